@@ -0,0 +1,201 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mirtchovski/clamav/httpscan"
+)
+
+// checkpoint is the state saved by -checkpoint. The walker visits files in a
+// fixed order, directory entries sorted by name, so the progress of a run is
+// the last file of the prefix of that order that has been completely scanned.
+// Files scanned out of order past that point are scanned again on resume.
+type checkpoint struct {
+	Args     []string  `json:"args"`
+	Root     int       `json:"root"` // index in Args of the tree holding Last
+	Last     string    `json:"last"` // empty if no file was completed yet
+	Summary  summary   `json:"summary"`
+	Infected []string  `json:"infected,omitempty"`
+	Updated  time.Time `json:"updated"`
+}
+
+// tracker follows the files from the walker to the workers and keeps the
+// checkpoint up to date.
+type tracker struct {
+	file string
+
+	mu      sync.Mutex
+	cp      checkpoint
+	next    uint64              // sequence number of the next file submitted
+	low     uint64              // every file before low is completed
+	pending map[string][]uint64 // submitted paths, to their sequence numbers
+	paths   map[uint64]int      // root of each submitted file
+	names   map[uint64]string
+	done    map[uint64]*record // completed past low; nil for skipped files
+}
+
+func newTracker(file string, args []string) *tracker {
+	return &tracker{
+		file:    file,
+		cp:      checkpoint{Args: args, Summary: summary{Type: "summary"}},
+		pending: map[string][]uint64{},
+		paths:   map[uint64]int{},
+		names:   map[uint64]string{},
+		done:    map[uint64]*record{},
+	}
+}
+
+// loadTracker resumes from the checkpoint in file. args must match those of
+// the interrupted run, or be empty to reuse them.
+func loadTracker(file string, args []string) (*tracker, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	t := newTracker(file, nil)
+	if err := json.Unmarshal(b, &t.cp); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if len(args) > 0 && strings.Join(args, "\x00") != strings.Join(t.cp.Args, "\x00") {
+		return nil, fmt.Errorf("%s: checkpoint is for %q, not %q", file, t.cp.Args, args)
+	}
+	return t, nil
+}
+
+// skipPath reports whether path, in tree i, comes before the checkpoint in
+// walk order and so was already scanned. For a directory it reports whether
+// everything under it was.
+func (t *tracker) skipPath(i int, path string, dir bool) bool {
+	if i != t.cp.Root || t.cp.Last == "" {
+		return i < t.cp.Root
+	}
+	c := walkCompare(path, t.cp.Last)
+	if dir && strings.HasPrefix(t.cp.Last, path+"/") {
+		return false
+	}
+	return c <= 0
+}
+
+// walkCompare orders paths as the walker visits them: component by component.
+func walkCompare(a, b string) int {
+	ac, bc := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(ac) && i < len(bc); i++ {
+		if c := strings.Compare(ac[i], bc[i]); c != 0 {
+			return c
+		}
+	}
+	return len(ac) - len(bc)
+}
+
+// submit is called by the walker for every file it sends to the workers.
+func (t *tracker) submit(root int, path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[path] = append(t.pending[path], t.next)
+	t.paths[t.next] = root
+	t.names[t.next] = path
+	t.next++
+}
+
+// complete is called by the workers once path has been scanned, with the
+// record reported for it or nil if it was skipped.
+func (t *tracker) complete(path string, r *record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seqs := t.pending[path]
+	if len(seqs) == 0 {
+		return
+	}
+	seq := seqs[0]
+	if len(seqs) == 1 {
+		delete(t.pending, path)
+	} else {
+		t.pending[path] = seqs[1:]
+	}
+	t.done[seq] = r
+	for {
+		r, ok := t.done[t.low]
+		if !ok {
+			break
+		}
+		t.cp.Root, t.cp.Last = t.paths[t.low], t.names[t.low]
+		t.count(r)
+		delete(t.done, t.low)
+		delete(t.paths, t.low)
+		delete(t.names, t.low)
+		t.low++
+	}
+}
+
+func (t *tracker) count(r *record) {
+	s := &t.cp.Summary
+	if r == nil {
+		s.Skipped++
+		return
+	}
+	s.Files++
+	s.Scanned += r.Scanned
+	switch r.Verdict {
+	case httpscan.VerdictInfected:
+		s.Infected++
+		t.cp.Infected = append(t.cp.Infected, r.Path)
+	case httpscan.VerdictError:
+		s.Errors++
+	}
+}
+
+// summary returns the totals of the files completed by earlier runs.
+func (t *tracker) summary() summary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cp.Summary
+}
+
+// save writes the checkpoint, atomically replacing the previous one.
+func (t *tracker) save() error {
+	t.mu.Lock()
+	t.cp.Updated = time.Now()
+	b, err := json.MarshalIndent(&t.cp, "", "\t")
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(t.file), filepath.Base(t.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), t.file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// remove deletes the checkpoint of a run that completed.
+func (t *tracker) remove() error {
+	err := os.Remove(t.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,265 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mirtchovski/clamav"
+	"github.com/mirtchovski/clamav/config"
+)
+
+// configFile is read by every subcommand after its flags are parsed, see
+// parseFlags, and logFile receives the log instead of stderr.
+var configFile = os.Getenv("AVCLIENT_CONFIG")
+var logFile string
+
+// configFlags maps the keys of the configuration file shared by the
+// subcommands to the flags they set. The keys of a table named after a
+// subcommand, e.g. [serve], are the names of its flags and override the
+// shared keys. The [engine] table sets the engine fields, see clamav.Fields.
+var configFlags = map[string]string{
+	"db":               "db",
+	"cache":            "cache",
+	"settings":         "settings",
+	"workers":          "workers",
+	"format":           "format",
+	"nosummary":        "nosummary",
+	"tree":             "tree",
+	"scan.options":     "scanopts",
+	"scan.profile":     "profile",
+	"scan.alert_max":   "alertexceedsmax",
+	"scan.encrypted":   "encrypted",
+	"scan.passwords":   "passwords",
+	"scan.include":     "include",
+	"scan.exclude":     "exclude",
+	"quarantine.dir":   "quarantine",
+	"quarantine.key":   "quarantinekey",
+	"log.file":         "log",
+	"log.debug":        "debug",
+	"log.clamav_debug": "clamavdebug",
+	"watchdog.stuck":   "stuck",
+	"watchdog.abort":   "abortstuck",
+}
+
+// quarantineActions are the values of the quarantine.action key, to the flags
+// they set
+var quarantineActions = map[string]string{"none": "", "move": "move", "copy": "copy", "remove": "remove"}
+
+// engineSetting is an engine field set in the configuration file
+type engineSetting struct {
+	field clamav.FieldInfo
+	num   uint64
+	str   string
+}
+
+// engineSettings are applied to every engine before the limits set by flags
+var engineSettings []engineSetting
+
+func applyEngineSettings(engine *clamav.Engine) error {
+	for _, s := range engineSettings {
+		var err error
+		if s.field.Type == clamav.FieldString {
+			err = engine.SetString(s.field.Field, s.str)
+		} else {
+			err = engine.SetNum(s.field.Field, s.num)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", s.field.Name, err)
+		}
+	}
+	return nil
+}
+
+// parseFlags parses the flags of a subcommand and completes them with the
+// configuration file: flags given on the command line override it.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	if configFile != "" {
+		if err := loadConfig(fs, configFile); err != nil {
+			fatal(err)
+		}
+	}
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fatal(err)
+		}
+		log.SetOutput(f)
+	}
+}
+
+func loadConfig(fs *flag.FlagSet, name string) error {
+	cfg, err := config.Load(name)
+	if err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	setFlag := func(v *config.Value, name string) error {
+		if set[name] || fs.Lookup(name) == nil {
+			return nil
+		}
+		if err := fs.Set(name, v.String()); err != nil {
+			return cfg.Errorf(v, "%s: %v", v.Key, err)
+		}
+		return nil
+	}
+
+	var own []*config.Value // keys of the table of this subcommand
+	for _, v := range cfg.Values {
+		i := strings.IndexByte(v.Key, '.')
+		table, key := "", v.Key
+		if i > 0 {
+			table, key = v.Key[:i], v.Key[i+1:]
+		}
+		switch flagName, ok := configFlags[v.Key]; {
+		case v.Key == "quarantine.action":
+			s, _ := v.Value.(string)
+			action, ok := quarantineActions[s]
+			if !ok {
+				return cfg.Errorf(v, "%s must be one of none, move, copy or remove", v.Key)
+			}
+			if action != "" && !set["move"] && !set["copy"] && !set["remove"] && fs.Lookup(action) != nil {
+				fs.Set(action, "true")
+			}
+		case ok:
+			if err := setFlag(v, flagName); err != nil {
+				return err
+			}
+		case table == "engine":
+			s, err := engineSettingOf(key, v)
+			if err != nil {
+				return cfg.Errorf(v, "%v", err)
+			}
+			engineSettings = append(engineSettings, s)
+		case table == fs.Name():
+			if fs.Lookup(key) == nil {
+				return cfg.Errorf(v, "%s has no flag -%s", fs.Name(), key)
+			}
+			own = append(own, v)
+		case isCommand(table):
+			// checked when that subcommand runs
+		default:
+			return cfg.Errorf(v, "unknown key %s", v.Key)
+		}
+	}
+	for _, v := range own {
+		if err := setFlag(v, v.Key[len(fs.Name())+1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isCommand(name string) bool {
+	for _, c := range commands {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// engineSettingOf converts the value of an engine field. Numbers may be
+// written as sizes, e.g. "25M", and booleans stand for 1 and 0.
+func engineSettingOf(name string, v *config.Value) (engineSetting, error) {
+	f, ok := clamav.FieldByName(name)
+	if !ok {
+		return engineSetting{}, fmt.Errorf("unknown engine field %s", name)
+	}
+	if f.ReadOnly {
+		return engineSetting{}, fmt.Errorf("engine field %s can not be set", name)
+	}
+	s := engineSetting{field: f}
+	switch x := v.Value.(type) {
+	case string:
+		if f.Type == clamav.FieldString {
+			s.str = x
+			return s, nil
+		}
+		var n size
+		if err := n.Set(x); err != nil {
+			return s, fmt.Errorf("engine.%s: %v", name, err)
+		}
+		s.num = uint64(n)
+	case int64:
+		if x < 0 {
+			return s, fmt.Errorf("engine.%s: negative value", name)
+		}
+		s.num = uint64(x)
+	case bool:
+		if x {
+			s.num = 1
+		}
+	default:
+		return s, fmt.Errorf("engine.%s: bad value %v", name, v)
+	}
+	if f.Type == clamav.FieldString {
+		return s, fmt.Errorf("engine.%s must be a string", name)
+	}
+	if f.Type == clamav.FieldUint32 && s.num > 1<<32-1 {
+		return s, fmt.Errorf("engine.%s: %d is too large", name, s.num)
+	}
+	return s, nil
+}
+
+// patterns are the -include and -exclude rules: shell patterns matched
+// against the base name of a file or directory, or against the whole path if
+// they contain a slash.
+type patterns []string
+
+func (p *patterns) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patterns) Set(v string) error {
+	*p = nil
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if _, err := filepath.Match(s, ""); err != nil {
+			return fmt.Errorf("bad pattern %q", s)
+		}
+		*p = append(*p, s)
+	}
+	return nil
+}
+
+func (p patterns) match(path string) bool {
+	for _, pat := range p {
+		name := path
+		if !strings.Contains(pat, "/") {
+			name = filepath.Base(path)
+		}
+		if ok, _ := filepath.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+var include, exclude patterns
+
+// wanted reports whether the file in path is to be scanned: it matches the
+// -include rules, if any, and neither it nor a directory above it matches
+// the -exclude rules.
+func wanted(path string) bool {
+	if len(include) > 0 && !include.match(path) {
+		return false
+	}
+	for p := path; p != "/" && p != "." && p != ""; p = filepath.Dir(p) {
+		if exclude.match(p) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,153 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// dbFile describes one file of the virus databases
+type dbFile struct {
+	Name       string    `json:"name"`
+	Version    uint      `json:"version,omitempty"` // only for .cvd and .cld containers
+	Signatures uint      `json:"signatures"`
+	Time       time.Time `json:"time"` // build time of a container, modification time otherwise
+	Builder    string    `json:"builder,omitempty"`
+}
+
+// dbSummary describes the virus databases without loading them into an
+// engine: the version and time are those of the newest container.
+type dbSummary struct {
+	Path       string    `json:"path"`
+	Files      []dbFile  `json:"files"`
+	Version    uint      `json:"version"`
+	Time       time.Time `json:"time"`
+	Signatures uint      `json:"signatures"`
+}
+
+// dbExts are the extensions of the files libclamav loads signatures from
+var dbExts = map[string]bool{
+	".cvd": true, ".cld": true, ".cud": true,
+	".db": true, ".hdb": true, ".hdu": true, ".hsb": true, ".hsu": true,
+	".mdb": true, ".mdu": true, ".msb": true, ".msu": true,
+	".ndb": true, ".ndu": true, ".ldb": true, ".ldu": true, ".idb": true,
+	".cdb": true, ".cbc": true, ".crb": true, ".cat": true,
+	".fp": true, ".sfp": true, ".ign": true, ".ign2": true,
+	".pdb": true, ".gdb": true, ".wdb": true, ".ftm": true, ".info": true,
+	".yar": true, ".yara": true,
+}
+
+// readDBSummary examines the database files in path, a directory or a single
+// file.
+func readDBSummary(path string) (*dbSummary, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []os.FileInfo{fi}
+	dir := filepath.Dir(path)
+	if fi.IsDir() {
+		if files, err = ioutil.ReadDir(path); err != nil {
+			return nil, err
+		}
+		dir = path
+	}
+	s := &dbSummary{Path: path}
+	for _, fi := range files {
+		ext := filepath.Ext(fi.Name())
+		if !fi.Mode().IsRegular() || !dbExts[ext] {
+			continue
+		}
+		p := filepath.Join(dir, fi.Name())
+		f := dbFile{Name: fi.Name(), Time: fi.ModTime()}
+		if ext == ".cvd" || ext == ".cld" {
+			cvd, err := clamav.CVDHead(p)
+			if err != nil {
+				return nil, err
+			}
+			f.Version, f.Signatures, f.Time, f.Builder = cvd.Version, cvd.Signatures, cvd.Time, cvd.Builder
+			if f.Version > s.Version {
+				s.Version = f.Version
+			}
+			if f.Time.After(s.Time) {
+				s.Time = f.Time
+			}
+		} else if f.Signatures, err = clamav.CountSigs(p, clamav.CountSigsAll); err != nil {
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+		s.Signatures += f.Signatures
+		s.Files = append(s.Files, f)
+	}
+	if len(s.Files) == 0 {
+		return nil, fmt.Errorf("%s: no virus databases", path)
+	}
+	return s, nil
+}
+
+// dbInfo describes the virus databases.
+func dbInfo(args []string) {
+	fs := newFlagSet("dbinfo", "[flags]")
+	dbFlag(fs)
+	asJSON := fs.Bool("json", false, "print the description as JSON")
+	parseFlags(fs, args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+	}
+
+	s, err := readDBSummary(db)
+	if err != nil {
+		fatal(err)
+	}
+	if *asJSON {
+		b, err := json.MarshalIndent(s, "", "\t")
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("%s\n", b)
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "FILE\tVERSION\tSIGNATURES\tBUILT\tBUILDER\n")
+	for _, f := range s.Files {
+		version := "-"
+		if f.Version > 0 {
+			version = fmt.Sprint(f.Version)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", f.Name, version, f.Signatures, f.Time.UTC().Format(time.RFC3339), f.Builder)
+	}
+	tw.Flush()
+	fmt.Printf("\n%d signatures in %s", s.Signatures, s.Path)
+	if s.Version > 0 {
+		fmt.Printf(", version %d built %s (%s ago)", s.Version, s.Time.UTC().Format(time.RFC3339), time.Since(s.Time).Round(time.Minute))
+	}
+	fmt.Println()
+}
+
+// version prints the version of libclamav and of the databases, as
+// clamscan --version does.
+func version(args []string) {
+	fs := newFlagSet("version", "[flags]")
+	dbFlag(fs)
+	parseFlags(fs, args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+	}
+
+	v := []string{"ClamAV " + clamav.Retver()}
+	if s, err := readDBSummary(db); err == nil && s.Version > 0 {
+		v = append(v, fmt.Sprint(s.Version), s.Time.UTC().Format(time.ANSIC))
+	}
+	fmt.Println(strings.Join(v, "/"))
+	fmt.Printf("functionality level %d\n", clamav.Retflevel())
+}
@@ -0,0 +1,61 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mirtchovski/clamav"
+	"github.com/mirtchovski/clamav/httpscan"
+)
+
+// extract scans files in forensic mode and copies what libclamav extracted
+// from each, archive members, decompressed streams and unpacked executables,
+// to a directory of its own under -out, with a manifest, see
+// clamav.Extractor.
+func extract(args []string) {
+	fs := newFlagSet("extract", "-out dir [flags] file...")
+	engineFlags(fs)
+	out := fs.String("out", "", "directory receiving a directory of extracted files and a "+clamav.ManifestName+" for each file")
+	parseFlags(fs, args)
+	if *out == "" || fs.NArg() == 0 {
+		fs.Usage()
+	}
+
+	engine := initClamAV()
+	defer engine.Free()
+	x := clamav.NewExtractor(engine)
+	code := exitClean
+	for i, path := range fs.Args() {
+		dir := filepath.Join(*out, fmt.Sprintf("%03d-%s", i+1, filepath.Base(path)))
+		m, err := x.ExtractPath(path, dir, scanOpts.or(httpscan.DefaultOptions), path)
+		switch {
+		case m == nil:
+			log.Printf("error extracting %s: %v", path, err)
+			code = exitError
+			continue
+		case err != nil:
+			log.Printf("error scanning %s: %v", path, err)
+			if code == exitClean {
+				code = exitError
+			}
+		case m.Result.Infected():
+			fmt.Printf("%s: %s FOUND\n", path, m.Result.Virus)
+			code = exitVirus
+		default:
+			fmt.Printf("%s: OK\n", path)
+		}
+		fmt.Printf("%s: %d files extracted to %s\n", path, len(m.Files), dir)
+		if m.Result.Tree != nil {
+			for _, chain := range m.Result.Tree.Detections() {
+				fmt.Printf("  in %s\n", clamav.ChainString(chain))
+			}
+		}
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,409 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+	"github.com/mirtchovski/clamav/procpool"
+	"github.com/mirtchovski/clamav/watchdog"
+)
+
+// Options shared by the subcommands. Each subcommand registers the ones it
+// uses on its own flag set with dbFlag, engineFlags and actionFlags, so that
+// they are spelled, documented and parsed the same everywhere.
+var (
+	db          = clamav.DBDir()
+	debug       bool
+	clamavdebug bool
+	cacheDir    string
+	limits      engineLimits
+	scanOpts    scanOptions
+	profileName string
+	alertMax    bool
+	encrypted   encryptedPolicy
+	passwords   string
+	stuckAfter  = watchdog.DefaultThreshold
+	abortStuck  bool
+)
+
+// Options of the subcommands that act on infected files and report results
+var (
+	workers       = 8
+	quarantineDir string
+	quarantineKey string
+	move          bool
+	cpy           bool
+	remove        bool
+	format        = formatText
+	nosummary     bool
+	tree          bool
+)
+
+// newFlagSet returns the flag set of a subcommand, whose usage line shows
+// synopsis after the subcommand's name.
+func newFlagSet(name, synopsis string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s %s %s\n", os.Args[0], name, synopsis)
+		fs.PrintDefaults()
+		os.Exit(exitError)
+	}
+	return fs
+}
+
+// dbFlag registers the database location and the configuration file.
+func dbFlag(fs *flag.FlagSet) {
+	fs.StringVar(&db, "db", db, "virus definition database")
+	fs.StringVar(&configFile, "config", configFile, "configuration file, $AVCLIENT_CONFIG by default; flags override it")
+}
+
+// engineFlags registers the options of the subcommands that load an engine.
+func engineFlags(fs *flag.FlagSet) {
+	dbFlag(fs)
+	fs.BoolVar(&debug, "debug", debug, "enable debugging output")
+	fs.BoolVar(&clamavdebug, "clamavdebug", clamavdebug, "enable debugging output from the ClamAV engine")
+	fs.StringVar(&logFile, "log", logFile, "append the log to this file instead of writing it to stderr")
+	fs.StringVar(&settingsFile, "settings", settingsFile, "apply the engine fields saved in this file by the settings subcommand; the other flags override them")
+	fs.StringVar(&cacheDir, "cache", cacheDir, "directory of cached verdicts, shared between runs and processes")
+	fs.Var(&limits.maxFilesize, "maxfilesize", "skip files larger than this, e.g. 25M (the engine's default if not set)")
+	fs.Var(&limits.maxScansize, "maxscansize", "scan at most this much data of each file, archive members included, e.g. 100M")
+	fs.UintVar(&limits.maxRecursion, "maxrecursion", limits.maxRecursion, "how deep to descend into nested archives (0 for the engine's default)")
+	fs.UintVar(&limits.maxFiles, "maxfiles", limits.maxFiles, "how many files to scan in each archive (0 for the engine's default)")
+	fs.Var(&scanOpts, "scanopts", "comma separated scan options, "+scanOptionList()+"; -name removes an option set before it, e.g. std,-archive (the subcommand's default if not set)")
+	fs.StringVar(&profileName, "profile", profileName, "scan with the options and limits of a profile: "+profileList()+"; -scanopts and the limit flags override it")
+	fs.BoolVar(&alertMax, "alertexceedsmax", alertMax, "report the files not fully scanned because of a limit as infected with "+clamav.LimitsExceeded)
+	fs.Var(&encrypted, "encrypted", "what to do with encrypted archives and documents: allow, report (in the results, without changing the verdict) or block (as infected)")
+	fs.StringVar(&passwords, "passwords", passwords, "file of passwords to try on encrypted zip archives, one per line, optionally as name:password")
+	fs.DurationVar(&stuckAfter, "stuck", stuckAfter, "log the scans running longer than this, with the inner file they are on")
+	fs.BoolVar(&abortStuck, "abortstuck", abortStuck, "abort the scans running longer than -stuck")
+}
+
+// actionFlags registers the options of the subcommands that scan files and
+// act on infected ones.
+func actionFlags(fs *flag.FlagSet) {
+	fs.IntVar(&workers, "workers", workers, "number of scanning workers")
+	fs.StringVar(&quarantineDir, "quarantine", quarantineDir, "quarantine directory used by -move and -copy")
+	fs.StringVar(&quarantineKey, "quarantinekey", quarantineKey, "file holding a hex AES key to encrypt quarantined files; they are neutered if not set")
+	fs.BoolVar(&move, "move", move, "move infected files to the quarantine")
+	fs.BoolVar(&cpy, "copy", cpy, "copy infected files to the quarantine")
+	fs.BoolVar(&remove, "remove", remove, "remove infected files, without quarantining them unless -move or -copy is also set")
+	fs.StringVar(&format, "format", format, "output format: text, json (one object per line), csv or sarif")
+	fs.BoolVar(&nosummary, "nosummary", nosummary, "do not print the SCAN SUMMARY at the end")
+	fs.BoolVar(&tree, "tree", tree, "report the objects found in each file, such as archive members: as a tree in the json format, as the chain leading to each detection otherwise")
+	fs.Var(&include, "include", "comma separated patterns of the files to scan, all if not set; patterns with a slash match the whole path, others the base name")
+	fs.Var(&exclude, "exclude", "comma separated patterns of the files and directories not to scan")
+}
+
+// size is a number of bytes, set from flags such as 100M.
+type size uint64
+
+func (s *size) String() string {
+	switch {
+	case *s == 0:
+		return ""
+	case *s%(1<<30) == 0:
+		return fmt.Sprintf("%dG", *s>>30)
+	case *s%(1<<20) == 0:
+		return fmt.Sprintf("%dM", *s>>20)
+	case *s%(1<<10) == 0:
+		return fmt.Sprintf("%dK", *s>>10)
+	}
+	return strconv.FormatUint(uint64(*s), 10)
+}
+
+func (s *size) Set(v string) error {
+	if v == "" {
+		return fmt.Errorf("bad size %q", v)
+	}
+	shift := uint(0)
+	switch strings.ToUpper(v[len(v)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	}
+	if shift > 0 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || n > (1<<64-1)>>shift {
+		return fmt.Errorf("bad size %q", v)
+	}
+	*s = size(n << shift)
+	return nil
+}
+
+// engineLimits are the engine's limits set from the flags; zero values keep
+// the engine's defaults.
+type engineLimits struct {
+	maxFilesize  size
+	maxScansize  size
+	maxRecursion uint
+	maxFiles     uint
+}
+
+func (l *engineLimits) apply(engine *clamav.Engine) error {
+	set := []struct {
+		field clamav.EngineField
+		val   uint64
+	}{
+		{clamav.EngineMaxFilesize, uint64(l.maxFilesize)},
+		{clamav.EngineMaxScansize, uint64(l.maxScansize)},
+		{clamav.EngineMaxRecursion, uint64(l.maxRecursion)},
+		{clamav.EngineMaxFiles, uint64(l.maxFiles)},
+	}
+	for _, s := range set {
+		if s.val == 0 {
+			continue
+		}
+		if err := engine.SetNum(s.field, s.val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptedPolicy is the clamav.EncryptedPolicy set with -encrypted.
+type encryptedPolicy struct {
+	p clamav.EncryptedPolicy
+}
+
+func (e *encryptedPolicy) String() string {
+	return e.p.String()
+}
+
+func (e *encryptedPolicy) Set(v string) error {
+	p, err := clamav.ParseEncryptedPolicy(v)
+	if err != nil {
+		return err
+	}
+	e.p = p
+	return nil
+}
+
+// loadPasswords loads the passwords of -passwords into the engine.
+func loadPasswords(engine *clamav.Engine) error {
+	if passwords == "" {
+		return nil
+	}
+	f, err := os.Open(passwords)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	pws, err := clamav.ReadPasswords(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", passwords, err)
+	}
+	return engine.LoadPasswords(pws)
+}
+
+// scanOptionNames are the names of the scan options accepted by -scanopts
+var scanOptionNames = []struct {
+	name string
+	opt  uint
+}{
+	{"std", clamav.ScanStdopt},
+	{"archive", clamav.ScanArchive},
+	{"mail", clamav.ScanMail},
+	{"ole2", clamav.ScanOle2},
+	{"html", clamav.ScanHTML},
+	{"pe", clamav.ScanPe},
+	{"elf", clamav.ScanElf},
+	{"pdf", clamav.ScanPdf},
+	{"swf", clamav.ScanSwf},
+	{"algorithmic", clamav.ScanAlgorithmic},
+	{"blockencrypted", clamav.ScanBlockencrypted},
+	{"blockbroken", clamav.ScanBlockbroken},
+	{"blockmacros", clamav.ScanBlockmacros},
+	{"phishingssl", clamav.ScanPhishingBlockSSL},
+	{"phishingcloak", clamav.ScanPhishingBlockCloak},
+	{"structured", clamav.ScanStructured},
+	{"ssnnormal", clamav.ScanStructuredSSNNormal},
+	{"ssnstripped", clamav.ScanStructuredSSNStripped},
+	{"partial", clamav.ScanPartialMessage},
+	{"heuristicprecedence", clamav.ScanHeuristicPrecedence},
+	{"partitionintxn", clamav.ScanPartitionIntxn},
+	{"allmatches", clamav.ScanAllmatches},
+}
+
+func scanOptionList() string {
+	var names []string
+	for _, o := range scanOptionNames {
+		names = append(names, o.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// scanOptions are the scan options set with -scanopts, zero if not set.
+type scanOptions uint
+
+// or returns the options, or those of the -profile, or def if neither was
+// set.
+func (o scanOptions) or(def uint) uint {
+	if o != 0 {
+		return uint(o)
+	}
+	if p := selectedProfile(); p != nil && p.Options != 0 {
+		return p.Options
+	}
+	return def
+}
+
+func (o *scanOptions) String() string {
+	var names []string
+	rest := uint(*o)
+	for _, n := range scanOptionNames {
+		if n.opt != 0 && rest&n.opt == n.opt {
+			names = append(names, n.name)
+			rest &^= n.opt
+		}
+	}
+	if rest != 0 {
+		names = append(names, fmt.Sprintf("%#x", rest))
+	}
+	return strings.Join(names, ",")
+}
+
+func (o *scanOptions) Set(v string) error {
+	var opts uint
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		del := strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+		found := false
+		for _, n := range scanOptionNames {
+			if n.name == name {
+				if del {
+					opts &^= n.opt
+				} else {
+					opts |= n.opt
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown scan option %q", name)
+		}
+	}
+	if opts == 0 {
+		// raw scanning, which is also the zero value meaning not set
+		return fmt.Errorf("no scan option left in %q", v)
+	}
+	*o = scanOptions(opts)
+	return nil
+}
+
+func profileList() string {
+	var names []string
+	for _, p := range clamav.DefaultProfiles {
+		names = append(names, p.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// findProfile returns the default profile called name.
+func findProfile(name string) *clamav.Profile {
+	p, ok := clamav.ProfileByName(clamav.DefaultProfiles, name)
+	if !ok {
+		fatalf("unknown profile %q, want one of %s", name, profileList())
+	}
+	return &p
+}
+
+// selectedProfile returns the profile set with -profile, nil if none was.
+func selectedProfile() *clamav.Profile {
+	if profileName == "" {
+		return nil
+	}
+	return findProfile(profileName)
+}
+
+// dog watches the scans in progress, see startWatchdog
+var dog = watchdog.New(watchdog.DefaultThreshold)
+
+// startWatchdog starts checking for stuck scans.
+func startWatchdog() {
+	dog.Threshold = stuckAfter
+	dog.Abort = abortStuck
+	go dog.Run(nil)
+}
+
+// newReloader loads the databases into an engine that follows their updates.
+func newReloader() *clamav.Reloader {
+	log.Println("initializing ClamAV database...")
+	startWatchdog()
+	clamav.SetLogger(slog.Default())
+	clamav.Init(clamav.InitDefault)
+	if clamavdebug {
+		clamav.Debug()
+	}
+	engine, err := clamav.NewReloader(db, clamav.DbStdopt, setupEngine)
+	if err != nil {
+		fatalf("can not initialize ClamAV engine: %v", err)
+	}
+	return engine
+}
+
+// newPool starts n worker processes scanning with their own engines, see
+// package procpool. In the workers it does not return.
+func newPool(n int, maxMemory uint64, maxCPU time.Duration) *procpool.Pool {
+	if !procpool.IsWorker() {
+		log.Printf("starting %d scanning processes...", n)
+	}
+	startWatchdog() // in the workers, where the scans run
+	clamav.SetLogger(slog.Default())
+	clamav.Init(clamav.InitDefault)
+	if clamavdebug {
+		clamav.Debug()
+	}
+	pool, err := procpool.New(procpool.Config{
+		Workers:   n,
+		DB:        db,
+		Setup:     setupEngine,
+		MaxMemory: maxMemory,
+		MaxCPU:    maxCPU,
+	})
+	if err != nil {
+		fatalf("can not start the scanning processes: %v", err)
+	}
+	return pool
+}
+
+// newProfileScanner loads an engine for each of the comma separated profiles,
+// see clamav.ProfileScanner.
+func newProfileScanner(names string) *clamav.ProfileScanner {
+	var profiles []clamav.Profile
+	for _, name := range strings.Split(names, ",") {
+		profiles = append(profiles, *findProfile(strings.TrimSpace(name)))
+	}
+	log.Printf("initializing ClamAV database for profiles %s...", names)
+	startWatchdog()
+	clamav.SetLogger(slog.Default())
+	clamav.Init(clamav.InitDefault)
+	if clamavdebug {
+		clamav.Debug()
+	}
+	ps, err := clamav.NewProfileScanner(db, clamav.DbStdopt, setupEngine, profiles...)
+	if err != nil {
+		fatalf("can not initialize ClamAV engine: %v", err)
+	}
+	if debug {
+		log.Printf("loaded %d engines for %d profiles", ps.Engines(), len(profiles))
+	}
+	return ps
+}
@@ -7,6 +7,11 @@
 // directories as arguments and will crawl them (recursively) scanning every file. This code will
 // not follow symlinks but will also not make an effort to stay on the same computer. If you have
 // remote mounted filesystems this code will scan all files available on them.
+//
+// avclient is organized in subcommands, run avclient help for the list. The
+// scan subcommand is the one described above and is also run when no
+// subcommand is given. The options of the engine, databases and limits are
+// the same flags in every subcommand.
 package main
 
 // The code will spawn 8 scanners on 2 OS threads by default but uses only one ClamAV engine. You
@@ -16,31 +21,96 @@ package main
 // The code has been tested on Linux and OSX
 
 import (
-	"flag"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"os"
-	"runtime"
+	"strings"
+	"sync/atomic"
+)
+
+import (
+	"github.com/mirtchovski/clamav"
+	"github.com/mirtchovski/clamav/cache"
+	"github.com/mirtchovski/clamav/httpscan"
+	"github.com/mirtchovski/clamav/index"
+	"github.com/mirtchovski/clamav/quarantine"
+)
+
+// command is an avclient subcommand. Each parses its own flags, see
+// newFlagSet.
+type command struct {
+	name  string
+	run   func(args []string)
+	short string
+}
+
+// commands is set by init, since loadConfig refers to it
+var commands []command
+
+func init() {
+	commands = []command{
+		{"scan", scanPaths, "scan files and directory trees"},
+		{"watch", watchDirs, "scan files as they are written into directories"},
+		{"onaccess", onAccess, "scan files as they are opened and deny access to infected ones"},
+		{"serve", serve, "run the HTTP, ICAP and milter scanning services"},
+		{"dbinfo", dbInfo, "describe the virus databases"},
+		{"sigtool", sigtool, "inspect database files and make hash signatures"},
+		{"quarantine", manageQuarantine, "list, restore and delete quarantined files"},
+		{"settings", settings, "print the engine settings or compare them with a saved copy"},
+		{"extract", extract, "copy the files libclamav extracts while scanning, with a manifest"},
+		{"version", version, "print the versions of ClamAV and of the databases"},
+	}
+}
+
+// Exit codes, as clamscan's
+const (
+	exitClean = 0 // no virus found
+	exitVirus = 1 // some virus found
+	exitError = 2 // some errors occurred and no virus was found
 )
 
-import "github.com/mirtchovski/clamav"
+// walkOnly is set by scan -walkonly
+var walkOnly bool
+
+// legacy is set when scan runs without a subcommand, as before there were
+// subcommands, and takes the flags of then too.
+var legacy bool
+
+// directories counts the directories visited by the walker, walkErrors the
+// paths it could not examine
+var directories, walkErrors uint64
+
+// track follows the progress of the scan for -checkpoint, and walkRoot is the
+// index of the argument being walked.
+var track *tracker
+var walkRoot int
 
-var debug = flag.Bool("debug", false, "enable debugging output")
-var clamavdebug = flag.Bool("clamavdebug", false, "enable debugging output from the ClamAV engine")
-var clamavversion = flag.Bool("clamavversion", false, "print out the version of ClamAV linked")
-var scan = flag.Bool("scan", true, "don't scan files for viruses, only walk directories")
-var workers = flag.Int("workers", 8, "number of scanning workers")
-var cpus = flag.Int("cpus", 2, "number of active OS threads")
-var db = flag.String("db", clamav.DBDir(), "virus definition database")
-var testmap = flag.Bool("testfmap", false, "test memory scanning only")
+// stopping is set when the scan is interrupted: the walker stops, the workers
+// finish the scans in progress and drop the files still queued.
+var stopping int32
 
 var eicar = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
 
+func fatal(v ...interface{}) {
+	log.Print(v...)
+	os.Exit(exitError)
+}
+
+func fatalf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	os.Exit(exitError)
+}
+
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: %s path [...]\n", os.Args[0])
-	flag.PrintDefaults()
-	os.Exit(1)
+	fmt.Fprintf(os.Stderr, "usage: %s command [flags] [arguments]\n\ncommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-11s %s\n", c.name, c.short)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s help command for the flags of a command. Without a command the\narguments are passed to scan.\n", os.Args[0])
+	os.Exit(exitError)
 }
 
 // A counter goroutine sits between the walker and the workers and keeps track
@@ -58,28 +128,148 @@ func counter(cnt, out chan string) {
 	close(out)
 }
 
+// scanConfig is what the workers need to scan a file and act on the result.
+type scanConfig struct {
+	scanner clamav.Scanner
+	store   *quarantine.Store // nil unless -move or -copy
+	rep     *report
+	index   *index.Index // nil unless -index
+}
+
 // Workers receive file names on 'in', scan them, and output the results on 'out'
-func worker(in, cnt chan string, done chan bool, engine *clamav.Engine) {
+func worker(in, cnt chan string, done chan bool, cfg *scanConfig) {
 	for path := range in {
-		if *debug {
+		if atomic.LoadInt32(&stopping) != 0 {
+			continue
+		}
+		if debug {
 			log.Printf("scanning %s", path)
 		}
-		if *scan {
-			virus, _, err := engine.ScanFileCb(path, clamav.ScanStdopt|clamav.ScanAllmatches, path)
-			if virus != "" {
-				log.Printf("virus found in %s: %s", path, virus)
-			} else if err != nil {
-				log.Printf("error scanning %s: %v", path, err)
+		if !walkOnly {
+			r := scanFile(cfg, path)
+			if track != nil {
+				track.complete(path, r)
 			}
 		}
 	}
 	done <- true
 }
 
+// scanFile scans a file and quarantines or removes it if infected. The file
+// is opened once, without following symlinks, so the index and the actions
+// apply to the very file that was scanned even if the path is replaced
+// meanwhile. It returns the record reported, or nil if the index skipped the
+// file.
+func scanFile(cfg *scanConfig, path string) *record {
+	f, err := quarantine.OpenFile(path)
+	if err != nil {
+		return cfg.rep.result(path, &clamav.Result{Path: path, Code: clamav.Eopen}, err)
+	}
+	defer f.Close()
+
+	context := clamav.WithAttrs(path, slog.String("path", path))
+	if tree {
+		context = clamav.WithTree(context)
+	}
+	opts := scanOpts.or(httpscan.DefaultOptions)
+
+	var db *clamav.DBInfo
+	k := clamav.IndexKey{Opts: opts}
+	fi, err := f.Stat()
+	if cfg.index != nil && err == nil {
+		if k.Key, err = clamav.ScanKey(cfg.scanner, context); err == nil {
+			db, err = cfg.scanner.DBInfo()
+		}
+		if err != nil {
+			db = nil // not indexed
+		}
+		if k.DB = db; db != nil && cfg.index.Skip(path, f, fi, k) {
+			cfg.rep.skipped(path)
+			return nil
+		}
+	}
+
+	res, err := cfg.scanner.ScanFd(int(f.Fd()), opts, context)
+	res.Path = path
+	if res.Tree != nil {
+		res.Tree.Name = path
+	}
+	if db != nil && err == nil {
+		if err := cfg.index.Record(path, f, fi, res, k); err != nil {
+			log.Printf("error indexing %s: %v", path, err)
+		}
+	}
+	r := cfg.rep.result(path, res, err)
+	if err != nil || !res.Infected() || !(move || cpy || remove) {
+		return r
+	}
+
+	if cfg.store == nil || !(move || cpy) {
+		// -remove alone deletes the file, quarantine directory or not
+		if err := quarantine.Remove(f, path); err != nil {
+			log.Printf("error removing %s: %v", path, err)
+			return r
+		}
+		log.Printf("removed %s", path)
+		return r
+	}
+	if db == nil {
+		db, _ = cfg.scanner.DBInfo()
+	}
+	e, err := cfg.store.Add(f, path, res, db, move || remove)
+	if e != nil {
+		log.Printf("quarantined %s as %s", path, e.ID)
+	}
+	if err != nil {
+		log.Printf("error quarantining %s: %v", path, err)
+	} else if e.Removed {
+		log.Printf("removed %s", path)
+	}
+	return r
+}
+
+// openCache wraps s with the verdict cache in -cache.
+func openCache(s clamav.Scanner) clamav.Scanner {
+	c, err := cache.Open(cacheDir)
+	if err != nil {
+		fatal(err)
+	}
+	return cache.NewScanner(s, c)
+}
+
+// openQuarantine opens the store used by the -move and -copy actions.
+func openQuarantine() *quarantine.Store {
+	if quarantineDir == "" {
+		if move || cpy {
+			fatal("-move and -copy need a -quarantine directory")
+		}
+		return nil
+	}
+	store, err := quarantine.Open(quarantineDir)
+	if err != nil {
+		fatal(err)
+	}
+	if quarantineKey == "" {
+		store.Neuter = true
+		return store
+	}
+	b, err := ioutil.ReadFile(quarantineKey)
+	if err != nil {
+		fatal(err)
+	}
+	if store.Key, err = hex.DecodeString(strings.TrimSpace(string(b))); err != nil {
+		fatalf("bad key in %s: %v", quarantineKey, err)
+	}
+	return store
+}
+
 // Walker visits every file inside path, recursing into subdirectories
 // and sending all filenames it encounters on "in"
 func walker(path string, in chan string) {
-	if *debug {
+	if atomic.LoadInt32(&stopping) != 0 {
+		return
+	}
+	if debug {
 		log.Printf("examining %s", path)
 	}
 	// When encountering a symlink to a directory Lstat will return false for IsDir, but Stat will
@@ -87,18 +277,30 @@ func walker(path string, in chan string) {
 	lfi, err := os.Lstat(path)
 	if err != nil {
 		log.Printf("%v", err)
+		walkErrors++
 		return
 	}
 	if lfi.Mode()&os.ModeSymlink != 0 {
-		if *debug {
+		if debug {
 			log.Printf("skipping symlink %s\n", path)
 		}
 		return
 	}
+	if track != nil && track.skipPath(walkRoot, path, lfi.IsDir()) {
+		return
+	}
+	if exclude.match(path) {
+		if debug {
+			log.Printf("skipping excluded %s", path)
+		}
+		return
+	}
 	if lfi.IsDir() {
+		directories++
 		dir, err := ioutil.ReadDir(path)
 		if err != nil {
 			log.Printf("%v", err)
+			walkErrors++
 			return
 		}
 		for _, v := range dir {
@@ -109,16 +311,20 @@ func walker(path string, in chan string) {
 	fi, err := os.Stat(path)
 	if err != nil {
 		log.Printf("%v", err)
+		walkErrors++
 		return
 	}
-	if fi.IsDir() {
+	if fi.IsDir() || len(include) > 0 && !include.match(path) {
 		return
 	}
+	if track != nil {
+		track.submit(walkRoot, path)
+	}
 	in <- path
 }
 
 func preCacheCb(fd int, ftype string, context interface{}) clamav.ErrorCode {
-	if *debug {
+	if debug {
 		log.Printf("pre cache callback for %s: fd=%d ftype=%s", context, fd, ftype)
 	}
 
@@ -126,7 +332,7 @@ func preCacheCb(fd int, ftype string, context interface{}) clamav.ErrorCode {
 }
 
 func preScanCb(fd int, ftype string, context interface{}) clamav.ErrorCode {
-	if *debug {
+	if debug {
 		log.Printf("pre scan callback for %s: fd=%d ftype=%s", context, fd, ftype)
 	}
 
@@ -134,7 +340,7 @@ func preScanCb(fd int, ftype string, context interface{}) clamav.ErrorCode {
 }
 
 func postScanCb(fd int, result clamav.ErrorCode, virname string, context interface{}) clamav.ErrorCode {
-	if *debug {
+	if debug {
 		log.Printf("post scan callback for %s: fd=%d result=%s virus=%s", context, fd, clamav.StrError(result), virname)
 	}
 
@@ -142,95 +348,86 @@ func postScanCb(fd int, result clamav.ErrorCode, virname string, context interfa
 }
 
 func hashCb(fd int, size uint64, md5 []byte, virname string, context interface{}) {
-	if *debug {
+	if debug {
 		log.Printf("hash callback for %s: fd=%d size=%d md5=%s virus=%s", context, fd, size, md5, virname)
 	}
 
 	return
 }
 
+// setupEngine sets the callbacks, the fields from the configuration file and
+// the -settings snapshot, the limits of the -profile, the -passwords and the
+// limits on a new engine, before it is compiled
+func setupEngine(engine *clamav.Engine) error {
+	engine.SetPreCacheCallback(preCacheCb)
+	engine.SetPreScanCallback(preScanCb)
+	engine.SetPostScanCallback(postScanCb)
+	engine.SetHashCallback(hashCb)
+	if err := applyEngineSettings(engine); err != nil {
+		return err
+	}
+	if err := applySettingsFile(engine); err != nil {
+		return err
+	}
+	if p := selectedProfile(); p != nil {
+		if err := p.Apply(engine); err != nil {
+			return err
+		}
+	}
+	if err := loadPasswords(engine); err != nil {
+		return err
+	}
+	return limits.apply(engine)
+}
+
 func initClamAV() *clamav.Engine {
+	startWatchdog()
+	clamav.SetLogger(slog.Default())
 	clamav.Init(clamav.InitDefault)
+	if clamavdebug {
+		clamav.Debug()
+	}
 	engine := clamav.New()
-	sigs, err := engine.Load(*db, clamav.DbStdopt)
+	if err := setupEngine(engine); err != nil {
+		fatalf("can not initialize ClamAV engine: %v", err)
+	}
+	sigs, err := engine.Load(db, clamav.DbStdopt)
 	if err != nil {
-		log.Fatalf("can not initialize ClamAV engine: %v", err)
+		fatalf("can not initialize ClamAV engine: %v", err)
 	}
-	if *debug {
+	if debug {
 		log.Printf("loaded %d signatures", sigs)
 	}
 
-	engine.SetPreCacheCallback(preCacheCb)
-	engine.SetPreScanCallback(preScanCb)
-	engine.SetPostScanCallback(postScanCb)
-	engine.SetHashCallback(hashCb)
-
 	engine.Compile()
 
 	return engine
 }
 
 func main() {
-	var engine *clamav.Engine
-
-	flag.Usage = usage
-	flag.Parse()
-
-	if *clamavversion {
-		fmt.Println(clamav.Retver())
-		os.Exit(0)
-	}
-
-	args := flag.Args()
-	if len(args) == 0 && !*testmap {
-		fmt.Fprintln(os.Stderr, "error: missing path")
+	if len(os.Args) < 2 {
 		usage()
 	}
-
-	runtime.GOMAXPROCS(*cpus)
-
-	if *scan {
-		log.Println("initializing ClamAV database...")
-		engine = initClamAV()
-	}
-
-	if *testmap {
-		fmap := clamav.OpenMemory(eicar)
-		defer clamav.CloseMemory(fmap)
-
-		virus, _, err := engine.ScanMapCb(fmap, clamav.ScanStdopt|clamav.ScanAllmatches, "eicar memorytest")
-		if err != nil {
-			log.Printf("error scanning in-memory: %v\n", err)
+	name, args := os.Args[1], os.Args[2:]
+	switch name {
+	case "help", "-h", "-help", "--help":
+		if len(args) == 0 {
+			usage()
 		}
-		log.Printf("in-memory scan result: %s (eicar)\n", virus)
-		return
+		name, args = args[0], []string{"-h"}
 	}
-
-	in := make(chan string, 1024)
-	cnt := make(chan string, 1024)
-	out := make(chan string, 1024)
-	done := make(chan bool, *workers)
-
-	log.Println("scan starting...")
-
-	if *clamavdebug {
-		clamav.Debug()
-	}
-
-	for i := 0; i < *workers; i++ {
-		go worker(cnt, out, done, engine)
-	}
-
-	go counter(in, cnt)
-
-	for _, v := range args {
-		walker(v, in)
+	for _, c := range commands {
+		if c.name == name {
+			c.run(args)
+			return
+		}
 	}
-
-	close(in)
-	for i := 0; i < *workers; i++ {
-		<-done
+	// scan flags or paths without a command, as before there were commands
+	if _, err := os.Lstat(name); name == os.Args[1] && (err == nil || strings.HasPrefix(name, "-")) {
+		legacy = true
+		scanPaths(os.Args[1:])
+		return
 	}
-
-	log.Println("scan completed...")
+	fmt.Fprintf(os.Stderr, "%s: unknown command %q\n", os.Args[0], name)
+	usage()
 }
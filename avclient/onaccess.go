@@ -0,0 +1,86 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/mirtchovski/clamav"
+	"github.com/mirtchovski/clamav/fanotify"
+	"github.com/mirtchovski/clamav/httpscan"
+)
+
+// onAccess scans files as they are opened on the given mount points and
+// denies access to infected ones.
+func onAccess(args []string) {
+	fs := newFlagSet("onaccess", "[flags] mount [...]")
+	engineFlags(fs)
+	dirs := fs.Bool("dirs", false, "watch only the files directly inside the given directories instead of whole mounts")
+	timeout := fs.Duration("timeout", fanotify.DefaultTimeout, "allow an open if its scan takes longer than this")
+	deny := fs.Bool("deny", false, "deny opens that could not be scanned or timed out")
+	exclude := fs.String("exclude", "", "comma separated path prefixes that are never scanned")
+	fs.IntVar(&workers, "workers", workers, "number of scanning workers")
+	parseFlags(fs, args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+	}
+
+	engine := newReloader()
+	defer engine.Close()
+
+	var scanner clamav.Scanner = engine
+	if cacheDir != "" {
+		scanner = openCache(scanner)
+	}
+	scanner = clamav.WithEncryptedPolicy(scanner, encrypted.p)
+	if alertMax {
+		scanner = clamav.AlertExceedsMax(scanner)
+	}
+
+	m, err := fanotify.New(scanner)
+	if err != nil {
+		fatal(err)
+	}
+	m.Options = scanOpts.or(httpscan.DefaultOptions)
+	m.Timeout = *timeout
+	m.DenyOnError = *deny
+	m.Workers = workers
+	if *exclude != "" {
+		m.Exclude = strings.Split(*exclude, ",")
+	}
+	m.OnInfected = func(path string, res *clamav.Result, pid int, denied bool) {
+		action := "reported"
+		if denied {
+			action = "denied"
+		}
+		log.Printf("virus found in %s opened by pid %d: %s (%s)", path, pid, res.Virus, action)
+	}
+	for _, p := range fs.Args() {
+		if *dirs {
+			err = m.MarkDir(p)
+		} else {
+			err = m.MarkMount(p)
+		}
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		log.Println("stopping...")
+		m.Close()
+	}()
+	log.Printf("scanning on access under %v", fs.Args())
+	if err := m.Run(); err != nil {
+		fatal(err)
+	}
+}
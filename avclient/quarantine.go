@@ -0,0 +1,98 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mirtchovski/clamav/quarantine"
+)
+
+// manageQuarantine lists, shows, restores and deletes the files kept in a
+// quarantine directory.
+func manageQuarantine(args []string) {
+	fs := newFlagSet("quarantine", "-quarantine dir [flags] list|show|restore|delete|purge [id ...]")
+	fs.StringVar(&quarantineDir, "quarantine", quarantineDir, "quarantine directory")
+	fs.StringVar(&quarantineKey, "quarantinekey", quarantineKey, "file holding the hex AES key of encrypted entries")
+	asJSON := fs.Bool("json", false, "list the entries as JSON, one per line; show always prints JSON")
+	dest := fs.String("dest", "", "restore to this path instead of the original location (a single id only)")
+	olderThan := fs.Duration("olderthan", 30*24*time.Hour, "purge entries quarantined longer ago than this")
+	parseFlags(fs, args)
+	if fs.NArg() == 0 || quarantineDir == "" {
+		fs.Usage()
+	}
+	store := openQuarantine()
+	op, ids := fs.Arg(0), fs.Args()[1:]
+
+	code := exitClean
+	switch op {
+	case "list":
+		list, err := store.List()
+		if err != nil {
+			fatal(err)
+		}
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			for _, e := range list {
+				enc.Encode(e)
+			}
+			break
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "ID\tQUARANTINED\tSIZE\tVIRUS\tPATH\n")
+		for _, e := range list {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", e.ID, e.Quarantined.Format(time.RFC3339), e.Size, strings.Join(e.Matches, ","), e.Path)
+		}
+		tw.Flush()
+	case "show", "restore", "delete":
+		if len(ids) == 0 || *dest != "" && (op != "restore" || len(ids) > 1) {
+			fs.Usage()
+		}
+		for _, id := range ids {
+			var err error
+			switch op {
+			case "show":
+				var e *quarantine.Entry
+				var b []byte
+				if e, err = store.Get(id); err == nil {
+					b, err = json.MarshalIndent(e, "", "\t")
+				}
+				if err == nil {
+					fmt.Printf("%s\n", b)
+				}
+			case "restore":
+				var path string
+				if path, err = store.Restore(id, *dest); err == nil {
+					fmt.Printf("restored %s to %s\n", id, path)
+				}
+			case "delete":
+				if err = store.Delete(id); err == nil {
+					fmt.Printf("deleted %s\n", id)
+				}
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", id, err)
+				code = exitError
+			}
+		}
+	case "purge":
+		if len(ids) > 0 {
+			fs.Usage()
+		}
+		n, err := store.Purge(time.Now().Add(-*olderThan))
+		fmt.Printf("purged %d entries\n", n)
+		if err != nil {
+			fatal(err)
+		}
+	default:
+		fs.Usage()
+	}
+	os.Exit(code)
+}
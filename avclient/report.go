@@ -0,0 +1,403 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+	"github.com/mirtchovski/clamav/httpscan"
+)
+
+// Output formats for -format
+const (
+	formatText  = "text"
+	formatJSON  = "json"
+	formatCSV   = "csv"
+	formatSARIF = "sarif"
+)
+
+// record is the outcome of scanning one file, as reported by -format.
+type record struct {
+	Type     string   `json:"type"` // always "result"
+	Path     string   `json:"path"`
+	Verdict  string   `json:"verdict"` // clean, infected or error
+	Matches  []string `json:"matches,omitempty"`
+	Scanned  uint64   `json:"scanned"` // bytes
+	Code     string   `json:"code"`    // e.g. CL_CLEAN, CL_VIRUS, CL_EOPEN
+	Error    string   `json:"error,omitempty"`
+	Duration float64  `json:"duration_ms"`
+
+	Conditions clamav.Condition `json:"conditions,omitempty"` // why the file was not fully scanned
+	Tree       *clamav.Object   `json:"tree,omitempty"`       // the objects found in the file, see -tree
+}
+
+// summary ends the report.
+type summary struct {
+	Type        string    `json:"type"` // always "summary"
+	Signatures  uint      `json:"known_viruses"`
+	Directories uint64    `json:"directories"`
+	Files       uint64    `json:"files"`
+	Skipped     uint64    `json:"skipped,omitempty"` // unchanged since found clean, see -index
+	Infected    uint64    `json:"infected"`
+	Errors      uint64    `json:"errors"`
+	Incomplete  uint64    `json:"incomplete,omitempty"` // not fully scanned, see clamav.Result.Incomplete
+	Scanned     uint64    `json:"scanned"`              // bytes
+	DBVersion   uint      `json:"db_version,omitempty"`
+	DBTime      time.Time `json:"db_time,omitempty"`
+	Elapsed     float64   `json:"elapsed_ms"`
+}
+
+// formatter writes records in one of the -format formats.
+type formatter interface {
+	result(r *record)
+	summary(s *summary)
+}
+
+// report collects the scan results from the workers, counts them and hands
+// them to the formatter. It is safe for concurrent use.
+type report struct {
+	mu    sync.Mutex
+	f     formatter
+	sum   summary
+	start time.Time
+	db    func() (*clamav.DBInfo, error)
+}
+
+func newReport(format string, w io.Writer, s clamav.Scanner) (*report, error) {
+	var f formatter
+	switch format {
+	case formatText:
+		f = textFormatter{}
+	case formatJSON:
+		f = &jsonFormatter{enc: json.NewEncoder(w)}
+	case formatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"type", "path", "verdict", "matches", "scanned", "code", "error", "duration_ms", "conditions"})
+		f = &csvFormatter{w: cw}
+	case formatSARIF:
+		f = newSarifFormatter(w)
+	default:
+		return nil, fmt.Errorf("unknown format %q, want text, json, csv or sarif", format)
+	}
+	rep := &report{f: f, start: time.Now(), sum: summary{Type: "summary"}}
+	if s != nil {
+		rep.db = s.DBInfo
+	}
+	return rep, nil
+}
+
+// result reports the outcome of scanning path and returns the record. res may
+// be nil if the file could not even be opened.
+func (rep *report) result(path string, res *clamav.Result, err error) *record {
+	r := &record{Type: "result", Path: path, Verdict: httpscan.VerdictClean}
+	if res != nil {
+		r.Matches = res.Matches
+		if len(r.Matches) == 0 && res.Virus != "" {
+			r.Matches = []string{res.Virus}
+		}
+		r.Scanned = res.Scanned
+		r.Code = res.Code.Name()
+		r.Duration = float64(res.Duration) / float64(time.Millisecond)
+		r.Conditions = res.Conditions
+		r.Tree = res.Tree
+	}
+	switch {
+	case err != nil:
+		r.Verdict = httpscan.VerdictError
+		r.Error = err.Error()
+		if code, ok := err.(clamav.ErrorCode); ok {
+			r.Code = code.Name()
+		}
+	case res == nil:
+		r.Verdict = httpscan.VerdictError
+		r.Error = "no scan result"
+	case res.Infected():
+		r.Verdict = httpscan.VerdictInfected
+	}
+
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.sum.Files++
+	rep.sum.Scanned += r.Scanned
+	switch r.Verdict {
+	case httpscan.VerdictInfected:
+		rep.sum.Infected++
+	case httpscan.VerdictError:
+		rep.sum.Errors++
+	}
+	if r.Conditions&clamav.CondIncomplete != 0 {
+		rep.sum.Incomplete++
+	}
+	rep.f.result(r)
+	return r
+}
+
+// skipped counts a file that was not scanned because it was found clean
+// before and has not changed.
+func (rep *report) skipped(path string) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.sum.Skipped++
+}
+
+// resume adds the totals of an interrupted run to the summary.
+func (rep *report) resume(s summary) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.sum.Files += s.Files
+	rep.sum.Skipped += s.Skipped
+	rep.sum.Infected += s.Infected
+	rep.sum.Errors += s.Errors
+	rep.sum.Scanned += s.Scanned
+}
+
+// finish writes the summary and returns it.
+func (rep *report) finish() summary {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	if rep.db != nil {
+		if db, err := rep.db(); err == nil {
+			rep.sum.DBVersion, rep.sum.DBTime = db.Version, db.Time
+			rep.sum.Signatures = db.Signatures
+		}
+	}
+	rep.sum.Elapsed = float64(time.Since(rep.start)) / float64(time.Millisecond)
+	rep.f.summary(&rep.sum)
+	return rep.sum
+}
+
+// exitCode returns the clamscan exit status for a run: exitVirus if anything
+// was infected, exitError if there were errors and exitClean otherwise.
+func exitCode(s *summary) int {
+	switch {
+	case s.Infected > 0:
+		return exitVirus
+	case s.Errors > 0:
+		return exitError
+	}
+	return exitClean
+}
+
+// printSummary writes the totals the way clamscan does.
+func printSummary(w io.Writer, s *summary, start time.Time) {
+	end := time.Now()
+	elapsed := end.Sub(start)
+	fmt.Fprintf(w, "\n----------- SCAN SUMMARY -----------\n")
+	fmt.Fprintf(w, "Known viruses: %d\n", s.Signatures)
+	fmt.Fprintf(w, "Engine version: %s\n", clamav.Retver())
+	fmt.Fprintf(w, "Scanned directories: %d\n", s.Directories)
+	fmt.Fprintf(w, "Scanned files: %d\n", s.Files)
+	if s.Skipped > 0 {
+		fmt.Fprintf(w, "Skipped files: %d\n", s.Skipped)
+	}
+	fmt.Fprintf(w, "Infected files: %d\n", s.Infected)
+	if s.Errors > 0 {
+		fmt.Fprintf(w, "Total errors: %d\n", s.Errors)
+	}
+	if s.Incomplete > 0 {
+		fmt.Fprintf(w, "Incomplete files: %d\n", s.Incomplete)
+	}
+	fmt.Fprintf(w, "Data scanned: %.2f MB\n", float64(s.Scanned)/(1<<20))
+	secs := int(elapsed.Seconds())
+	fmt.Fprintf(w, "Time: %.3f sec (%d m %d s)\n", elapsed.Seconds(), secs/60, secs%60)
+	fmt.Fprintf(w, "Start Date: %s\n", start.Format("2006:01:02 15:04:05"))
+	fmt.Fprintf(w, "End Date:   %s\n", end.Format("2006:01:02 15:04:05"))
+}
+
+// textFormatter logs infected files and errors, as avclient always did. The
+// totals are printed by printSummary.
+type textFormatter struct{}
+
+func (textFormatter) result(r *record) {
+	switch r.Verdict {
+	case httpscan.VerdictInfected:
+		log.Printf("virus found in %s: %s", r.Path, strings.Join(r.Matches, ", "))
+		if r.Tree != nil {
+			for _, chain := range r.Tree.Detections() {
+				log.Printf("  in %s", clamav.ChainString(chain))
+			}
+		}
+	case httpscan.VerdictError:
+		log.Printf("error scanning %s: %s", r.Path, r.Error)
+	default:
+		if r.Conditions&clamav.CondIncomplete != 0 {
+			log.Printf("%s not fully scanned: %v", r.Path, r.Conditions)
+		}
+	}
+}
+
+func (textFormatter) summary(s *summary) {}
+
+// jsonFormatter writes one JSON object per line.
+type jsonFormatter struct {
+	enc *json.Encoder
+}
+
+func (f *jsonFormatter) result(r *record) {
+	f.enc.Encode(r)
+}
+
+func (f *jsonFormatter) summary(s *summary) {
+	f.enc.Encode(s)
+}
+
+// csvFormatter writes one row per file. The summary row has the counts in
+// place of the matches and an empty path.
+type csvFormatter struct {
+	w *csv.Writer
+}
+
+func (f *csvFormatter) result(r *record) {
+	f.w.Write([]string{r.Type, r.Path, r.Verdict, strings.Join(r.Matches, ";"),
+		fmt.Sprint(r.Scanned), r.Code, r.Error, fmt.Sprintf("%.3f", r.Duration), r.Conditions.String()})
+	f.w.Flush()
+}
+
+func (f *csvFormatter) summary(s *summary) {
+	counts := fmt.Sprintf("files=%d;infected=%d;errors=%d;incomplete=%d;db_version=%d", s.Files, s.Infected, s.Errors, s.Incomplete, s.DBVersion)
+	f.w.Write([]string{s.Type, "", "", counts, fmt.Sprint(s.Scanned), "", "", fmt.Sprintf("%.3f", s.Elapsed), ""})
+	f.w.Flush()
+}
+
+// sarifFormatter collects the detections and writes a SARIF 2.1.0 log at the
+// end, with a rule per virus name and scan errors as tool notifications.
+type sarifFormatter struct {
+	w       io.Writer
+	rules   []sarifRule
+	ruleIdx map[string]int
+	results []sarifResult
+	notes   []sarifNotification
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+	} `json:"physicalLocation"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	RuleIndex int             `json:"ruleIndex"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifNotification struct {
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations,omitempty"`
+}
+
+func newSarifFormatter(w io.Writer) *sarifFormatter {
+	return &sarifFormatter{w: w, ruleIdx: map[string]int{}}
+}
+
+func sarifLocations(path string) []sarifLocation {
+	var l sarifLocation
+	l.PhysicalLocation.ArtifactLocation.URI = filepath.ToSlash(path)
+	return []sarifLocation{l}
+}
+
+func (f *sarifFormatter) result(r *record) {
+	switch r.Verdict {
+	case httpscan.VerdictError:
+		f.notes = append(f.notes, sarifNotification{
+			Level:     "warning",
+			Message:   sarifMessage{fmt.Sprintf("error scanning: %s (%s)", r.Error, r.Code)},
+			Locations: sarifLocations(r.Path),
+		})
+	case httpscan.VerdictInfected:
+		for _, m := range r.Matches {
+			i, ok := f.ruleIdx[m]
+			if !ok {
+				i = len(f.rules)
+				f.ruleIdx[m] = i
+				f.rules = append(f.rules, sarifRule{ID: m, ShortDescription: sarifMessage{"ClamAV signature " + m}})
+			}
+			f.results = append(f.results, sarifResult{
+				RuleID:    m,
+				RuleIndex: i,
+				Level:     "error",
+				Message:   sarifMessage{"virus found: " + m},
+				Locations: sarifLocations(r.Path),
+			})
+		}
+	}
+	if r.Conditions&clamav.CondIncomplete != 0 && r.Verdict != httpscan.VerdictError {
+		f.notes = append(f.notes, sarifNotification{
+			Level:     "note",
+			Message:   sarifMessage{fmt.Sprintf("not fully scanned: %v", r.Conditions)},
+			Locations: sarifLocations(r.Path),
+		})
+	}
+}
+
+func (f *sarifFormatter) summary(s *summary) {
+	type driver struct {
+		Name           string      `json:"name"`
+		Version        string      `json:"version"`
+		InformationURI string      `json:"informationUri"`
+		Rules          []sarifRule `json:"rules"`
+	}
+	type invocation struct {
+		ExecutionSuccessful        bool                `json:"executionSuccessful"`
+		ToolExecutionNotifications []sarifNotification `json:"toolExecutionNotifications,omitempty"`
+		Properties                 *summary            `json:"properties"`
+	}
+	type run struct {
+		Tool struct {
+			Driver driver `json:"driver"`
+		} `json:"tool"`
+		Results     []sarifResult `json:"results"`
+		Invocations []invocation  `json:"invocations"`
+	}
+	var r run
+	r.Tool.Driver = driver{
+		Name:           "avclient",
+		Version:        clamav.Retver(),
+		InformationURI: "https://github.com/mirtchovski/clamav",
+		Rules:          f.rules,
+	}
+	if r.Tool.Driver.Rules == nil {
+		r.Tool.Driver.Rules = []sarifRule{}
+	}
+	r.Results = f.results
+	if r.Results == nil {
+		r.Results = []sarifResult{}
+	}
+	r.Invocations = []invocation{{
+		ExecutionSuccessful:        s.Errors == 0,
+		ToolExecutionNotifications: f.notes,
+		Properties:                 s,
+	}}
+	enc := json.NewEncoder(f.w)
+	enc.SetIndent("", "  ")
+	enc.Encode(struct {
+		Version string `json:"version"`
+		Schema  string `json:"$schema"`
+		Runs    []run  `json:"runs"`
+	}{"2.1.0", "https://json.schemastore.org/sarif-2.1.0.json", []run{r}})
+}
@@ -0,0 +1,226 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+	"github.com/mirtchovski/clamav/httpscan"
+	"github.com/mirtchovski/clamav/index"
+	"github.com/mirtchovski/clamav/metrics"
+)
+
+// scanPaths scans the given files and directory trees once.
+func scanPaths(args []string) {
+	fs := newFlagSet("scan", "[flags] path [...]")
+	engineFlags(fs)
+	actionFlags(fs)
+	cpus := fs.Int("cpus", 2, "number of active OS threads")
+	testmap := fs.Bool("testfmap", false, "test memory scanning only")
+	fs.BoolVar(&walkOnly, "walkonly", walkOnly, "don't scan files for viruses, only walk directories")
+	indexFile := fs.String("index", "", "skip files found clean in earlier runs, as recorded in this file")
+	checkpointFile := fs.String("checkpoint", "", "save the progress of the scan to this file, see -resume")
+	checkpointEvery := fs.Duration("checkpointevery", time.Minute, "how often to save the -checkpoint")
+	resume := fs.Bool("resume", false, "continue the scan saved in the -checkpoint file; the paths may be omitted")
+	metricsAddr := fs.String("metrics", "", "serve Prometheus metrics, and the scans in progress on /debug/scans, on this address while scanning, e.g. :9100")
+	var scan, clamavVersion *bool
+	if legacy {
+		scan = fs.Bool("scan", true, "scan files for viruses; if false only walk directories, as -walkonly")
+		clamavVersion = fs.Bool("clamavversion", false, "print out the version of ClamAV linked, as the version command")
+	}
+	parseFlags(fs, args)
+	if legacy {
+		if *clamavVersion {
+			fmt.Println(clamav.Retver())
+			os.Exit(exitClean)
+		}
+		walkOnly = walkOnly || !*scan
+	}
+
+	args = fs.Args()
+	if *checkpointFile != "" {
+		if *resume {
+			var err error
+			if track, err = loadTracker(*checkpointFile, args); err != nil {
+				fatal(err)
+			}
+			args = track.cp.Args
+			log.Printf("resuming after %s", track.cp.Last)
+		} else {
+			track = newTracker(*checkpointFile, args)
+		}
+	} else if *resume {
+		fatal("-resume needs a -checkpoint file")
+	}
+	if len(args) == 0 && !*testmap {
+		fmt.Fprintln(os.Stderr, "error: missing path")
+		fs.Usage()
+	}
+
+	runtime.GOMAXPROCS(*cpus)
+
+	var engine *clamav.Engine
+	if !walkOnly {
+		log.Println("initializing ClamAV database...")
+		engine = initClamAV()
+	}
+
+	if *testmap {
+		fmap := clamav.OpenMemory(eicar)
+		defer clamav.CloseMemory(fmap)
+
+		virus, _, err := engine.ScanMapCb(fmap, scanOpts.or(httpscan.DefaultOptions), "eicar memorytest")
+		if err != nil {
+			log.Printf("error scanning in-memory: %v\n", err)
+		}
+		log.Printf("in-memory scan result: %s (eicar)\n", virus)
+		return
+	}
+
+	in := make(chan string, 1024)
+	cnt := make(chan string, 1024)
+	out := make(chan string, 1024)
+	done := make(chan bool, workers)
+
+	log.Println("scan starting...")
+
+	var scanner clamav.Scanner = engine
+	if cacheDir != "" {
+		scanner = openCache(scanner)
+	}
+	scanner = clamav.WithEncryptedPolicy(scanner, encrypted.p)
+	if alertMax {
+		scanner = clamav.AlertExceedsMax(scanner)
+	}
+	if *metricsAddr != "" {
+		collector := metrics.New(engine)
+		scanner = collector.Instrument(scanner)
+		mux := http.NewServeMux()
+		mux.Handle("/", collector)
+		mux.Handle("/debug/scans", dog)
+		go func() {
+			fatal(http.ListenAndServe(*metricsAddr, mux))
+		}()
+	}
+
+	store := openQuarantine()
+	rep, err := newReport(format, os.Stdout, engine)
+	if err != nil {
+		fatal(err)
+	}
+
+	cfg := &scanConfig{scanner: scanner, store: store, rep: rep}
+	if *indexFile != "" {
+		if cfg.index, err = index.Open(*indexFile); err != nil {
+			fatal(err)
+		}
+	}
+
+	stopSaving, saverDone := make(chan struct{}), make(chan struct{})
+	if track != nil {
+		rep.resume(track.summary())
+		go func() {
+			saveCheckpoints(*checkpointEvery, stopSaving)
+			close(saverDone)
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		// a second signal kills the process
+		signal.Stop(sig)
+		log.Println("interrupted, finishing the scans in progress...")
+		atomic.StoreInt32(&stopping, 1)
+	}()
+
+	for i := 0; i < workers; i++ {
+		go worker(cnt, out, done, cfg)
+	}
+
+	go counter(in, cnt)
+
+	for i, v := range args {
+		walkRoot = i
+		walker(v, in)
+	}
+
+	close(in)
+	for i := 0; i < workers; i++ {
+		<-done
+	}
+
+	interrupted := atomic.LoadInt32(&stopping) != 0
+	if interrupted {
+		log.Println("scan interrupted...")
+	} else {
+		log.Println("scan completed...")
+	}
+	if track != nil {
+		close(stopSaving)
+		<-saverDone
+		if interrupted {
+			if err := track.save(); err != nil {
+				log.Printf("error saving checkpoint: %v", err)
+			} else {
+				log.Printf("progress saved to %s, continue with -resume", *checkpointFile)
+			}
+		} else if err := track.remove(); err != nil {
+			log.Printf("error removing checkpoint: %v", err)
+		}
+	}
+	if walkOnly {
+		return
+	}
+	if cfg.index != nil {
+		if !interrupted {
+			cfg.index.Prune(args...)
+		}
+		if err := cfg.index.Save(); err != nil {
+			log.Printf("error saving %s: %v", *indexFile, err)
+		}
+	}
+	rep.sum.Directories = directories
+	rep.sum.Errors += walkErrors
+	sum := rep.finish()
+	if !nosummary {
+		w := os.Stdout
+		if format != formatText {
+			w = os.Stderr
+		}
+		printSummary(w, &sum, rep.start)
+	}
+	code := exitCode(&sum)
+	if interrupted && code == exitClean {
+		code = exitError
+	}
+	os.Exit(code)
+}
+
+// saveCheckpoints saves the progress every interval until stop is closed.
+func saveCheckpoints(interval time.Duration, stop chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if err := track.save(); err != nil {
+				log.Printf("error saving checkpoint: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+	"github.com/mirtchovski/clamav/httpscan"
+	"github.com/mirtchovski/clamav/icap"
+	"github.com/mirtchovski/clamav/metrics"
+	"github.com/mirtchovski/clamav/milter"
+)
+
+// headerTimeout bounds the time the HTTP servers wait for the headers of a
+// request, so that idle or slow clients do not hold connections forever.
+const headerTimeout = 10 * time.Second
+
+// serve runs the HTTP scanning service, see package httpscan for the endpoints.
+func serve(args []string) {
+	fs := newFlagSet("serve", "[flags]")
+	engineFlags(fs)
+	listen := fs.String("listen", ":8080", "address to listen on")
+	readTimeout := fs.Duration("readtimeout", 5*time.Minute, "longest time to read a request, its body included (0 for no limit)")
+	debugAddr := fs.String("debugaddr", "", "serve the scans in progress on /debug/scans on this address, e.g. localhost:6060; they list file names and can be aborted, so keep it private")
+	maxBody := fs.Int64("maxbody", httpscan.DefaultMaxBodySize, "largest accepted request body, in bytes")
+	memLimit := fs.Int64("memlimit", 0, "bodies larger than this many bytes are spooled to disk (0 for the default)")
+	tmpdir := fs.String("tmpdir", "", "directory for spooled request bodies")
+	concurrent := fs.Int("concurrent", workers, "number of scans allowed to run at once")
+	queueTimeout := fs.Duration("queuetimeout", httpscan.DefaultQueueTimeout, "longest wait for a free scan slot before answering 503")
+	maxAge := fs.Duration("maxdbage", 0, "report not ready when the databases are older than this (0 disables)")
+	allowDebug := fs.Bool("allowdebug", false, "return the libclamav debug messages of a scan for /scan?debug=1; such scans run alone")
+	profiles := fs.String("profiles", "", "comma separated profiles to load an engine for, chosen with /scan?profile=name; the first is the default")
+	procs := fs.Int("procs", 0, "scan in this many worker processes, replaced when libclamav crashes (0 scans in this process)")
+	var procMem size
+	fs.Var(&procMem, "procmem", "limit the address space of each worker process, e.g. 2G (0 for no limit)")
+	procCPU := fs.Duration("proccpu", 0, "kill the worker process of a scan using more CPU time than this (0 for no limit)")
+	reload := fs.Duration("reload", 5*time.Minute, "check the databases for updates this often (0 disables)")
+	icapAddr := fs.String("icap", "", "also serve ICAP (RFC 3507) on this address, e.g. :1344")
+	milterAddr := fs.String("milter", "", "also serve the milter protocol on this address, e.g. unix:/run/clamav/milter.sock or tcp:localhost:7357")
+	milterInfected := fs.String("milterinfected", "reject", "milter action for infected messages: accept, reject, tempfail, discard or quarantine")
+	milterError := fs.String("miltererror", "tempfail", "milter action for messages that could not be scanned")
+	parseFlags(fs, args)
+
+	var ms *milter.Server
+	if *milterAddr != "" {
+		ms = new(milter.Server)
+		var err error
+		if ms.OnInfected, err = milter.ParseAction(*milterInfected); err != nil {
+			fatal(err)
+		}
+		if ms.OnError, err = milter.ParseAction(*milterError); err != nil {
+			fatal(err)
+		}
+	}
+
+	var engine clamav.Scanner
+	var watch func(time.Duration, <-chan struct{})
+	var onReload *func(*clamav.DBInfo, error)
+	switch {
+	case *profiles != "" && *procs > 0:
+		fatal("-profiles and -procs can not be used together")
+	case *debugAddr != "" && *procs > 0:
+		// the scans run in the workers, whose watchdogs log them
+		fatal("-debugaddr and -procs can not be used together")
+	case *profiles != "":
+		ps := newProfileScanner(*profiles)
+		defer ps.Close()
+		engine, watch, onReload = ps, ps.Watch, &ps.OnReload
+	case *procs > 0:
+		pool := newPool(*procs, uint64(procMem), *procCPU)
+		defer pool.Close()
+		engine, watch, onReload = pool, pool.Watch, &pool.OnReload
+	default:
+		r := newReloader()
+		defer r.Close()
+		logSettings(r)
+		engine, watch, onReload = r, r.Watch, &r.OnReload
+	}
+
+	collector := metrics.New(engine)
+	*onReload = collector.ObserveReload
+	scanner := engine
+	if cacheDir != "" {
+		scanner = openCache(scanner)
+	}
+	scanner = clamav.WithEncryptedPolicy(scanner, encrypted.p)
+	if alertMax {
+		scanner = clamav.AlertExceedsMax(scanner)
+	}
+	scanner = collector.Instrument(scanner)
+	if *reload > 0 {
+		go watch(*reload, nil)
+	}
+
+	h := &httpscan.Handler{
+		Scanner:       scanner,
+		MaxBodySize:   *maxBody,
+		MemoryLimit:   *memLimit,
+		TempDir:       *tmpdir,
+		MaxConcurrent: *concurrent,
+		QueueTimeout:  *queueTimeout,
+		MaxDBAge:      *maxAge,
+		AllowDebug:    *allowDebug,
+		Options:       scanOpts.or(0),
+	}
+	if *icapAddr != "" {
+		is := &icap.Server{
+			Scanner:     scanner,
+			Options:     scanOpts.or(0),
+			MemoryLimit: *memLimit,
+			TempDir:     *tmpdir,
+		}
+		go func() {
+			log.Printf("serving ICAP on %s", *icapAddr)
+			fatal(is.ListenAndServe(*icapAddr))
+		}()
+	}
+	if ms != nil {
+		network, addr := "tcp", *milterAddr
+		if i := strings.Index(addr, ":"); i > 0 && (addr[:i] == "unix" || addr[:i] == "tcp") {
+			network, addr = addr[:i], addr[i+1:]
+		}
+		ms.Scanner = scanner
+		ms.Options = scanOpts.or(0)
+		ms.AddHeaders = true
+		ms.MemoryLimit = *memLimit
+		ms.TempDir = *tmpdir
+		go func() {
+			log.Printf("serving milter on %s:%s", network, addr)
+			fatal(ms.ListenAndServe(network, addr))
+		}()
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", h)
+	mux.Handle("/metrics", collector)
+	if *debugAddr != "" {
+		dmux := http.NewServeMux()
+		dmux.Handle("/debug/scans", dog)
+		ds := &http.Server{Addr: *debugAddr, Handler: dmux, ReadHeaderTimeout: headerTimeout}
+		go func() {
+			log.Printf("serving the scans in progress on %s", *debugAddr)
+			fatal(ds.ListenAndServe())
+		}()
+	}
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           mux,
+		ReadHeaderTimeout: headerTimeout,
+		ReadTimeout:       *readTimeout,
+	}
+	log.Printf("serving on %s", *listen)
+	fatal(srv.ListenAndServe())
+}
@@ -0,0 +1,100 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// settingsFile is a snapshot saved by the settings subcommand, applied to
+// every engine by setupEngine
+var settingsFile string
+
+// settings prints the effective fields of an engine set up as the other
+// subcommands would, after the databases are loaded, or compares them with a
+// saved snapshot.
+func settings(args []string) {
+	fs := newFlagSet("settings", "[flags]")
+	engineFlags(fs)
+	diff := fs.String("diff", "", "compare with the snapshot in this file and print the fields that differ; exit 1 if any but the database fields do")
+	parseFlags(fs, args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+	}
+
+	engine := initClamAV()
+	defer engine.Free()
+	snap, err := engine.Snapshot()
+	if err != nil {
+		fatal(err)
+	}
+	if *diff == "" {
+		b, err := json.MarshalIndent(snap, "", "\t")
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("%s\n", b)
+		return
+	}
+
+	saved, err := readSnapshot(*diff)
+	if err != nil {
+		fatal(err)
+	}
+	code := exitClean
+	for _, d := range clamav.Diff(saved, snap) {
+		if d.ReadOnly {
+			fmt.Printf("%v (databases)\n", d)
+			continue
+		}
+		fmt.Println(d)
+		code = exitVirus
+	}
+	os.Exit(code)
+}
+
+func readSnapshot(file string) (*clamav.Snapshot, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var s clamav.Snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return &s, nil
+}
+
+// applySettingsFile applies the snapshot of -settings, if set.
+func applySettingsFile(engine *clamav.Engine) error {
+	if settingsFile == "" {
+		return nil
+	}
+	s, err := readSnapshot(settingsFile)
+	if err != nil {
+		return err
+	}
+	return s.Apply(engine)
+}
+
+// logSettings logs the fields of a loaded engine, so that the log of every
+// service shows the configuration it ran with.
+func logSettings(engine interface {
+	Snapshot() (*clamav.Snapshot, error)
+}) {
+	snap, err := engine.Snapshot()
+	if err != nil {
+		log.Printf("reading the engine settings: %v", err)
+		return
+	}
+	b, _ := json.Marshal(snap)
+	log.Printf("engine settings: %s", b)
+}
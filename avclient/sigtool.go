@@ -0,0 +1,102 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// sigtool inspects database files and makes signatures, covering the parts
+// of ClamAV's sigtool that we use.
+func sigtool(args []string) {
+	fs := newFlagSet("sigtool", "-info|-count|-md5|-sha1|-sha256 file [...]")
+	info := fs.Bool("info", false, "print the header of .cvd and .cld files and verify them")
+	count := fs.Bool("count", false, "count the signatures in database files or directories")
+	md5sig := fs.Bool("md5", false, "print MD5 hash signatures (.hdb) of files")
+	sha1sig := fs.Bool("sha1", false, "print SHA1 hash signatures (.hsb) of files")
+	sha256sig := fs.Bool("sha256", false, "print SHA256 hash signatures (.hsb) of files")
+	parseFlags(fs, args)
+
+	modes := 0
+	for _, b := range []bool{*info, *count, *md5sig, *sha1sig, *sha256sig} {
+		if b {
+			modes++
+		}
+	}
+	if modes != 1 || fs.NArg() == 0 {
+		fs.Usage()
+	}
+
+	code := exitClean
+	for _, path := range fs.Args() {
+		var err error
+		switch {
+		case *info:
+			err = cvdInfo(path)
+		case *count:
+			var n uint
+			if n, err = clamav.CountSigs(path, clamav.CountSigsAll); err == nil {
+				fmt.Printf("%s: %d signatures\n", path, n)
+			}
+		case *md5sig:
+			err = hashSig(path, md5.New())
+		case *sha1sig:
+			err = hashSig(path, sha1.New())
+		case *sha256sig:
+			err = hashSig(path, sha256.New())
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			code = exitError
+		}
+	}
+	os.Exit(code)
+}
+
+func cvdInfo(path string) error {
+	cvd, err := clamav.CVDHead(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("File: %s\n", path)
+	fmt.Printf("Build time: %s\n", cvd.Time.UTC().Format(time.RFC1123))
+	fmt.Printf("Version: %d\n", cvd.Version)
+	fmt.Printf("Signatures: %d\n", cvd.Signatures)
+	fmt.Printf("Functionality level: %d\n", cvd.Flevel)
+	fmt.Printf("Builder: %s\n", cvd.Builder)
+	fmt.Printf("MD5: %s\n", cvd.MD5)
+	fmt.Printf("Digital signature: %s\n", cvd.DSig)
+	if err := clamav.CVDVerify(path); err != nil {
+		return fmt.Errorf("verification failed: %v", err)
+	}
+	fmt.Println("Verification OK.")
+	return nil
+}
+
+// hashSig prints the hash signature of the file in path, in the
+// hash:size:name form of .hdb and .hsb databases.
+func hashSig(path string, h hash.Hash) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%x:%d:%s\n", h.Sum(nil), n, filepath.Base(path))
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+	"github.com/mirtchovski/clamav/watch"
+)
+
+// watchDirs scans files as they are written into the given directories,
+// applying the same actions as a one-shot scan.
+func watchDirs(args []string) {
+	fs := newFlagSet("watch", "[flags] dir [...]")
+	engineFlags(fs)
+	actionFlags(fs)
+	debounce := fs.Duration("debounce", watch.DefaultDebounce, "wait this long after the last write to a file before scanning it")
+	poll := fs.Duration("poll", watch.DefaultPoll, "poll directories that can not be watched this often")
+	initial := fs.Bool("initial", false, "scan the files already in the directories at startup")
+	reload := fs.Duration("reload", 5*time.Minute, "check the databases for updates this often (0 disables)")
+	parseFlags(fs, args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+	}
+
+	store := openQuarantine()
+	engine := newReloader()
+	defer engine.Close()
+	if *reload > 0 {
+		go engine.Watch(*reload, nil)
+	}
+
+	var scanner clamav.Scanner = engine
+	if cacheDir != "" {
+		scanner = openCache(scanner)
+	}
+	scanner = clamav.WithEncryptedPolicy(scanner, encrypted.p)
+	if alertMax {
+		scanner = clamav.AlertExceedsMax(scanner)
+	}
+
+	w, err := watch.New(*debounce, *poll)
+	if err != nil {
+		fatal(err)
+	}
+	for _, dir := range fs.Args() {
+		if err := w.Add(dir); err != nil {
+			fatal(err)
+		}
+	}
+
+	rep, err := newReport(format, os.Stdout, engine)
+	if err != nil {
+		fatal(err)
+	}
+	in := make(chan string, 1024)
+	done := make(chan bool, workers)
+	cfg := &scanConfig{scanner: scanner, store: store, rep: rep}
+	for i := 0; i < workers; i++ {
+		go worker(in, nil, done, cfg)
+	}
+	go func() {
+		for path := range w.Files() {
+			if wanted(path) {
+				in <- path
+			}
+		}
+		close(in)
+	}()
+	if *initial {
+		go w.Rescan()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	log.Printf("watching %v", fs.Args())
+	<-sig
+	log.Println("stopping...")
+	w.Close()
+	for i := 0; i < workers; i++ {
+		<-done
+	}
+	rep.sum.Directories = uint64(fs.NArg())
+	sum := rep.finish()
+	if !nosummary && format == formatText {
+		printSummary(os.Stdout, &sum, rep.start)
+	}
+}
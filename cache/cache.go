@@ -0,0 +1,229 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+// Package cache remembers scan verdicts across restarts, keyed by the SHA-256
+// of the scanned content, the version and build time of the databases that
+// produced them, the scan options and the engine settings, such as the
+// limits, when the scanner tells them, see clamav.Keyer. libclamav's own
+// cache lives in the engine and is lost whenever the engine is freed or
+// reloaded.
+//
+// The cache is a directory tree with one small file per verdict. Entries are
+// written to a temporary file and renamed into place, so any number of
+// processes can share a cache directory without locking. Verdicts of
+// different databases are kept in separate subdirectories; once a scanner
+// sees new databases the subdirectories of the others are pruned when no
+// process used them for Cache.Grace, so that processes sharing the directory
+// through an update keep their verdicts.
+//
+// Only clean and infected verdicts are cached, and only when the content did
+// not change while it was scanned. A cached verdict is returned without
+// calling libclamav, so the engine's callbacks are not run for it; scans
+// asking for the tree of their objects, see clamav.WithTree, are not looked
+// up.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// Sum is the SHA-256 of a scanned object.
+type Sum [sha256.Size]byte
+
+// entry is what is stored for every verdict.
+type entry struct {
+	Code     clamav.ErrorCode `json:"code"`
+	Virus    string           `json:"virus,omitempty"`
+	Matches  []string         `json:"matches,omitempty"`
+	FileType string           `json:"file_type,omitempty"`
+	Scanned  uint64           `json:"scanned"`
+	Time     time.Time        `json:"time"`
+
+	Conditions clamav.Condition `json:"conditions,omitempty"`
+	Heuristics []string         `json:"heuristics,omitempty"`
+}
+
+// DefaultGrace is how long the verdicts of other databases are kept after
+// their last use when Cache.Grace is zero.
+const DefaultGrace = 24 * time.Hour
+
+// Cache is a directory of scan verdicts. It is safe for concurrent use by
+// several goroutines and processes.
+type Cache struct {
+	Grace time.Duration // verdicts of other databases unused for this long are pruned, DefaultGrace if zero
+
+	dir    string
+	hits   uint64
+	misses uint64
+
+	mu      sync.Mutex
+	touched map[string]time.Time // when this process last marked each generation used
+}
+
+// Open opens the cache in dir, creating it if needed.
+func Open(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Cache{dir: dir}, nil
+}
+
+// Key identifies a verdict.
+type Key struct {
+	Sum      Sum            // of the scanned content
+	DB       *clamav.DBInfo // the databases that produced the verdict
+	Opts     uint           // the scan options
+	Settings string         // the engine settings, see clamav.Keyer; empty if the scanner can not tell
+}
+
+// generation names the subdirectory holding the verdicts of one set of
+// databases, scan options and engine settings.
+func (k *Key) generation() string {
+	g := fmt.Sprintf("%s%x", dbPrefix(k.DB), k.Opts)
+	if k.Settings != "" {
+		g += "-" + k.Settings
+	}
+	return g
+}
+
+func dbPrefix(db *clamav.DBInfo) string {
+	return fmt.Sprintf("%d-%d-", db.Version, db.Time.Unix())
+}
+
+func (c *Cache) grace() time.Duration {
+	if c.Grace <= 0 {
+		return DefaultGrace
+	}
+	return c.Grace
+}
+
+// touch marks the generation g used by setting the modification time of its
+// directory, which Prune goes by. It does so once in a while, not on every
+// lookup.
+func (c *Cache) touch(g string) {
+	now := time.Now()
+	c.mu.Lock()
+	if now.Sub(c.touched[g]) < c.grace()/8 {
+		c.mu.Unlock()
+		return
+	}
+	if c.touched == nil {
+		c.touched = map[string]time.Time{}
+	}
+	c.touched[g] = now
+	c.mu.Unlock()
+	// the directory is made by the first Put, with the time of its making
+	os.Chtimes(filepath.Join(c.dir, g), now, now)
+}
+
+func (c *Cache) path(k *Key) string {
+	h := hex.EncodeToString(k.Sum[:])
+	return filepath.Join(c.dir, k.generation(), h[:2], h)
+}
+
+// Get returns the verdict cached under k.
+func (c *Cache) Get(k Key) (*clamav.Result, bool) {
+	c.touch(k.generation())
+	b, err := ioutil.ReadFile(c.path(&k))
+	var e entry
+	if err == nil {
+		err = json.Unmarshal(b, &e)
+	}
+	if err != nil || (e.Code != clamav.Clean && e.Code != clamav.Virus) {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return &clamav.Result{
+		Virus:    e.Virus,
+		Matches:  e.Matches,
+		FileType: e.FileType,
+		Scanned:  e.Scanned,
+		Code:     e.Code,
+		Cached:   true,
+
+		Conditions: e.Conditions,
+		Heuristics: e.Heuristics,
+	}, true
+}
+
+// Put caches the verdict in res under k. Results of scans that failed are
+// ignored.
+func (c *Cache) Put(k Key, res *clamav.Result) error {
+	if res.Code != clamav.Clean && res.Code != clamav.Virus {
+		return nil
+	}
+	b, err := json.Marshal(&entry{
+		Code:     res.Code,
+		Virus:    res.Virus,
+		Matches:  res.Matches,
+		FileType: res.FileType,
+		Scanned:  res.Scanned,
+		Time:     time.Now(),
+
+		Conditions: res.Conditions,
+		Heuristics: res.Heuristics,
+	})
+	if err != nil {
+		return err
+	}
+	name := c.path(&k)
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Prune removes the verdicts of the databases other than db that no process
+// sharing the cache looked up for Grace, and returns the number of
+// generations removed.
+func (c *Cache) Prune(db *clamav.DBInfo) (int, error) {
+	dirs, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return 0, err
+	}
+	keep := dbPrefix(db)
+	n := 0
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), keep) || time.Since(d.ModTime()) < c.grace() {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(c.dir, d.Name())); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Stats returns the number of lookups that found and did not find a verdict.
+func (c *Cache) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
@@ -0,0 +1,229 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+	"github.com/mirtchovski/clamav/internal/scantest"
+)
+
+var CacheTests = []struct {
+	name    string
+	content []byte
+	code    clamav.ErrorCode
+}{
+	{"clean", []byte("hello, world\n"), clamav.Clean},
+	{"infected", scantest.EICAR, clamav.Virus},
+}
+
+func TestCache(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	c, err := Open(filepath.Join(tmp, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &scantest.Scanner{DB: clamav.DBInfo{Version: 1, Time: time.Unix(1500000000, 0)}}
+	s := NewScanner(fake, c)
+
+	for _, tt := range CacheTests {
+		path := filepath.Join(tmp, tt.name)
+		if err := ioutil.WriteFile(path, tt.content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		before := fake.Scans()
+		for i := 0; i < 2; i++ {
+			res, err := s.ScanPath(path, clamav.ScanStdopt, nil)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if res.Code != tt.code || res.Cached != (i > 0) || res.Path != path {
+				t.Errorf("%s: scan %d: %+v", tt.name, i, res)
+			}
+		}
+		// the same content read from a stream hits the cache too
+		res, err := s.ScanReader(strings.NewReader(string(tt.content)), clamav.ScanStdopt, nil)
+		if err != nil || !res.Cached || res.Code != tt.code {
+			t.Errorf("%s: ScanReader = %+v, %v", tt.name, res, err)
+		}
+		// other options are cached separately
+		if res, _ := s.ScanPath(path, clamav.ScanStdopt|clamav.ScanAllmatches, nil); res.Cached {
+			t.Errorf("%s: cached across scan options", tt.name)
+		}
+		if n := fake.Scans() - before; n != 2 {
+			t.Errorf("%s: %d scans reached the engine, want 2", tt.name, n)
+		}
+	}
+
+	// new databases invalidate the cache and prune the old verdicts
+	fake.DB.Version = 2
+	before := fake.Scans()
+	res, err := s.ScanPath(filepath.Join(tmp, "clean"), clamav.ScanStdopt, nil)
+	if n := fake.Scans() - before; err != nil || res.Cached || n != 1 {
+		t.Errorf("after database update: %+v, %v, %d scans", res, err, n)
+	}
+	// once no process used them for the grace period
+	db2 := &clamav.DBInfo{Version: 2, Time: time.Unix(1500000000, 0)}
+	if n, err := c.Prune(db2); err != nil || n != 0 {
+		t.Errorf("Prune of generations in use: %d pruned, %v", n, err)
+	}
+	dirs, _ := ioutil.ReadDir(c.dir)
+	old := time.Now().Add(-2 * DefaultGrace)
+	for _, d := range dirs {
+		if strings.HasPrefix(d.Name(), "1-") {
+			os.Chtimes(filepath.Join(c.dir, d.Name()), old, old)
+		}
+	}
+	if _, err := c.Prune(db2); err != nil {
+		t.Fatal(err)
+	}
+	dirs, _ = ioutil.ReadDir(c.dir)
+	for _, d := range dirs {
+		if strings.HasPrefix(d.Name(), "1-") {
+			t.Errorf("old generation %s not pruned", d.Name())
+		}
+	}
+
+	// a second process sharing the directory sees the verdicts
+	c2, err := Open(c.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = NewScanner(fake, c2).ScanReader(bytes.NewReader(scantest.EICAR), clamav.ScanStdopt, nil)
+	if err != nil || res.Cached {
+		t.Errorf("eicar should not be cached for version 2: %+v, %v", res, err)
+	}
+	if _, ok := c.Get(Key{sumOf(scantest.EICAR), &clamav.DBInfo{Version: 2, Time: time.Unix(1500000000, 0)}, clamav.ScanStdopt, ""}); !ok {
+		t.Errorf("verdict written by one cache not seen by the other")
+	}
+}
+
+func sumOf(b []byte) Sum {
+	return Sum(sha256.Sum256(b))
+}
+
+// keyedScanner tells the settings of its scans, see clamav.Keyer
+type keyedScanner struct {
+	*scantest.Scanner
+	key string
+}
+
+func (s *keyedScanner) ScanKey(context interface{}) (string, error) {
+	return s.key, nil
+}
+
+func TestCacheSettings(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	c, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &scantest.Scanner{}
+	small := NewScanner(&keyedScanner{fake, "small"}, c)
+	large := NewScanner(&keyedScanner{fake, "large"}, c)
+	for _, s := range []*Scanner{small, large, small, large} {
+		s.ScanReader(bytes.NewReader(scantest.EICAR), clamav.ScanStdopt, nil)
+	}
+	if n := fake.Scans(); n != 2 {
+		t.Errorf("%d scans reached the engine, want one for each of the settings", n)
+	}
+}
+
+func TestCacheChanged(t *testing.T) {
+	f, err := ioutil.TempFile("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	c, err := Open(f.Name() + ".d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(f.Name() + ".d")
+
+	// the file is infected when hashed and clean when scanned: the clean
+	// verdict must not be cached for the infected content
+	f.Write(scantest.EICAR)
+	fake := &scantest.Scanner{During: func() {
+		f.Truncate(0)
+		f.WriteAt([]byte("clean"), 0)
+	}}
+	s := NewScanner(fake, c)
+	if res, _ := s.ScanFd(int(f.Fd()), clamav.ScanStdopt, nil); res.Code != clamav.Clean {
+		t.Fatalf("scan of the rewritten file: %+v", res)
+	}
+	fake.During = nil
+	res, err := s.ScanReader(bytes.NewReader(scantest.EICAR), clamav.ScanStdopt, nil)
+	if err != nil || res.Cached || res.Code != clamav.Virus {
+		t.Errorf("verdict of the rewritten file cached for its old content: %+v, %v", res, err)
+	}
+}
+
+func TestUnchanged(t *testing.T) {
+	f, err := ioutil.TempFile("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.Write(scantest.EICAR)
+	before, ok := fdState(int(f.Fd()))
+	if !ok {
+		t.Skip("no change times here")
+	}
+	sum := sha256.Sum256(scantest.EICAR)
+
+	// the content of a file changed long before is not hashed again
+	if !unchanged(int(f.Fd()), before, time.Now().Add(time.Hour), Sum{}) {
+		t.Errorf("file changed long before: changed")
+	}
+	if !unchanged(int(f.Fd()), before, time.Now(), sum) {
+		t.Errorf("file changed just before, same content: changed")
+	}
+	if unchanged(int(f.Fd()), before, time.Now(), Sum{}) {
+		t.Errorf("file changed just before, other content: unchanged")
+	}
+	f.Write([]byte("more"))
+	if unchanged(int(f.Fd()), before, time.Now().Add(time.Hour), sum) {
+		t.Errorf("file written to: unchanged")
+	}
+}
+
+func TestCacheTree(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	c, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &scantest.Scanner{}
+	s := NewScanner(fake, c)
+	s.ScanReader(bytes.NewReader(scantest.EICAR), clamav.ScanStdopt, nil)
+	res, _ := s.ScanReader(bytes.NewReader(scantest.EICAR), clamav.ScanStdopt, clamav.WithTree(nil))
+	if res.Cached || fake.Scans() != 2 {
+		t.Errorf("scan asking for a tree answered from the cache: %+v", res)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"crypto/sha256"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// Scanner is a clamav.Scanner that consults a Cache before scanning with the
+// underlying scanner and caches what it scans.
+type Scanner struct {
+	clamav.Scanner
+	Cache *Cache
+
+	mu     sync.Mutex
+	last   string    // prefix of the databases seen last, to prune on change
+	pruned time.Time // when the cache was last pruned
+}
+
+// NewScanner returns a Scanner that caches the verdicts of s in c.
+func NewScanner(s clamav.Scanner, c *Cache) *Scanner {
+	return &Scanner{Scanner: s, Cache: c}
+}
+
+// db returns the databases currently loaded, pruning the verdicts of others
+// when they change and every Grace after, as the verdicts of the databases
+// replaced are still in use for Grace.
+func (s *Scanner) db() (*clamav.DBInfo, error) {
+	db, err := s.Scanner.DBInfo()
+	if err != nil {
+		return nil, err
+	}
+	p := dbPrefix(db)
+	s.mu.Lock()
+	prune := s.last != p || time.Since(s.pruned) > s.Cache.grace()
+	s.last = p
+	if prune {
+		s.pruned = time.Now()
+	}
+	s.mu.Unlock()
+	if prune {
+		go func() {
+			if _, err := s.Cache.Prune(db); err != nil {
+				log.Printf("clamav/cache: pruning %s: %v", s.Cache.dir, err)
+			}
+		}()
+	}
+	return db, nil
+}
+
+// lookup hashes what r returns and looks up the verdict of its scan with
+// opts and context in the cache.
+func (s *Scanner) lookup(r io.Reader, opts uint, context interface{}) (Key, *clamav.Result, error) {
+	k := Key{Opts: opts}
+	var err error
+	if k.DB, err = s.db(); err != nil {
+		return k, nil, err
+	}
+	if k.Settings, err = clamav.ScanKey(s.Scanner, context); err != nil {
+		return k, nil, err
+	}
+	if k.Sum, err = hash(r); err != nil {
+		return k, nil, err
+	}
+	res, _ := s.Cache.Get(k)
+	return k, res, nil
+}
+
+func hash(r io.Reader) (Sum, error) {
+	var sum Sum
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+func (s *Scanner) store(k Key, res *clamav.Result, err error) {
+	if err != nil {
+		return
+	}
+	if perr := s.Cache.Put(k, res); perr != nil {
+		log.Printf("clamav/cache: %v", perr)
+	}
+}
+
+// fileState is what tells whether a file was written to: its identity, size
+// and modification and change times. The change time can not be set back.
+type fileState struct {
+	dev, ino     uint64
+	size         int64
+	mtime, ctime int64
+}
+
+// racy is how long after a change the change time may not tell a further
+// write, the file times being only as fine as the clock of the kernel or the
+// file system.
+const racy = 2 * time.Second
+
+// unchanged reports whether the file open on fd is still in the state it was
+// in at the time taken, before it was hashed and scanned, so that the verdict
+// is that of the content with the sum. The content is hashed again only if
+// the file changed just before.
+func unchanged(fd int, before fileState, taken time.Time, sum Sum) bool {
+	after, ok := fdState(fd)
+	if !ok || after != before {
+		return false
+	}
+	if taken.UnixNano()-before.ctime > int64(racy) {
+		return true
+	}
+	again, err := hash(&preader{fd: fd})
+	return err == nil && again == sum
+}
+
+// ScanKey returns the key of the underlying scanner, see clamav.Keyer.
+func (s *Scanner) ScanKey(context interface{}) (string, error) {
+	return clamav.ScanKey(s.Scanner, context)
+}
+
+// ScanPath returns the cached verdict for the content of path, scanning it if
+// there is none.
+func (s *Scanner) ScanPath(path string, opts uint, context interface{}) (*clamav.Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return s.Scanner.ScanPath(path, opts, context)
+	}
+	defer f.Close()
+	res, err := s.ScanFd(int(f.Fd()), opts, context)
+	res.Path = path
+	return res, err
+}
+
+// ScanFd returns the cached verdict for the content of the file open on fd,
+// scanning it if there is none. The file offset is not changed. The verdict
+// is not cached if the file was written to while it was hashed or scanned.
+func (s *Scanner) ScanFd(fd int, opts uint, context interface{}) (*clamav.Result, error) {
+	if clamav.WantsTree(context) {
+		return s.Scanner.ScanFd(fd, opts, context)
+	}
+	start := time.Now()
+	before, ok := fdState(fd)
+	k, res, err := s.lookup(&preader{fd: fd}, opts, context)
+	if err != nil {
+		return s.Scanner.ScanFd(fd, opts, context)
+	}
+	if res != nil {
+		res.Duration = time.Since(start)
+		return res, nil
+	}
+	res, err = s.Scanner.ScanFd(fd, opts, context)
+	if ok && unchanged(fd, before, start, k.Sum) {
+		s.store(k, res, err)
+	}
+	return res, err
+}
+
+// ScanReader returns the cached verdict for what r returns, scanning it if
+// there is none. Readers other than files and spools are spooled first.
+func (s *Scanner) ScanReader(r io.Reader, opts uint, context interface{}) (*clamav.Result, error) {
+	if clamav.WantsTree(context) {
+		return s.Scanner.ScanReader(r, opts, context)
+	}
+	switch r := r.(type) {
+	case *os.File:
+		res, err := s.ScanFd(int(r.Fd()), opts, context)
+		res.Path = r.Name()
+		return res, err
+	case *clamav.Spool:
+		if f := r.File(); f != nil {
+			// spooled to a file, which may be written to as any other
+			res, err := s.ScanFd(int(f.Fd()), opts, context)
+			if rerr := r.Rewind(); rerr != nil && err == nil {
+				return &clamav.Result{Code: clamav.Eread}, rerr
+			}
+			return res, err
+		}
+		// held in memory, where it does not change
+		start := time.Now()
+		k, res, err := s.lookup(r, opts, context)
+		if rerr := r.Rewind(); rerr != nil {
+			return &clamav.Result{Code: clamav.Eread}, rerr
+		}
+		if err != nil {
+			return s.Scanner.ScanReader(r, opts, context)
+		}
+		if res != nil {
+			res.Duration = time.Since(start)
+			return res, nil
+		}
+		res, err = s.Scanner.ScanReader(r, opts, context)
+		s.store(k, res, err)
+		return res, err
+	}
+	sp, err := clamav.NewSpool(r, clamav.DefaultSpoolLimit, "")
+	if err != nil {
+		return &clamav.Result{Code: clamav.Eread}, err
+	}
+	defer sp.Close()
+	return s.ScanReader(sp, opts, context)
+}
+
+// preader reads a descriptor from the start with pread, leaving its offset
+// alone and without taking ownership of it as os.NewFile would.
+type preader struct {
+	fd  int
+	off int64
+}
+
+func (p *preader) Read(b []byte) (int, error) {
+	n, err := syscall.Pread(p.fd, b, p.off)
+	if n < 0 {
+		n = 0
+	}
+	p.off += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if n == 0 && len(b) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,24 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+//go:build darwin || freebsd || netbsd || openbsd
+
+package cache
+
+import "syscall"
+
+// fdState returns the state of the file open on fd.
+func fdState(fd int) (fileState, bool) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return fileState{}, false
+	}
+	return fileState{
+		dev:   uint64(st.Dev),
+		ino:   uint64(st.Ino),
+		size:  st.Size,
+		mtime: int64(st.Mtimespec.Sec)*1e9 + int64(st.Mtimespec.Nsec),
+		ctime: int64(st.Ctimespec.Sec)*1e9 + int64(st.Ctimespec.Nsec),
+	}, true
+}
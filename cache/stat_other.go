@@ -0,0 +1,13 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package cache
+
+// fdState can not tell the change time of a file here, so the verdicts of
+// scans by descriptor are not cached.
+func fdState(fd int) (fileState, bool) {
+	return fileState{}, false
+}
@@ -14,10 +14,15 @@ cl_error_t precache_cgo(int fd, const char *type, void *context);
 cl_error_t prescan_cgo(int fd, const char *type, void *context);
 cl_error_t postscan_cgo(int fd, int result, char *virname, void *context);
 
+void msg_cgo(enum cl_msg severity, const char *fullmsg, const char *msg, void *context);
 void hash_cgo(int fd, unsigned long long size, const unsigned char *md5, const char *virname, void *context);
 */
 import "C"
-import "unsafe"
+import (
+	"log"
+	"sync/atomic"
+	"unsafe"
+)
 
 var callbackFuncs = map[string]interface{}{
 	"precache": nil,
@@ -29,14 +34,49 @@ var callbackFuncs = map[string]interface{}{
 	"meta":     nil,
 }
 
+// callbackErrors counts the user callbacks that panicked.
+var callbackErrors uint64
+
+// CallbackErrors returns the number of times a user callback panicked. A
+// callback that panics is treated as if it had returned Clean, instead of
+// unwinding through libclamav.
+func CallbackErrors() uint64 {
+	return atomic.LoadUint64(&callbackErrors)
+}
+
+// recoverCallback is deferred by the callbacks exported to C.
+func recoverCallback(name string, ret *C.cl_error_t) {
+	if r := recover(); r != nil {
+		atomic.AddUint64(&callbackErrors, 1)
+		log.Printf("clamav: %s callback panicked: %v", name, r)
+		if ret != nil {
+			*ret = Clean
+		}
+	}
+}
+
 //export precacheCallback
-func precacheCallback(fd C.int, ftype *C.char, context unsafe.Pointer) C.cl_error_t {
+func precacheCallback(fd C.int, ftype *C.char, context unsafe.Pointer) (ret C.cl_error_t) {
+	defer recoverCallback("precache", &ret)
+	ctx := findContext(context)
+	if ctx != nil {
+		ctx.mu.Lock()
+		if ctx.fileType == "" {
+			ctx.fileType = C.GoString(ftype)
+		}
+		if ctx.tree != nil {
+			ctx.tree.precache(int(fd), C.GoString(ftype))
+		}
+		ctx.mu.Unlock()
+	}
+	if ctx.isAborted() {
+		return Break
+	}
 	fn := callbackFuncs["precache"]
 	if fn == nil {
 		return Clean
 	}
-	ctx := findContext(context)
-	return C.cl_error_t(fn.(CallbackPreCache)(int(fd), C.GoString(ftype), ctx))
+	return C.cl_error_t(fn.(CallbackPreCache)(int(fd), C.GoString(ftype), ctx.userValue()))
 }
 
 // SetPreCacheCallback sets the callback function to use with ClamAV's
@@ -48,13 +88,31 @@ func (e *Engine) SetPreCacheCallback(cb CallbackPreCache) {
 }
 
 //export prescanCallback
-func prescanCallback(fd C.int, ftype *C.char, context unsafe.Pointer) C.cl_error_t {
+func prescanCallback(fd C.int, ftype *C.char, context unsafe.Pointer) (ret C.cl_error_t) {
+	defer recoverCallback("prescan", &ret)
+	ctx := findContext(context)
+	if ctx != nil {
+		var f objectFile
+		if ctx.tree != nil {
+			// hashed before locking, which would hold up InFlight
+			f = ctx.tree.file(int(fd))
+		}
+		ctx.mu.Lock()
+		ctx.inner = C.GoString(ftype)
+		ctx.files++
+		if ctx.tree != nil {
+			ctx.tree.prescan(int(fd), ctx.inner, f)
+		}
+		ctx.mu.Unlock()
+	}
+	if ctx.isAborted() {
+		return Break
+	}
 	v := callbackFuncs["prescan"]
 	if v == nil {
 		return Clean
 	}
-	ctx := findContext(context)
-	return C.cl_error_t(v.(CallbackPreScan)(int(fd), C.GoString(ftype), ctx))
+	return C.cl_error_t(v.(CallbackPreScan)(int(fd), C.GoString(ftype), ctx.userValue()))
 }
 
 // SetPreScanCallback will set the callback function ClamAV will call before a
@@ -65,13 +123,23 @@ func (e *Engine) SetPreScanCallback(cb CallbackPreScan) {
 }
 
 //export postscanCallback
-func postscanCallback(fd, result C.int, virname *C.char, context unsafe.Pointer) C.cl_error_t {
+func postscanCallback(fd, result C.int, virname *C.char, context unsafe.Pointer) (ret C.cl_error_t) {
+	defer recoverCallback("postscan", &ret)
+	ctx := findContext(context)
+	if ErrorCode(result) == Virus {
+		ctx.addMatch(C.GoString(virname))
+	}
+	ctx.addCondition(ErrorCode(result))
+	if ctx != nil && ctx.tree != nil {
+		ctx.mu.Lock()
+		ctx.tree.postscan(ErrorCode(result), C.GoString(virname))
+		ctx.mu.Unlock()
+	}
 	v := callbackFuncs["postscan"]
 	if v == nil {
 		return Clean
 	}
-	ctx := findContext(context)
-	return C.cl_error_t(v.(CallbackPostScan)(int(fd), ErrorCode(result), C.GoString(virname), ctx))
+	return C.cl_error_t(v.(CallbackPostScan)(int(fd), ErrorCode(result), C.GoString(virname), ctx.userValue()))
 }
 
 // SetPostScanCallback will set the callback function ClamAV will call before the
@@ -81,6 +149,16 @@ func (e *Engine) SetPostScanCallback(cb CallbackPostScan) {
 	C.cl_engine_set_clcb_post_scan((*C.struct_cl_engine)(unsafe.Pointer(e)), (C.clcb_post_scan)(unsafe.Pointer(C.postscan_cgo)))
 }
 
+// setHooks installs the callbacks the package itself depends on to build a
+// Result and to follow the scans in progress. They call through to the user
+// callbacks, if any are set.
+func (e *Engine) setHooks() {
+	C.cl_engine_set_clcb_pre_cache((*C.struct_cl_engine)(unsafe.Pointer(e)), (C.clcb_pre_cache)(unsafe.Pointer(C.precache_cgo)))
+	C.cl_engine_set_clcb_pre_scan((*C.struct_cl_engine)(unsafe.Pointer(e)), C.clcb_pre_scan(unsafe.Pointer(C.prescan_cgo)))
+	C.cl_engine_set_clcb_post_scan((*C.struct_cl_engine)(unsafe.Pointer(e)), (C.clcb_post_scan)(unsafe.Pointer(C.postscan_cgo)))
+	C.cl_engine_set_clcb_hash((*C.struct_cl_engine)(unsafe.Pointer(e)), (C.clcb_hash)(unsafe.Pointer(C.hash_cgo)))
+}
+
 // PreadHandleCallbacks stores a pread function associated with each handle passed
 // through FmapOpenHandle. The callbacks are used to read from the file/memory location
 // associated with the handle
@@ -101,14 +179,28 @@ func preadCallback(handle unsafe.Pointer, buf unsafe.Pointer, count C.size_t, of
 //	return 0
 // }
 
-//export msgcb
-var msgcb = func(severity C.enum_cl_msg, fullmsg *C.char, msg *C.char, context unsafe.Pointer) {
-	v := callbackFuncs["msg"]
-	if v == nil {
-		return
+//export msgCallback
+func msgCallback(severity C.enum_cl_msg, fullmsg, msg *C.char, context unsafe.Pointer) {
+	defer recoverCallback("msg", nil)
+	// messages logged outside of a scan, e.g. while loading the databases,
+	// have no context
+	var sc *scanContext
+	if context != nil {
+		callbacks.Lock()
+		sc = callbacks.cb[context]
+		callbacks.Unlock()
 	}
-	ctx := findContext(context)
-	v.(CallbackMsg)(Msg(severity), C.GoString(fullmsg), C.GoString(msg), ctx)
+	if l := currentLogger(); l != nil {
+		logMsg(l, Msg(severity), C.GoString(msg), sc)
+	}
+	if v := callbackFuncs["msg"]; v != nil {
+		v.(CallbackMsg)(Msg(severity), C.GoString(fullmsg), C.GoString(msg), sc.userValue())
+	}
+}
+
+// setMsgHook installs msgCallback as the message callback of libclamav.
+func setMsgHook() {
+	C.cl_set_clcb_msg((C.clcb_msg)(unsafe.Pointer(C.msg_cgo)))
 }
 
 // SetMsgCallback will set the callback function ClamAV will call for any error and warning
@@ -119,17 +211,23 @@ var msgcb = func(severity C.enum_cl_msg, fullmsg *C.char, msg *C.char, context u
 // Callable before cl_init, if you want to log messages from cl_init() itself.
 func SetMsgCallback(cb CallbackMsg) {
 	callbackFuncs["msg"] = cb
-	C.cl_set_clcb_msg((C.clcb_msg)(unsafe.Pointer(&msgcb)))
+	setMsgHook()
 }
 
 //export hashCallback
 func hashCallback(fd C.int, size C.ulonglong, md5 *C.uchar, virname *C.char, context unsafe.Pointer) {
+	defer recoverCallback("hash", nil)
+	ctx := findContext(context)
+	if ctx != nil && ctx.tree != nil {
+		ctx.mu.Lock()
+		ctx.tree.hash(uint64(size), C.GoBytes(unsafe.Pointer(md5), 16), C.GoString(virname))
+		ctx.mu.Unlock()
+	}
 	v := callbackFuncs["hash"]
 	if v == nil {
 		return
 	}
-	ctx := findContext(context)
-	v.(CallbackHash)(int(fd), uint64(size), []byte(C.GoBytes(unsafe.Pointer(md5), 16)), C.GoString(virname), ctx)
+	v.(CallbackHash)(int(fd), uint64(size), []byte(C.GoBytes(unsafe.Pointer(md5), 16)), C.GoString(virname), ctx.userValue())
 }
 
 // SetHashCallback will set the callback function ClamAV will call with statistics
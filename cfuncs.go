@@ -28,6 +28,12 @@ off_t pread_cgo(void* handle, void *buf, size_t count, off_t offset)
 	return preadCallback(handle, buf, count, offset);
 }
 
+extern void msgCallback(enum cl_msg severity, char *fullmsg, char *msg, void *context);
+void msg_cgo(enum cl_msg severity, const char *fullmsg, const char *msg, void *context)
+{
+	msgCallback(severity, (char *)fullmsg, (char *)msg, context);
+}
+
 extern void hashCallback(int fd, unsigned long long size, const unsigned char *md5, const char *virname, void *context);
 void hash_cgo(int fd, unsigned long long size, const unsigned char *md5, const char *virname, void *context)
 {
@@ -17,7 +17,10 @@ import "C"
 
 import (
 	"fmt"
+	"io"
+	"log/slog"
 	"sync"
+	"time"
 	"unsafe"
 )
 
@@ -29,14 +32,86 @@ var initOnce sync.Once
 type Callback struct {
 	sync.Mutex
 	nextID uintptr
-	cb     map[unsafe.Pointer]interface{}
+	cb     map[unsafe.Pointer]*scanContext
 }
 
 var callbacks = Callback{
-	cb: map[unsafe.Pointer]interface{}{},
+	cb: map[unsafe.Pointer]*scanContext{},
+}
+
+// scanContext holds the state of a single scan for the duration of that scan.
+// The callbacks map it to the opaque pointer handed to libclamav.
+type scanContext struct {
+	value   interface{} // context passed to the user callbacks
+	attrs   []slog.Attr // attached to the messages logged during the scan, see WithAttrs
+	debug   io.Writer   // receives the debug messages of the scan, see WithDebug
+	matches []string
+	conds   Condition    // from the codes of the post-scan callbacks
+	tree    *treeBuilder // the objects visited, see WithTree
+
+	// progress, read by InFlight while the scan runs
+	id       uint64
+	path     string
+	start    time.Time
+	aborted  int32 // set by AbortScan
+	mu       sync.Mutex
+	fileType string // type of the outer file, from the first pre-cache callback
+	inner    string // type of the file being scanned, from the last pre-scan callback
+	files    int    // number of pre-scan callbacks
+}
+
+// newScanContext returns the context of a scan of path, which may be empty,
+// unwrapping the attributes, debug writer and tree request added to context by
+// WithAttrs, WithDebug and WithTree.
+func newScanContext(path string, context interface{}) *scanContext {
+	sc := &scanContext{value: context, path: path}
+	if path != "" {
+		sc.attrs = []slog.Attr{slog.String("path", path)}
+	}
+	if ac, ok := context.(*attrContext); ok {
+		sc.value = ac.value
+		sc.attrs = append(sc.attrs, ac.attrs...)
+		sc.debug = ac.debug
+		if ac.tree {
+			sc.tree = &treeBuilder{tmpdir: ac.tmpdir}
+		}
+	}
+	return sc
+}
+
+// userValue returns the user context, allowing for scans with no context.
+func (sc *scanContext) userValue() interface{} {
+	if sc == nil {
+		return nil
+	}
+	return sc.value
 }
 
-func setContext(i interface{}) unsafe.Pointer {
+// addMatch records a virus name reported during the scan, once.
+func (sc *scanContext) addMatch(name string) {
+	if sc == nil || name == "" {
+		return
+	}
+	for _, m := range sc.matches {
+		if m == name {
+			return
+		}
+	}
+	sc.matches = append(sc.matches, name)
+}
+
+// addCondition records the condition reported by the code returned for a
+// file in the scanned object.
+func (sc *scanContext) addCondition(code ErrorCode) {
+	if sc == nil {
+		return
+	}
+	sc.mu.Lock()
+	sc.conds |= conditionOf(code)
+	sc.mu.Unlock()
+}
+
+func setContext(sc *scanContext) unsafe.Pointer {
 	cptr := C.malloc(1)
 	if cptr == nil {
 		panic("C malloc")
@@ -44,12 +119,20 @@ func setContext(i interface{}) unsafe.Pointer {
 
 	callbacks.Lock()
 	defer callbacks.Unlock()
-	callbacks.cb[cptr] = i
+	callbacks.nextID++
+	sc.id = uint64(callbacks.nextID)
+	sc.start = time.Now()
+	callbacks.cb[cptr] = sc
 
 	return cptr
 }
 
-func findContext(key unsafe.Pointer) interface{} {
+// findContext returns the scan context registered for key. Scans started
+// without a context (ScanFile, ScanDesc) pass a nil key and get a nil context.
+func findContext(key unsafe.Pointer) *scanContext {
+	if key == nil {
+		return nil
+	}
 	callbacks.Lock()
 	defer callbacks.Unlock()
 	if v, ok := callbacks.cb[key]; ok {
@@ -97,6 +180,7 @@ func DeinitCrypto() {
 // New allocates a new ClamAV engine.
 func New() *Engine {
 	eng := (*Engine)(C.cl_engine_new())
+	eng.setHooks()
 	return eng
 }
 
@@ -105,9 +189,21 @@ func New() *Engine {
 // by the Go garbage collector, Free should be called when the engine is no
 // longer in use.
 func (e *Engine) Free() int {
+	loaded.release(e)
 	return int(C.cl_engine_free((*C.struct_cl_engine)(e)))
 }
 
+// Addref adds a reference to the engine. The engine is released by the Free
+// call dropping the last reference.
+func (e *Engine) Addref() error {
+	err := ErrorCode(C.cl_engine_addref((*C.struct_cl_engine)(e)))
+	if err != Success {
+		return fmt.Errorf("Addref: %v", StrError(err))
+	}
+	loaded.addref(e)
+	return nil
+}
+
 // SetNum sets a number in the specified field of the engine configuration.
 // Certain fields accept only 32-bit numbers, silently truncating the higher bits
 // of the engine config. See dat.go for more information.
@@ -240,18 +336,24 @@ func (e *Engine) ScanFileCb(path string, opts uint, context interface{}) (string
 
 	// find where to store the context in our callback map. we do _not_ pass the context to
 	// C directly because aggressive garbage collection will move it around
-	cctx := setContext(context)
+	sc := newScanContext(path, context)
+	end, err := beginScan(sc)
+	if err != nil {
+		return "", 0, err
+	}
+	defer end()
+	cctx := setContext(sc)
 	// cleanup
 	defer deleteContext(cctx)
 
-	err := ErrorCode(C.cl_scanfile_callback(cpath, &name, &scanned, (*C.struct_cl_engine)(e), C.uint(opts), cctx))
-	if err == Success {
+	code := ErrorCode(C.cl_scanfile_callback(cpath, &name, &scanned, (*C.struct_cl_engine)(e), C.uint(opts), cctx))
+	if code == Success {
 		return "", 0, nil
 	}
-	if err == Virus {
-		return C.GoString(name), uint(scanned), fmt.Errorf(StrError(err))
+	if code == Virus {
+		return C.GoString(name), uint(scanned), fmt.Errorf(StrError(code))
 	}
-	return "", 0, fmt.Errorf(StrError(err))
+	return "", 0, fmt.Errorf(StrError(code))
 }
 
 // OpenMemory creates an object from the given memory that can be scanned using ScanMapCb
@@ -271,18 +373,24 @@ func (e *Engine) ScanMapCb(fmap *Fmap, opts uint, context interface{}) (string,
 
 	// find where to store the context in our callback map. we do _not_ pass the context to
 	// C directly because aggressive garbage collection will move it around
-	cctx := setContext(context)
+	sc := newScanContext("", context)
+	end, err := beginScan(sc)
+	if err != nil {
+		return "", 0, err
+	}
+	defer end()
+	cctx := setContext(sc)
 	// cleanup
 	defer deleteContext(cctx)
 
-	err := ErrorCode(C.cl_scanmap_callback((*C.cl_fmap_t)(fmap), &name, &scanned, (*C.struct_cl_engine)(e), C.uint(opts), unsafe.Pointer(cctx)))
-	if err == Success {
+	code := ErrorCode(C.cl_scanmap_callback((*C.cl_fmap_t)(fmap), &name, &scanned, (*C.struct_cl_engine)(e), C.uint(opts), unsafe.Pointer(cctx)))
+	if code == Success {
 		return "", 0, nil
 	}
-	if err == Virus {
-		return C.GoString(name), uint(scanned), fmt.Errorf(StrError(err))
+	if code == Virus {
+		return C.GoString(name), uint(scanned), fmt.Errorf(StrError(code))
 	}
-	return "", 0, fmt.Errorf(StrError(err))
+	return "", 0, fmt.Errorf(StrError(code))
 }
 
 // Load loads a single database file or all databases depending on whether its first argument
@@ -296,6 +404,7 @@ func (e *Engine) Load(path string, dbopts uint) (uint, error) {
 	if err != Success {
 		return 0, fmt.Errorf("Load: %v", StrError(err))
 	}
+	loaded.add(e, signo)
 	return signo, nil
 }
 
@@ -360,11 +469,6 @@ func CountSigs(path string, options uint) (uint, error) {
 	return cnt, nil
 }
 
-// Debug enables debug messages from libclamav
-func Debug() {
-	C.cl_debug()
-}
-
 // Retflevel returns the engine database minimum level
 func Retflevel() uint {
 	return uint(C.cl_retflevel())
@@ -384,3 +488,9 @@ func StrError(errno ErrorCode) string {
 func (e ErrorCode) String() string {
 	return C.GoString(C.cl_strerror(C.int(e)))
 }
+
+// Error implements the error interface, so that scan errors can be compared
+// against the error codes directly
+func (e ErrorCode) Error() string {
+	return e.String()
+}
@@ -300,6 +300,12 @@ func TestAddref(t *testing.T) {
 	if err := eng.Addref(); err != nil {
 		t.Fatalf("Addref: %v", err)
 	}
+	// dropping the added reference keeps what is known of the engine
+	loaded.add(eng, 7)
+	eng.Free()
+	if n := eng.Signatures(); n != 7 {
+		t.Errorf("Signatures after dropping a reference: %d, want 7", n)
+	}
 }
 
 var scanFiles = []struct {
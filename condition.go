@@ -0,0 +1,231 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Condition is a set of reasons why a scan was not complete or found
+// something short of a signature, reported in Result.Conditions.
+//
+// libclamav 0.99 skips the data beyond its limits quietly and reports the
+// object as clean, so the conditions are gathered from the codes returned for
+// the object and for each file in it, from the size of the object against
+// max_filesize and max_scansize, and from the Heuristics.* names of the
+// matches.
+type Condition uint
+
+// Scan conditions
+const (
+	CondMaxSize           Condition = 1 << iota // a file or the whole scan went over max_filesize or max_scansize
+	CondMaxFiles                                // an archive had more than max_files files
+	CondMaxRecursion                            // archives were nested deeper than max_recursion
+	CondTimeout                                 // the scan or a bytecode timed out, or was aborted
+	CondEncryptedArchive                        // an encrypted archive could not be scanned, see EncryptedPolicy
+	CondEncryptedDocument                       // an encrypted document, e.g. a PDF, could not be scanned
+	CondHeuristic                               // a Heuristics.* name matched, see Result.Heuristics
+
+	// CondEncrypted are the conditions of encrypted content
+	CondEncrypted = CondEncryptedArchive | CondEncryptedDocument
+
+	// CondIncomplete are the conditions leaving part of the object unscanned
+	CondIncomplete = CondMaxSize | CondMaxFiles | CondMaxRecursion | CondTimeout | CondEncrypted
+	// CondLimits are the conditions of clamd's AlertExceedsMax
+	CondLimits = CondMaxSize | CondMaxFiles | CondMaxRecursion | CondTimeout
+)
+
+var conditionNames = []struct {
+	c    Condition
+	name string
+}{
+	{CondMaxSize, "maxsize"},
+	{CondMaxFiles, "maxfiles"},
+	{CondMaxRecursion, "maxrecursion"},
+	{CondTimeout, "timeout"},
+	{CondEncryptedArchive, "encrypted_archive"},
+	{CondEncryptedDocument, "encrypted_document"},
+	{CondHeuristic, "heuristic"},
+}
+
+// Names returns the names of the conditions, e.g. ["maxsize", "encrypted_archive"].
+func (c Condition) Names() []string {
+	var names []string
+	for _, n := range conditionNames {
+		if c&n.c != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return names
+}
+
+func (c Condition) String() string {
+	return strings.Join(c.Names(), ",")
+}
+
+// MarshalJSON encodes the conditions as a list of names.
+func (c Condition) MarshalJSON() ([]byte, error) {
+	names := c.Names()
+	if names == nil {
+		names = []string{}
+	}
+	return json.Marshal(names)
+}
+
+// UnmarshalJSON decodes a list of names.
+func (c *Condition) UnmarshalJSON(b []byte) error {
+	var names []string
+	if err := json.Unmarshal(b, &names); err != nil {
+		return err
+	}
+	*c = 0
+next:
+	for _, name := range names {
+		for _, n := range conditionNames {
+			if n.name == name {
+				*c |= n.c
+				continue next
+			}
+		}
+		return fmt.Errorf("clamav: unknown scan condition %q", name)
+	}
+	return nil
+}
+
+// conditionOf returns the condition reported by a libclamav return code.
+func conditionOf(code ErrorCode) Condition {
+	switch code {
+	case Emaxsize:
+		return CondMaxSize
+	case Emaxfiles:
+		return CondMaxFiles
+	case Emaxrec:
+		return CondMaxRecursion
+	case Etimeout:
+		return CondTimeout
+	}
+	return 0
+}
+
+// LimitsExceeded is the name reported by AlertExceedsMax, as by clamd.
+const LimitsExceeded = "Heuristics.Limits.Exceeded"
+
+// encryptedPrefix starts the names of the detections of ScanBlockencrypted,
+// e.g. Heuristics.Encrypted.Zip
+const encryptedPrefix = "Heuristics.Encrypted."
+
+// encryptedDocuments are the types of encrypted files, after encryptedPrefix,
+// that are documents; the others are archives.
+var encryptedDocuments = []string{"PDF", "Doc", "OLE2", "OOXML", "XLS", "PPT"}
+
+// heuristicConditions map the prefixes of the Heuristics.* names to the
+// conditions they reveal. Newer versions of libclamav report their limits as
+// Heuristics.Limits.Exceeded.MaxFileSize and the like.
+var heuristicConditions = []struct {
+	prefix string
+	c      Condition
+}{
+	{LimitsExceeded + ".MaxFiles", CondMaxFiles},
+	{LimitsExceeded + ".MaxRecursion", CondMaxRecursion},
+	{LimitsExceeded + ".MaxScanTime", CondTimeout},
+	{LimitsExceeded, CondMaxSize},
+}
+
+// heuristics returns the Heuristics.* names among matches and the conditions
+// they reveal.
+func heuristics(matches []string) ([]string, Condition) {
+	var names []string
+	var c Condition
+	for _, m := range matches {
+		if !strings.HasPrefix(m, "Heuristics.") {
+			continue
+		}
+		names = append(names, m)
+		c |= CondHeuristic
+		if strings.HasPrefix(m, encryptedPrefix) {
+			c |= encryptedCondition(m)
+			continue
+		}
+		for _, h := range heuristicConditions {
+			if strings.HasPrefix(m, h.prefix) {
+				c |= h.c
+				break
+			}
+		}
+	}
+	return names, c
+}
+
+// encryptedCondition tells whether the encrypted file named by a detection of
+// ScanBlockencrypted is a document or an archive.
+func encryptedCondition(name string) Condition {
+	typ := strings.TrimPrefix(name, encryptedPrefix)
+	for _, d := range encryptedDocuments {
+		if strings.HasPrefix(typ, d) {
+			return CondEncryptedDocument
+		}
+	}
+	return CondEncryptedArchive
+}
+
+// Incomplete reports whether part of the object was left unscanned.
+func (r *Result) Incomplete() bool {
+	return r.Conditions&CondIncomplete != 0
+}
+
+// AlertExceedsMax turns a scan that was cut short by a limit into a detection
+// named LimitsExceeded, as clamd's AlertExceedsMax does, and reports whether
+// it did. Infected results are left alone.
+func (r *Result) AlertExceedsMax() bool {
+	if r.Code == Virus || r.Conditions&CondLimits == 0 {
+		return false
+	}
+	r.Code = Virus
+	r.Virus = LimitsExceeded
+	r.Matches = append(r.Matches, LimitsExceeded)
+	r.Heuristics = append(r.Heuristics, LimitsExceeded)
+	r.Conditions |= CondHeuristic
+	return true
+}
+
+// alertScanner is the Scanner returned by AlertExceedsMax
+type alertScanner struct {
+	Scanner
+}
+
+// AlertExceedsMax returns a Scanner reporting the scans of s cut short by a
+// limit as infected, see Result.AlertExceedsMax. The limit errors, such as
+// Emaxsize, are reported as detections instead of errors.
+func AlertExceedsMax(s Scanner) Scanner {
+	return alertScanner{s}
+}
+
+func alert(res *Result, err error) (*Result, error) {
+	if res.AlertExceedsMax() {
+		err = nil
+	}
+	return res, err
+}
+
+// ScanKey marks the key of the scanner, see Keyer.
+func (a alertScanner) ScanKey(context interface{}) (string, error) {
+	k, err := ScanKey(a.Scanner, context)
+	return k + "-alertmax", err
+}
+
+func (a alertScanner) ScanPath(path string, opts uint, context interface{}) (*Result, error) {
+	return alert(a.Scanner.ScanPath(path, opts, context))
+}
+
+func (a alertScanner) ScanFd(fd int, opts uint, context interface{}) (*Result, error) {
+	return alert(a.Scanner.ScanFd(fd, opts, context))
+}
+
+func (a alertScanner) ScanReader(r io.Reader, opts uint, context interface{}) (*Result, error) {
+	return alert(a.Scanner.ScanReader(r, opts, context))
+}
@@ -0,0 +1,73 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+var heuristicTests = []struct {
+	matches []string
+	names   []string
+	conds   Condition
+}{
+	{nil, nil, 0},
+	{[]string{"Eicar-Test-Signature"}, nil, 0},
+	{[]string{"Heuristics.Encrypted.Zip"}, []string{"Heuristics.Encrypted.Zip"}, CondHeuristic | CondEncryptedArchive},
+	{[]string{"Heuristics.Encrypted.PDF", "Heuristics.Encrypted.RAR"}, []string{"Heuristics.Encrypted.PDF", "Heuristics.Encrypted.RAR"}, CondHeuristic | CondEncrypted},
+	{[]string{"Win.Trojan.Agent", "Heuristics.OLE2.ContainsMacros"}, []string{"Heuristics.OLE2.ContainsMacros"}, CondHeuristic},
+	{[]string{"Heuristics.Limits.Exceeded"}, []string{"Heuristics.Limits.Exceeded"}, CondHeuristic | CondMaxSize},
+	{[]string{"Heuristics.Limits.Exceeded.MaxRecursion"}, []string{"Heuristics.Limits.Exceeded.MaxRecursion"}, CondHeuristic | CondMaxRecursion},
+}
+
+func TestHeuristics(t *testing.T) {
+	for _, tt := range heuristicTests {
+		names, conds := heuristics(tt.matches)
+		if !reflect.DeepEqual(names, tt.names) || conds != tt.conds {
+			t.Errorf("heuristics(%q): got %q %v, want %q %v", tt.matches, names, conds, tt.names, tt.conds)
+		}
+	}
+}
+
+func TestAlertExceedsMax(t *testing.T) {
+	for _, tt := range []struct {
+		res   Result
+		alert bool
+	}{
+		{Result{Code: Clean}, false},
+		{Result{Code: Clean, Conditions: CondMaxFiles}, true},
+		{Result{Code: Emaxsize, Conditions: CondMaxSize}, true},
+		{Result{Code: Clean, Conditions: CondEncryptedDocument}, false},
+		{Result{Code: Virus, Virus: "Eicar-Test-Signature", Conditions: CondMaxRecursion}, false},
+	} {
+		res := tt.res
+		if got := res.AlertExceedsMax(); got != tt.alert {
+			t.Errorf("AlertExceedsMax(%+v): %v, want %v", tt.res, got, tt.alert)
+		}
+		if tt.alert && (!res.Infected() || res.Virus != LimitsExceeded || res.Conditions&CondHeuristic == 0) {
+			t.Errorf("AlertExceedsMax(%+v): got %+v", tt.res, res)
+		}
+	}
+}
+
+func TestConditionJSON(t *testing.T) {
+	res := &Result{Code: Clean, Conditions: CondMaxSize | CondEncryptedArchive}
+	b, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Result
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Conditions != res.Conditions || !got.Incomplete() {
+		t.Errorf("%s: decoded conditions %v, want %v", b, got.Conditions, res.Conditions)
+	}
+	if err := json.Unmarshal([]byte(`{"conditions":["maxsize","bogus"]}`), &got); err == nil {
+		t.Errorf("unknown condition decoded without error")
+	}
+}
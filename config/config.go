@@ -0,0 +1,368 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+// Package config reads configuration files written in a subset of TOML:
+// comments, [table] headers, and key = value pairs whose values are strings,
+// integers, booleans or arrays of those, which may span several lines.
+//
+//	# where the databases are
+//	db = "/var/lib/clamav"
+//
+//	[engine]
+//	max_filesize = "25M"
+//	max_recursion = 16
+//
+//	[scan]
+//	exclude = [
+//		"/proc",
+//		"*.iso",
+//	]
+//
+// The package only checks the syntax. Values are returned in the order of the
+// file with their line numbers, so that the program can report keys it does
+// not know or values it can not use where they were written.
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Value is a key set in a file.
+type Value struct {
+	Key   string      // with the table, e.g. "engine.max_filesize"
+	Line  int         // where the key is set
+	Value interface{} // string, int64, bool or []interface{} of those
+}
+
+// String formats the value as a command-line flag would be written: arrays
+// are joined with commas.
+func (v *Value) String() string {
+	switch x := v.Value.(type) {
+	case []interface{}:
+		s := make([]string, len(x))
+		for i, e := range x {
+			s[i] = fmt.Sprint(e)
+		}
+		return strings.Join(s, ",")
+	}
+	return fmt.Sprint(v.Value)
+}
+
+// File is a parsed configuration file.
+type File struct {
+	Name   string
+	Values []*Value // in the order of the file
+}
+
+// Errorf returns an error located at the line of v.
+func (f *File) Errorf(v *Value, format string, args ...interface{}) error {
+	return &Error{File: f.Name, Line: v.Line, Err: fmt.Errorf(format, args...)}
+}
+
+// Error is an error at a line of a file.
+type Error struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+}
+
+// Load reads the file named name.
+func Load(name string) (*File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(name, f)
+}
+
+// Parse reads a file from r. name is used in errors.
+func Parse(name string, r io.Reader) (*File, error) {
+	p := &parser{f: &File{Name: name}, seen: map[string]int{}, sc: bufio.NewScanner(r)}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	return p.f, nil
+}
+
+type parser struct {
+	f     *File
+	sc    *bufio.Scanner
+	line  int
+	table string
+	seen  map[string]int // keys and tables, to the line where they were defined
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &Error{File: p.f.Name, Line: p.line, Err: fmt.Errorf(format, args...)}
+}
+
+// next returns the next line, false at the end of the file.
+func (p *parser) next() (string, bool) {
+	if !p.sc.Scan() {
+		return "", false
+	}
+	p.line++
+	return p.sc.Text(), true
+}
+
+func (p *parser) parse() error {
+	for {
+		line, ok := p.next()
+		if !ok {
+			break
+		}
+		s := strings.TrimSpace(line)
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		if s[0] == '[' {
+			if err := p.header(s); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := p.keyValue(s); err != nil {
+			return err
+		}
+	}
+	return p.sc.Err()
+}
+
+func (p *parser) header(s string) error {
+	if strings.HasPrefix(s, "[[") {
+		return p.errorf("arrays of tables are not supported")
+	}
+	end := strings.IndexByte(s, ']')
+	if end < 0 {
+		return p.errorf("missing ] in table header")
+	}
+	if rest := strings.TrimSpace(s[end+1:]); rest != "" && rest[0] != '#' {
+		return p.errorf("unexpected %q after table header", rest)
+	}
+	name, err := p.key(s[1:end])
+	if err != nil {
+		return err
+	}
+	if l, ok := p.seen[name]; ok {
+		return p.errorf("%s already defined at line %d", name, l)
+	}
+	p.seen[name] = p.line
+	p.table = name
+	return nil
+}
+
+// key checks a bare or dotted key and returns it without blanks.
+func (p *parser) key(s string) (string, error) {
+	parts := strings.Split(s, ".")
+	for i, k := range parts {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			return "", p.errorf("empty key in %q", s)
+		}
+		for _, c := range k {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+				return "", p.errorf("bad character %q in key %q", c, s)
+			}
+		}
+		parts[i] = k
+	}
+	return strings.Join(parts, "."), nil
+}
+
+func (p *parser) keyValue(s string) error {
+	eq := strings.IndexByte(s, '=')
+	if eq < 0 {
+		return p.errorf("expected key = value")
+	}
+	key, err := p.key(s[:eq])
+	if err != nil {
+		return err
+	}
+	if p.table != "" {
+		key = p.table + "." + key
+	}
+	if l, ok := p.seen[key]; ok {
+		return p.errorf("%s already defined at line %d", key, l)
+	}
+	v := &Value{Key: key, Line: p.line}
+
+	text := strings.TrimSpace(s[eq+1:])
+	for strings.HasPrefix(text, "[") && !closed(text) {
+		line, ok := p.next()
+		if !ok {
+			return &Error{File: p.f.Name, Line: v.Line, Err: errors.New("unterminated array")}
+		}
+		text += "\n" + line
+	}
+	val, rest, err := value(text)
+	if err != nil {
+		return &Error{File: p.f.Name, Line: v.Line, Err: fmt.Errorf("%s: %v", key, err)}
+	}
+	if rest = strings.TrimSpace(rest); rest != "" && rest[0] != '#' {
+		return p.errorf("unexpected %q after value of %s", rest, key)
+	}
+	v.Value = val
+	p.seen[key] = v.Line
+	p.f.Values = append(p.f.Values, v)
+	return nil
+}
+
+// closed reports whether the brackets of an array are balanced in s, ignoring
+// those in strings and comments.
+func closed(s string) bool {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				return true
+			}
+		case '"', '\'':
+			_, rest, err := str(s[i:])
+			if err != nil {
+				return false
+			}
+			i = len(s) - len(rest) - 1
+		case '#':
+			nl := strings.IndexByte(s[i:], '\n')
+			if nl < 0 {
+				return false
+			}
+			i += nl
+		}
+	}
+	return false
+}
+
+// value parses the value at the start of s and returns what follows it.
+func value(s string) (interface{}, string, error) {
+	switch {
+	case s == "":
+		return nil, "", errors.New("missing value")
+	case s[0] == '"' || s[0] == '\'':
+		return str(s)
+	case s[0] == '[':
+		return array(s[1:])
+	case s[0] == '{':
+		return nil, "", errors.New("inline tables are not supported")
+	}
+	end := strings.IndexAny(s, " \t\n,]#")
+	if end < 0 {
+		end = len(s)
+	}
+	tok, rest := s[:end], s[end:]
+	switch tok {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+	n, err := integer(tok)
+	if err != nil {
+		return nil, "", err
+	}
+	return n, rest, nil
+}
+
+func integer(tok string) (int64, error) {
+	digits := strings.TrimLeft(tok, "+-")
+	if len(digits) > 1 && digits[0] == '0' && !strings.ContainsAny(digits[1:2], "xob") {
+		return 0, fmt.Errorf("bad integer %q: leading zero", tok)
+	}
+	if strings.HasPrefix(digits, "_") || strings.HasSuffix(digits, "_") || strings.Contains(digits, "__") {
+		return 0, fmt.Errorf("bad integer %q", tok)
+	}
+	n, err := strconv.ParseInt(strings.Replace(tok, "_", "", -1), 0, 64)
+	if err != nil {
+		if strings.ContainsAny(tok, ".eE:") && !strings.HasPrefix(digits, "0x") {
+			return 0, fmt.Errorf("unsupported value %q: only strings, integers, booleans and arrays", tok)
+		}
+		return 0, fmt.Errorf("bad value %q", tok)
+	}
+	return n, nil
+}
+
+// str parses a basic "string" with escapes or a literal 'string'.
+func str(s string) (string, string, error) {
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if q == '"' {
+				i++
+			}
+		case '\n':
+			return "", "", errors.New("newline in string")
+		case q:
+			if q == '\'' {
+				return s[1:i], s[i+1:], nil
+			}
+			v, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", "", fmt.Errorf("bad string %s", s[:i+1])
+			}
+			return v, s[i+1:], nil
+		}
+	}
+	return "", "", errors.New("unterminated string")
+}
+
+// array parses the elements of an array, s starting after the [.
+func array(s string) (interface{}, string, error) {
+	var list []interface{}
+	for {
+		s = skip(s)
+		if s == "" {
+			return nil, "", errors.New("unterminated array")
+		}
+		if s[0] == ']' {
+			return list, s[1:], nil
+		}
+		v, rest, err := value(s)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, ok := v.([]interface{}); ok {
+			return nil, "", errors.New("nested arrays are not supported")
+		}
+		list = append(list, v)
+		s = skip(rest)
+		switch {
+		case strings.HasPrefix(s, ","):
+			s = s[1:]
+		case strings.HasPrefix(s, "]"):
+		default:
+			return nil, "", errors.New("expected , or ] in array")
+		}
+	}
+}
+
+// skip skips blanks, newlines and comments.
+func skip(s string) string {
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if !strings.HasPrefix(s, "#") {
+			return s
+		}
+		nl := strings.IndexByte(s, '\n')
+		if nl < 0 {
+			return ""
+		}
+		s = s[nl:]
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const example = `# avclient configuration
+db = "/var/lib/clamav"   # databases
+workers = 1_000
+
+[engine]
+max_filesize = '25M'
+max_recursion = 0x10
+keeptmp = false
+
+[scan]
+options = ["std", "-archive"]
+exclude = [
+	"/proc",  # not files
+	"*.iso",
+]
+`
+
+func TestParse(t *testing.T) {
+	f, err := Parse("avclient.toml", strings.NewReader(example))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Value{
+		{"db", 2, "/var/lib/clamav"},
+		{"workers", 3, int64(1000)},
+		{"engine.max_filesize", 6, "25M"},
+		{"engine.max_recursion", 7, int64(16)},
+		{"engine.keeptmp", 8, false},
+		{"scan.options", 11, []interface{}{"std", "-archive"}},
+		{"scan.exclude", 12, []interface{}{"/proc", "*.iso"}},
+	}
+	if len(f.Values) != len(want) {
+		t.Fatalf("got %d values, want %d", len(f.Values), len(want))
+	}
+	for i, v := range f.Values {
+		if !reflect.DeepEqual(*v, want[i]) {
+			t.Errorf("value %d = %+v, want %+v", i, *v, want[i])
+		}
+	}
+	if s := f.Values[6].String(); s != "/proc,*.iso" {
+		t.Errorf("String() = %q", s)
+	}
+}
+
+var ErrorTests = []struct {
+	in   string
+	line int
+	err  string
+}{
+	{"a = 1\nb = \n", 2, "missing value"},
+	{"a = 1\n\n[t\n", 3, "missing ]"},
+	{"a = 1\na = 2\n", 2, "already defined at line 1"},
+	{"[t]\n[t]\n", 2, "already defined"},
+	{"a = \"x\n", 1, "unterminated string"},
+	{"a = [1,\n2\n", 1, "unterminated array"},
+	{"a = 1.5\n", 1, "unsupported value"},
+	{"a = 007\n", 1, "leading zero"},
+	{"a b = 1\n", 1, "bad character"},
+	{"a = 1 2\n", 1, "unexpected"},
+	{"a = {b = 1}\n", 1, "inline tables"},
+	{"[[t]]\n", 1, "arrays of tables"},
+	{"just words\n", 1, "expected key = value"},
+}
+
+func TestErrors(t *testing.T) {
+	for _, tt := range ErrorTests {
+		_, err := Parse("f", strings.NewReader(tt.in))
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%q: got %v, want an *Error", tt.in, err)
+			continue
+		}
+		if e.Line != tt.line || !strings.Contains(e.Error(), tt.err) {
+			t.Errorf("%q: got %v, want line %d and %q", tt.in, err, tt.line, tt.err)
+		}
+	}
+}
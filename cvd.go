@@ -0,0 +1,60 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+/*
+#include <clamav.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+// CVD is the header of a signed (.cvd) or incremental (.cld) virus database
+// container.
+type CVD struct {
+	Version    uint      `json:"version"`
+	Signatures uint      `json:"signatures"`
+	Flevel     uint      `json:"flevel"` // minimum functionality level of the engine
+	Time       time.Time `json:"time"`   // build time
+	MD5        string    `json:"md5"`
+	DSig       string    `json:"dsig"` // digital signature
+	Builder    string    `json:"builder"`
+}
+
+// CVDHead reads the header of the database container in path.
+func CVDHead(path string) (*CVD, error) {
+	p := C.CString(path)
+	defer C.free(unsafe.Pointer(p))
+	cvd := C.cl_cvdhead(p)
+	if cvd == nil {
+		return nil, fmt.Errorf("CVDHead: %s: can not parse header", path)
+	}
+	defer C.cl_cvdfree(cvd)
+	return &CVD{
+		Version:    uint(cvd.version),
+		Signatures: uint(cvd.sigs),
+		Flevel:     uint(cvd.fl),
+		Time:       time.Unix(int64(cvd.stime), 0),
+		MD5:        C.GoString(cvd.md5),
+		DSig:       C.GoString(cvd.dsig),
+		Builder:    C.GoString(cvd.builder),
+	}, nil
+}
+
+// CVDVerify checks the digital signature and the checksum of the database
+// container in path.
+func CVDVerify(path string) error {
+	p := C.CString(path)
+	defer C.free(unsafe.Pointer(p))
+	if err := ErrorCode(C.cl_cvdverify(p)); err != Success {
+		return err
+	}
+	return nil
+}
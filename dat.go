@@ -12,6 +12,8 @@ package clamav
 */
 import "C"
 
+import "fmt"
+
 // Engine is a ClamAV virus scanning engine
 type Engine C.struct_cl_engine
 
@@ -60,29 +62,85 @@ const (
 	ELast                       = C.CL_ELAST_ERROR // no error codes below this line please
 )
 
+var errorNames = map[ErrorCode]string{
+	Clean:             "CL_CLEAN", // also CL_SUCCESS
+	Virus:             "CL_VIRUS",
+	Enullarg:          "CL_ENULLARG",
+	Earg:              "CL_EARG",
+	Emalfdb:           "CL_EMALFDB",
+	Ecvd:              "CL_ECVD",
+	Everify:           "CL_EVERIFY",
+	Eunpack:           "CL_EUNPACK",
+	Eopen:             "CL_EOPEN",
+	Ecreat:            "CL_ECREAT",
+	Eunlink:           "CL_EUNLINK",
+	Estat:             "CL_ESTAT",
+	Eread:             "CL_EREAD",
+	Eseek:             "CL_ESEEK",
+	Ewrite:            "CL_EWRITE",
+	Edup:              "CL_EDUP",
+	Eacces:            "CL_EACCES",
+	Etmpfile:          "CL_ETMPFILE",
+	Etmpdir:           "CL_ETMPDIR",
+	Emap:              "CL_EMAP",
+	Emem:              "CL_EMEM",
+	Etimeout:          "CL_ETIMEOUT",
+	Break:             "CL_BREAK",
+	Emaxrec:           "CL_EMAXREC",
+	Emaxsize:          "CL_EMAXSIZE",
+	Emaxfiles:         "CL_EMAXFILES",
+	Eformat:           "CL_EFORMAT",
+	Eparse:            "CL_EPARSE",
+	Ebytecode:         "CL_EBYTECODE",
+	EbytecodeTestfail: "CL_EBYTECODE_TESTFAIL",
+	Elock:             "CL_ELOCK",
+	Ebusy:             "CL_EBUSY",
+	Estate:            "CL_ESTATE",
+}
+
+// Name returns the libclamav name of the error code, e.g. "CL_EMAXSIZE", for
+// use in logs and machine-readable output.
+func (e ErrorCode) Name() string {
+	if n, ok := errorNames[e]; ok {
+		return n
+	}
+	return fmt.Sprintf("CL_ERROR_%d", int(e))
+}
+
 // EngineField selects a particular engine settings field
 type EngineField C.enum_cl_engine_field
 
 // Engine settings
 const (
-	EngineMaxScansize      EngineField = C.CL_ENGINE_MAX_SCANSIZE      // uint64_t
-	EngineMaxFilesize                  = C.CL_ENGINE_MAX_FILESIZE      // uint64_t
-	EngineMaxRecursion                 = C.CL_ENGINE_MAX_RECURSION     // uint32_t
-	EngineMaxFiles                     = C.CL_ENGINE_MAX_FILES         // uint32_t
-	EngineMinCcCount                   = C.CL_ENGINE_MIN_CC_COUNT      // uint32_t
-	EngineMinSsnCount                  = C.CL_ENGINE_MIN_SSN_COUNT     // uint32_t
-	EnginePuaCategories                = C.CL_ENGINE_PUA_CATEGORIES    // (char *)
-	EngineDbOptions                    = C.CL_ENGINE_DB_OPTIONS        // uint32_t
-	EngineDbVersion                    = C.CL_ENGINE_DB_VERSION        // uint32_t
-	EngineDbTime                       = C.CL_ENGINE_DB_TIME           // time_t
-	EngineAcOnly                       = C.CL_ENGINE_AC_ONLY           // uint32_t
-	EngineAcMindepth                   = C.CL_ENGINE_AC_MINDEPTH       // uint32_t
-	EngineAcMaxdepth                   = C.CL_ENGINE_AC_MAXDEPTH       // uint32_t
-	EngineTmpdir                       = C.CL_ENGINE_TMPDIR            // (char *)
-	EngineKeeptmp                      = C.CL_ENGINE_KEEPTMP           // uint32_t
-	EngineBytecodeSecurity             = C.CL_ENGINE_BYTECODE_SECURITY // uint32_t
-	EngineBytecodeTimeout              = C.CL_ENGINE_BYTECODE_TIMEOUT  // uint32_t
-	EngineBytecodeMode                 = C.CL_ENGINE_BYTECODE_MODE     // uint32_t
+	EngineMaxScansize        EngineField = C.CL_ENGINE_MAX_SCANSIZE        // uint64_t
+	EngineMaxFilesize                    = C.CL_ENGINE_MAX_FILESIZE        // uint64_t
+	EngineMaxRecursion                   = C.CL_ENGINE_MAX_RECURSION       // uint32_t
+	EngineMaxFiles                       = C.CL_ENGINE_MAX_FILES           // uint32_t
+	EngineMinCcCount                     = C.CL_ENGINE_MIN_CC_COUNT        // uint32_t
+	EngineMinSsnCount                    = C.CL_ENGINE_MIN_SSN_COUNT       // uint32_t
+	EnginePuaCategories                  = C.CL_ENGINE_PUA_CATEGORIES      // (char *)
+	EngineDbOptions                      = C.CL_ENGINE_DB_OPTIONS          // uint32_t
+	EngineDbVersion                      = C.CL_ENGINE_DB_VERSION          // uint32_t
+	EngineDbTime                         = C.CL_ENGINE_DB_TIME             // time_t
+	EngineAcOnly                         = C.CL_ENGINE_AC_ONLY             // uint32_t
+	EngineAcMindepth                     = C.CL_ENGINE_AC_MINDEPTH         // uint32_t
+	EngineAcMaxdepth                     = C.CL_ENGINE_AC_MAXDEPTH         // uint32_t
+	EngineTmpdir                         = C.CL_ENGINE_TMPDIR              // (char *)
+	EngineKeeptmp                        = C.CL_ENGINE_KEEPTMP             // uint32_t
+	EngineBytecodeSecurity               = C.CL_ENGINE_BYTECODE_SECURITY   // uint32_t
+	EngineBytecodeTimeout                = C.CL_ENGINE_BYTECODE_TIMEOUT    // uint32_t
+	EngineBytecodeMode                   = C.CL_ENGINE_BYTECODE_MODE       // uint32_t
+	EngineMaxEmbeddedpe                  = C.CL_ENGINE_MAX_EMBEDDEDPE      // uint64_t
+	EngineMaxHtmlnormalize               = C.CL_ENGINE_MAX_HTMLNORMALIZE   // uint64_t
+	EngineMaxHtmlnotags                  = C.CL_ENGINE_MAX_HTMLNOTAGS      // uint64_t
+	EngineMaxScriptnormalize             = C.CL_ENGINE_MAX_SCRIPTNORMALIZE // uint64_t
+	EngineMaxZiptypercg                  = C.CL_ENGINE_MAX_ZIPTYPERCG      // uint64_t
+	EngineForcetodisk                    = C.CL_ENGINE_FORCETODISK         // uint32_t
+	EngineDisableCache                   = C.CL_ENGINE_DISABLE_CACHE       // uint32_t
+	EngineDisablePEStats                 = C.CL_ENGINE_DISABLE_PE_STATS    // uint32_t
+	EngineStatsTimeout                   = C.CL_ENGINE_STATS_TIMEOUT       // uint32_t
+	EngineMaxPartitions                  = C.CL_ENGINE_MAX_PARTITIONS      // uint32_t
+	EngineMaxIconspe                     = C.CL_ENGINE_MAX_ICONSPE         // uint32_t
 )
 
 // BytecodeSecurity models security settings for the bytecode scanner
@@ -224,6 +282,9 @@ type Fmap C.cl_fmap_t
 // InitDefault has default initialization settings
 const InitDefault = 0
 
+// CountPrecision is the unit, in bytes, of the scanned counts returned by the scan functions
+const CountPrecision = C.CL_COUNT_PRECISION
+
 // CallbackPreCache is called for each processed file (both the entry level - AKA 'outer' - file and
 // inner files - those generated when processing archive and container files), before
 // the actual scanning takes place.
@@ -292,8 +353,10 @@ type Msg C.enum_cl_msg
 // Logging severity
 const (
 	MsgInfoVerbose Msg = C.CL_MSG_INFO_VERBOSE
-	MsgWarn            = C.CL_MSG_WARN
-	NsgError           = C.CL_MSG_ERROR
+	MsgWarn        Msg = C.CL_MSG_WARN
+	MsgError       Msg = C.CL_MSG_ERROR
+
+	NsgError = MsgError // misspelled, use MsgError
 )
 
 // CallbackMsg will be called instead of logging to stderr.
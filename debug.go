@@ -0,0 +1,205 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+/*
+#cgo darwin LDFLAGS:-Wl,-U,_cli_debug_flag
+
+#include <stdint.h>
+#include <stdio.h>
+#include <unistd.h>
+#include <clamav.h>
+
+// cli_debug_flag is private to libclamav: cl_debug sets it and nothing resets
+// it. Builds of the library that do not export it leave the weak reference
+// NULL.
+extern uint8_t cli_debug_flag __attribute__((weak));
+
+static int set_debug_flag(int on)
+{
+	if (&cli_debug_flag == NULL)
+		return -1;
+	cli_debug_flag = on;
+	return 0;
+}
+
+static void flush_stderr(void)
+{
+	fflush(stderr);
+}
+*/
+import "C"
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	// debugOn is set by Debug: the debug messages stay on after a capture
+	debugOn int32
+	// captureMu serializes the redirections of stderr
+	captureMu sync.Mutex
+	// scanMu is held for reading by every scan and for writing by the
+	// scans traced with WithDebug, which then run alone
+	scanMu sync.RWMutex
+)
+
+// Debug enables debug messages from libclamav, written to stderr.
+func Debug() {
+	atomic.StoreInt32(&debugOn, 1)
+	C.cl_debug()
+}
+
+// CaptureDebug enables the debug messages of libclamav and writes them to w,
+// one line per write, until stop is called. The messages of every scan in
+// progress are captured; use WithDebug to trace a single scan. libclamav
+// writes its messages to stderr, which is redirected to a pipe while
+// capturing: the lines not written by libclamav are passed on to stderr.
+//
+// libclamav has no call to turn the messages off again. When the library
+// does not export its private debug flag, the messages go to stderr after
+// the capture is stopped, as if Debug had been called.
+func CaptureDebug(w io.Writer) (stop func(), err error) {
+	captureMu.Lock()
+	end, err := startCapture(w)
+	if err != nil {
+		captureMu.Unlock()
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			end()
+			captureMu.Unlock()
+		})
+	}, nil
+}
+
+// startCapture redirects stderr to a pipe and turns on the debug messages.
+func startCapture(w io.Writer) (stop func(), err error) {
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	C.flush_stderr()
+	saved, err := C.dup(2)
+	if saved < 0 {
+		r.Close()
+		pw.Close()
+		return nil, fmt.Errorf("dup stderr: %v", err)
+	}
+	if n, err := C.dup2(C.int(pw.Fd()), 2); n < 0 {
+		C.close(saved)
+		r.Close()
+		pw.Close()
+		return nil, fmt.Errorf("redirect stderr: %v", err)
+	}
+	pw.Close()
+	stderr := os.NewFile(uintptr(saved), "stderr")
+	syscall.CloseOnExec(int(saved))
+
+	if C.set_debug_flag(1) != 0 {
+		C.cl_debug()
+	}
+	done := make(chan struct{})
+	go func() {
+		copyDebug(w, stderr, r)
+		close(done)
+	}()
+	return func() {
+		if atomic.LoadInt32(&debugOn) == 0 {
+			C.set_debug_flag(0)
+		}
+		C.flush_stderr()
+		C.dup2(C.int(saved), 2) // closes the last write end of the pipe
+		// a child process started meanwhile may hold a copy of it
+		r.SetReadDeadline(time.Now().Add(time.Second))
+		<-done
+		r.Close()
+		stderr.Close()
+	}, nil
+}
+
+// copyDebug sorts the lines read from the redirected stderr: those of
+// libclamav go to w, the others to the real stderr.
+func copyDebug(w, stderr io.Writer, r io.Reader) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			if strings.HasPrefix(line, "LibClamAV") {
+				w.Write([]byte(line))
+			} else {
+				io.WriteString(stderr, line)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// WithDebug returns a scan context that captures the debug messages of
+// libclamav while scanning with it, and writes them to w. As the messages
+// can not be told apart by scan, a traced scan waits for the scans in
+// progress to finish and runs alone. Meant for troubleshooting, e.g. to
+// attach the trace of a false positive to a bug report. See CaptureDebug.
+func WithDebug(context interface{}, w io.Writer) interface{} {
+	ac := wrapContext(context)
+	ac.debug = w
+	return ac
+}
+
+// beginScan waits for the scan of sc to be allowed to run, capturing its
+// debug messages if asked, and returns the function that ends it. A traced
+// scan waits for a CaptureDebug in progress to stop before it waits for the
+// other scans, which run meanwhile.
+func beginScan(sc *scanContext) (end func(), err error) {
+	if sc.debug == nil {
+		scanMu.RLock()
+		return scanMu.RUnlock, nil
+	}
+	captureMu.Lock()
+	scanMu.Lock()
+	stop, err := startCapture(sc.debug)
+	if err != nil {
+		scanMu.Unlock()
+		captureMu.Unlock()
+		return nil, err
+	}
+	return func() {
+		stop()
+		scanMu.Unlock()
+		captureMu.Unlock()
+	}, nil
+}
+
+// LogWriter returns a writer that logs each line written to it at
+// slog.LevelDebug, for CaptureDebug and WithDebug.
+func LogWriter(l *slog.Logger, attrs ...slog.Attr) io.Writer {
+	return &logWriter{l, attrs}
+}
+
+type logWriter struct {
+	l     *slog.Logger
+	attrs []slog.Attr
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.l.LogAttrs(context.Background(), slog.LevelDebug, strings.TrimSpace(line), w.attrs...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EncryptedPolicy says what to do with encrypted archives and documents,
+// whose content libclamav can not scan.
+type EncryptedPolicy int
+
+// Encrypted content policies
+const (
+	// EncryptedAllow scans what can be scanned of encrypted files and
+	// reports nothing more, the default of libclamav.
+	EncryptedAllow EncryptedPolicy = iota
+	// EncryptedReport finds encrypted files with ScanBlockencrypted but only
+	// reports them in Result.Conditions: the verdict is that of the rest of
+	// the object. ScanAllmatches is added so that the scan goes on past the
+	// first encrypted file.
+	EncryptedReport
+	// EncryptedBlock reports encrypted files as infected, with names such as
+	// Heuristics.Encrypted.Zip, as ScanBlockencrypted does.
+	EncryptedBlock
+)
+
+var encryptedPolicyNames = []string{"allow", "report", "block"}
+
+func (p EncryptedPolicy) String() string {
+	if p < 0 || int(p) >= len(encryptedPolicyNames) {
+		return fmt.Sprintf("EncryptedPolicy(%d)", int(p))
+	}
+	return encryptedPolicyNames[p]
+}
+
+// ParseEncryptedPolicy returns the policy called allow, report or block.
+func ParseEncryptedPolicy(name string) (EncryptedPolicy, error) {
+	for i, n := range encryptedPolicyNames {
+		if n == name {
+			return EncryptedPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("clamav: unknown encrypted policy %q, want allow, report or block", name)
+}
+
+// Options returns the scan options implementing the policy on top of opts.
+func (p EncryptedPolicy) Options(opts uint) uint {
+	switch p {
+	case EncryptedReport:
+		return opts | ScanBlockencrypted | ScanAllmatches
+	case EncryptedBlock:
+		return opts | ScanBlockencrypted
+	}
+	return opts
+}
+
+// Apply adjusts the outcome of a scan made with the Options of the policy.
+// Under EncryptedReport the encrypted files are dropped from the matches,
+// leaving their conditions, and a scan with no other match is clean.
+func (p EncryptedPolicy) Apply(res *Result, err error) (*Result, error) {
+	if p != EncryptedReport || res.Conditions&CondEncrypted == 0 {
+		return res, err
+	}
+	matches := res.Matches[:0:0]
+	for _, m := range res.Matches {
+		if !strings.HasPrefix(m, encryptedPrefix) {
+			matches = append(matches, m)
+		}
+	}
+	res.Matches = matches
+	if strings.HasPrefix(res.Virus, encryptedPrefix) {
+		res.Virus = ""
+		if len(matches) > 0 {
+			res.Virus = matches[0]
+		}
+	}
+	if res.Code == Virus && len(matches) == 0 {
+		res.Code = Clean
+	}
+	return res, err
+}
+
+// encryptedScanner is the Scanner returned by WithEncryptedPolicy
+type encryptedScanner struct {
+	Scanner
+	p EncryptedPolicy
+}
+
+// WithEncryptedPolicy returns a Scanner applying the policy to the scans of
+// s.
+func WithEncryptedPolicy(s Scanner, p EncryptedPolicy) Scanner {
+	if p == EncryptedAllow {
+		return s
+	}
+	return encryptedScanner{s, p}
+}
+
+// ScanKey adds the policy to the key of the scanner, see Keyer.
+func (e encryptedScanner) ScanKey(context interface{}) (string, error) {
+	k, err := ScanKey(e.Scanner, context)
+	return k + "-encrypted=" + e.p.String(), err
+}
+
+func (e encryptedScanner) ScanPath(path string, opts uint, context interface{}) (*Result, error) {
+	return e.p.Apply(e.Scanner.ScanPath(path, e.p.Options(opts), context))
+}
+
+func (e encryptedScanner) ScanFd(fd int, opts uint, context interface{}) (*Result, error) {
+	return e.p.Apply(e.Scanner.ScanFd(fd, e.p.Options(opts), context))
+}
+
+func (e encryptedScanner) ScanReader(r io.Reader, opts uint, context interface{}) (*Result, error) {
+	return e.p.Apply(e.Scanner.ScanReader(r, e.p.Options(opts), context))
+}
+
+// Password is tried by libclamav on encrypted zip archives, whose content is
+// scanned when one works.
+type Password struct {
+	Name     string // shown in the debug messages when the password works
+	Password string
+}
+
+// ReadPasswords reads a password list, one per line. A line may name its
+// password as name:password; blank lines and lines starting with # are
+// skipped. Passwords are taken as they are, spaces included.
+func ReadPasswords(r io.Reader) ([]Password, error) {
+	var pws []Password
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimRight(s.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pw := Password{Name: fmt.Sprintf("Password.%d", n), Password: line}
+		if i := strings.IndexByte(line, ':'); i > 0 && validPasswordName(line[:i]) {
+			pw.Name, pw.Password = line[:i], line[i+1:]
+		}
+		pws = append(pws, pw)
+	}
+	return pws, s.Err()
+}
+
+// validPasswordName reports whether name can be written in a .pwdb file.
+func validPasswordName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, ";:\r\n\t ")
+}
+
+// WritePasswordDB writes the passwords as a .pwdb database, to be tried in
+// order on encrypted zip archives. The passwords are hex encoded, so that
+// they may hold any byte.
+func WritePasswordDB(w io.Writer, pws []Password) error {
+	bw := bufio.NewWriter(w)
+	for _, pw := range pws {
+		if !validPasswordName(pw.Name) {
+			return fmt.Errorf("clamav: bad password name %q", pw.Name)
+		}
+		if pw.Password == "" {
+			return fmt.Errorf("clamav: empty password %s", pw.Name)
+		}
+		// the Engine range starts at the functionality level of 0.99,
+		// the first to read .pwdb files
+		fmt.Fprintf(bw, "%s;Engine:81-255,Container:CL_TYPE_ZIP;1;%s\n", pw.Name, hex.EncodeToString([]byte(pw.Password)))
+	}
+	return bw.Flush()
+}
+
+// LoadPasswords writes the passwords to a temporary .pwdb database and loads
+// it into the engine, before it is compiled.
+func (e *Engine) LoadPasswords(pws []Password) error {
+	if len(pws) == 0 {
+		return nil
+	}
+	dir, err := ioutil.TempDir("", "clamav-pwdb")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "passwords.pwdb")
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = WritePasswordDB(f, pws)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	_, err = e.Load(name, DbStdopt)
+	return err
+}
@@ -0,0 +1,79 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedPolicy(t *testing.T) {
+	if got := EncryptedReport.Options(ScanStdopt); got != ScanStdopt|ScanBlockencrypted|ScanAllmatches {
+		t.Errorf("report options %#x", got)
+	}
+	if got := EncryptedAllow.Options(ScanStdopt); got != ScanStdopt {
+		t.Errorf("allow options %#x", got)
+	}
+
+	for _, tt := range []struct {
+		p       EncryptedPolicy
+		matches []string
+		code    ErrorCode
+		virus   string
+	}{
+		{EncryptedReport, []string{"Heuristics.Encrypted.Zip"}, Clean, ""},
+		{EncryptedReport, []string{"Heuristics.Encrypted.Zip", "Eicar-Test-Signature"}, Virus, "Eicar-Test-Signature"},
+		{EncryptedBlock, []string{"Heuristics.Encrypted.Zip"}, Virus, "Heuristics.Encrypted.Zip"},
+	} {
+		res := &Result{Code: Virus, Virus: tt.matches[0], Matches: tt.matches}
+		res.Heuristics, res.Conditions = heuristics(tt.matches)
+		res, _ = tt.p.Apply(res, nil)
+		if res.Code != tt.code || res.Virus != tt.virus || res.Conditions&CondEncryptedArchive == 0 {
+			t.Errorf("%v %q: got %+v", tt.p, tt.matches, res)
+		}
+	}
+
+	for _, name := range []string{"allow", "report", "block"} {
+		if p, err := ParseEncryptedPolicy(name); err != nil || p.String() != name {
+			t.Errorf("ParseEncryptedPolicy(%s): %v %v", name, p, err)
+		}
+	}
+	if _, err := ParseEncryptedPolicy("deny"); err == nil {
+		t.Errorf("ParseEncryptedPolicy(deny): no error")
+	}
+
+	// verdicts kept under one policy do not hold under another
+	report, _ := ScanKey(WithEncryptedPolicy(nil, EncryptedReport), nil)
+	block, _ := ScanKey(WithEncryptedPolicy(nil, EncryptedBlock), nil)
+	if report == block {
+		t.Errorf("report and block scan with the same key %q", report)
+	}
+}
+
+func TestPasswordDB(t *testing.T) {
+	pws, err := ReadPasswords(strings.NewReader("# partners\nacme:s3cret;x\n\ninfected\nhttp://x\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Password{{"acme", "s3cret;x"}, {"Password.4", "infected"}, {"http", "//x"}}
+	if !reflect.DeepEqual(pws, want) {
+		t.Errorf("ReadPasswords: got %q, want %q", pws, want)
+	}
+
+	var b bytes.Buffer
+	if err := WritePasswordDB(&b, pws[:2]); err != nil {
+		t.Fatal(err)
+	}
+	wantDB := "acme;Engine:81-255,Container:CL_TYPE_ZIP;1;7333637265743b78\n" +
+		"Password.4;Engine:81-255,Container:CL_TYPE_ZIP;1;696e666563746564\n"
+	if b.String() != wantDB {
+		t.Errorf("WritePasswordDB: got %q, want %q", b.String(), wantDB)
+	}
+	if err := WritePasswordDB(&b, []Password{{"bad name", "x"}}); err == nil {
+		t.Errorf("WritePasswordDB: no error for a name with a space")
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ManifestName is the name of the manifest an Extractor writes along with the
+// extracted files.
+const ManifestName = "manifest.json"
+
+// Manifest describes the files extracted from a scanned object.
+type Manifest struct {
+	Source string          `json:"source"` // the scanned file
+	Time   time.Time       `json:"time"`
+	Result *Result         `json:"result"` // with the tree of objects, whose Extracted fields name the files
+	Files  []ExtractedFile `json:"files"`
+}
+
+// ExtractedFile is a temporary file libclamav made while scanning, such as an
+// archive member, a decompressed stream or an unpacked executable, copied to
+// the output directory of an Extractor.
+type ExtractedFile struct {
+	File  string `json:"file"` // name in the output directory
+	Temp  string `json:"temp"` // path of the temporary file, relative to the temporary directory of the scan
+	Size  int64  `json:"size"`
+	Depth int    `json:"depth"` // of the object scanned from the file, -1 if none was
+	Type  string `json:"type,omitempty"`
+	MD5   string `json:"md5,omitempty"`
+	Virus string `json:"virus,omitempty"`
+}
+
+// Extractor scans files in forensic mode: libclamav keeps the temporary files
+// it makes, in a directory of their own for each scan, and they are copied to
+// an output directory with a Manifest mapping them onto the tree of objects of
+// the scan, see WithTree. This is what clamscan --leave-temps leaves behind,
+// named and sorted out.
+//
+// The temporary files are told apart through /proc/self/fd, so on systems
+// without it they are all copied but none is mapped. The temporary directory
+// and keeptmp are fields of the engine, so an Extractor runs one scan at a
+// time and its engine must not be used for other scans meanwhile.
+type Extractor struct {
+	Engine  *Engine
+	TempDir string // where the temporary directories of the scans are made, os.TempDir if empty
+
+	mu sync.Mutex
+}
+
+// NewExtractor returns an Extractor scanning with e.
+func NewExtractor(e *Engine) *Extractor {
+	return &Extractor{Engine: e}
+}
+
+// ExtractPath scans the file at path and copies the files libclamav extracted
+// from it to the directory out, which is made if needed and should be empty,
+// with a Manifest named ManifestName. The scan result is in the Manifest; the
+// error is that of the scan, if it failed, or of the extraction.
+func (x *Extractor) ExtractPath(path, out string, opts uint, context interface{}) (*Manifest, error) {
+	return x.extract(path, out, context, func(context interface{}) (*Result, error) {
+		return x.Engine.ScanPath(path, opts, context)
+	})
+}
+
+// ExtractFd is ExtractPath for the file open on fd, called name in the
+// Manifest.
+func (x *Extractor) ExtractFd(fd int, name, out string, opts uint, context interface{}) (*Manifest, error) {
+	return x.extract(name, out, context, func(context interface{}) (*Result, error) {
+		return x.Engine.ScanFd(fd, opts, context)
+	})
+}
+
+func (x *Extractor) extract(name, out string, context interface{}, scan func(context interface{}) (*Result, error)) (*Manifest, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if err := os.MkdirAll(out, 0700); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempDir(x.TempDir, "clamav-extract")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	// the paths read from /proc/self/fd are resolved
+	if p, err := filepath.EvalSymlinks(tmp); err == nil {
+		tmp = p
+	}
+
+	restore, err := x.keepTemps(tmp)
+	if err != nil {
+		return nil, err
+	}
+	ac := wrapContext(context)
+	ac.tree = true
+	ac.tmpdir = tmp
+	res, scanErr := scan(ac)
+	restore()
+
+	m := &Manifest{Source: name, Time: time.Now(), Result: res}
+	if res.Tree != nil {
+		res.Tree.Name = name
+	}
+	m.Files, err = collectExtracted(tmp, out, res.Tree)
+	if err == nil {
+		err = writeManifest(filepath.Join(out, ManifestName), m)
+	}
+	if scanErr != nil {
+		return m, scanErr
+	}
+	return m, err
+}
+
+// keepTemps points the temporary directory of the engine to dir and has
+// libclamav keep its temporary files there. The returned function restores
+// the settings.
+func (x *Extractor) keepTemps(dir string) (func(), error) {
+	e := x.Engine
+	oldDir, err := e.GetString(EngineTmpdir)
+	if err != nil {
+		return nil, err
+	}
+	oldKeep, err := e.GetNum(EngineKeeptmp)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.SetString(EngineTmpdir, dir); err != nil {
+		return nil, err
+	}
+	if err := e.SetNum(EngineKeeptmp, 1); err != nil {
+		e.SetString(EngineTmpdir, oldDir)
+		return nil, err
+	}
+	return func() {
+		e.SetNum(EngineKeeptmp, oldKeep)
+		if oldDir == "" {
+			// libclamav's default, which can not be set back
+			oldDir = os.TempDir()
+		}
+		e.SetString(EngineTmpdir, oldDir)
+	}, nil
+}
+
+// collectExtracted copies the regular files under tmp to out, naming them
+// after the objects of tree scanned from them, and returns their list. The
+// files no object was scanned from, such as those libclamav scanned from
+// memory once written, come last.
+func collectExtracted(tmp, out string, tree *Object) ([]ExtractedFile, error) {
+	kept := map[string]bool{}
+	err := filepath.Walk(tmp, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			kept[path] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	objects := map[string]*Object{}
+	var order, rest []string
+	if tree != nil {
+		tree.Walk(func(o *Object) {
+			if kept[o.tempPath] && objects[o.tempPath] == nil {
+				objects[o.tempPath] = o
+				order = append(order, o.tempPath)
+			}
+		})
+	}
+	for path := range kept {
+		if objects[path] == nil {
+			rest = append(rest, path)
+		}
+	}
+	sort.Strings(rest)
+
+	files := []ExtractedFile{}
+	for _, path := range append(order, rest...) {
+		rel, err := filepath.Rel(tmp, path)
+		if err != nil {
+			return files, err
+		}
+		f := ExtractedFile{Temp: rel, Depth: -1}
+		kind := "unknown"
+		if o := objects[path]; o != nil {
+			f.Depth, f.Type, f.MD5, f.Virus = o.Depth, o.Type, o.MD5, o.Virus
+			kind = strings.ToLower(strings.TrimPrefix(o.Type, "CL_TYPE_"))
+		}
+		f.File = fmt.Sprintf("%04d-%s", len(files)+1, kind)
+		if f.Size, err = copyFile(filepath.Join(out, f.File), path); err != nil {
+			return files, err
+		}
+		if o := objects[path]; o != nil {
+			o.Extracted = f.File
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// copyFile copies the file src to a new file dst and returns its size.
+func copyFile(dst, src string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+func writeManifest(name string, m *Manifest) error {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, append(b, '\n'), 0600)
+}
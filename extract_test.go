@@ -0,0 +1,79 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCollectExtracted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clamav-extract-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	tmp, out := filepath.Join(dir, "tmp"), filepath.Join(dir, "out")
+	for _, d := range []string{tmp, filepath.Join(tmp, "clamav-dir"), out} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"archive.zip":             "PK...", // the scanned file, outside tmp
+		"tmp/clamav-a.tmp":        "MZ...",
+		"tmp/clamav-dir/clamav-b": "unpacked",
+		"tmp/clamav-dir/clamav-c": "stream",
+	}
+	fds := map[string]int{}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		fds[name] = int(f.Fd())
+	}
+
+	// a zip whose member is an executable, unpacked to clamav-b; clamav-c
+	// was not scanned from a file
+	tb := treeBuilder{tmpdir: tmp}
+	tb.prescan(fds["archive.zip"], "CL_TYPE_ZIP", tb.file(fds["archive.zip"]))
+	tb.prescan(fds["tmp/clamav-a.tmp"], "CL_TYPE_MSEXE", tb.file(fds["tmp/clamav-a.tmp"]))
+	tb.prescan(fds["tmp/clamav-dir/clamav-b"], "CL_TYPE_MSEXE", tb.file(fds["tmp/clamav-dir/clamav-b"]))
+	tb.postscan(Virus, "Win.Test")
+	tb.postscan(Virus, "Win.Test")
+	tb.postscan(Virus, "Win.Test")
+	tree := tb.finish("archive.zip", Virus, "Win.Test")
+
+	got, err := collectExtracted(tmp, out, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ExtractedFile{
+		{File: "0001-msexe", Temp: "clamav-a.tmp", Size: 5, Depth: 1, Type: "CL_TYPE_MSEXE", MD5: fdMD5(fds["tmp/clamav-a.tmp"])},
+		{File: "0002-msexe", Temp: "clamav-dir/clamav-b", Size: 8, Depth: 2, Type: "CL_TYPE_MSEXE", MD5: fdMD5(fds["tmp/clamav-dir/clamav-b"]), Virus: "Win.Test"},
+		{File: "0003-unknown", Temp: "clamav-dir/clamav-c", Size: 6, Depth: -1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("collectExtracted:\ngot  %+v\nwant %+v", got, want)
+	}
+	if tree.Extracted != "" || tree.Children[0].Extracted != "0001-msexe" || tree.Children[0].Children[0].Extracted != "0002-msexe" {
+		t.Errorf("Extracted not set on the tree: %+v", tree)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(out, "0002-msexe")); err != nil || string(b) != "unpacked" {
+		t.Errorf("0002-msexe: %q %v", b, err)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+// Package fanotify implements on-access scanning on Linux. A Monitor
+// receives fanotify events for the mount points and directories marked on
+// it, scans the file through the descriptor the kernel passes along and, for
+// FAN_OPEN_PERM events, allows or denies the open according to the verdict.
+// Files closed after writing (FAN_CLOSE_WRITE) are scanned too, and reported
+// to OnInfected, but nothing can be denied for them.
+//
+// A process blocked on a permission event waits for the scan, so every
+// decision is bounded by Timeout, after which the open is allowed unless
+// DenyOnError is set. Opens by the monitor's own process, which includes
+// libclamav reading its databases and temporary files, are always allowed.
+// Each event holds a descriptor until it is scanned, so at most MaxPending
+// are held at once; the events beyond are decided as on a timeout.
+//
+// Marking needs CAP_SYS_ADMIN. Scanner is typically wrapped in a cache.Scanner
+// so that files opened over and over are not scanned each time.
+package fanotify
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// Defaults for the Monitor settings
+const (
+	DefaultTimeout = 5 * time.Second
+	DefaultOptions = clamav.ScanStdopt
+)
+
+// ErrUnsupported is returned by New where fanotify is not available.
+var ErrUnsupported = errors.New("fanotify: not supported on this system")
+
+// Monitor scans files on access. Its fields must be set before Run.
+type Monitor struct {
+	Scanner clamav.Scanner
+
+	Options     uint          // scan options, DefaultOptions if zero
+	Timeout     time.Duration // longest a permission decision may take, DefaultTimeout if zero
+	DenyOnError bool          // deny opens that could not be scanned or timed out instead of allowing them
+	Workers     int           // concurrent scans, 4 if zero
+	MaxPending  int           // events waiting for or in a scan, 64 per worker if zero
+	Exclude     []string      // path prefixes that are never scanned
+
+	// OnInfected, if set, is called for every infected file with the
+	// process that accessed it and whether the access was denied.
+	OnInfected func(path string, res *clamav.Result, pid int, denied bool)
+
+	// ErrorLog logs errors and timeouts, the log package's default if nil.
+	ErrorLog *log.Logger
+
+	sys
+}
+
+func (m *Monitor) logf(format string, args ...interface{}) {
+	if m.ErrorLog != nil {
+		m.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func (m *Monitor) options() uint {
+	if m.Options == 0 {
+		return DefaultOptions
+	}
+	return m.Options
+}
+
+func (m *Monitor) timeout() time.Duration {
+	if m.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return m.Timeout
+}
+
+func (m *Monitor) workers() int {
+	if m.Workers <= 0 {
+		return 4
+	}
+	return m.Workers
+}
+
+func (m *Monitor) maxPending() int {
+	if m.MaxPending <= 0 {
+		return 64 * m.workers()
+	}
+	return m.MaxPending
+}
+
+func (m *Monitor) excluded(path string) bool {
+	for _, p := range m.Exclude {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package fanotify
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// From <linux/fanotify.h>, which the syscall package does not carry
+const (
+	fanCloseWrite   = 0x00000008
+	fanQOverflow    = 0x00004000
+	fanOpenPerm     = 0x00010000
+	fanEventOnChild = 0x08000000
+
+	fanCloexec      = 0x00000001
+	fanNonblock     = 0x00000002
+	fanClassContent = 0x00000004
+
+	fanMarkAdd    = 0x00000001
+	fanMarkRemove = 0x00000002
+	fanMarkMount  = 0x00000010
+
+	fanAllow = 0x01
+	fanDeny  = 0x02
+
+	metadataVersion = 3
+	metadataSize    = 24
+	atFdcwd         = -100
+)
+
+// sys holds the fanotify group.
+type sys struct {
+	f       *os.File
+	fd      int
+	once    sync.Once
+	sem     chan struct{}
+	pending chan struct{} // events being handled
+	wmu     sync.Mutex    // serializes responses
+}
+
+// New returns a Monitor that scans with s. It needs CAP_SYS_ADMIN.
+func New(s clamav.Scanner) (*Monitor, error) {
+	fd, _, errno := syscall.Syscall(syscall.SYS_FANOTIFY_INIT,
+		fanClassContent|fanCloexec|fanNonblock,
+		uintptr(os.O_RDONLY|syscall.O_LARGEFILE|syscall.O_CLOEXEC), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("fanotify_init", errno)
+	}
+	m := &Monitor{Scanner: s}
+	// non-blocking, so that the runtime poller lets Close interrupt Run
+	m.f = os.NewFile(fd, "fanotify")
+	m.fd = int(fd)
+	return m, nil
+}
+
+func (m *Monitor) mark(flags uint, mask uint64, path string) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	// the mask is a single argument on 64-bit systems
+	dirfd := atFdcwd
+	_, _, errno := syscall.Syscall6(syscall.SYS_FANOTIFY_MARK, uintptr(m.fd), uintptr(flags),
+		uintptr(mask), uintptr(dirfd), uintptr(unsafe.Pointer(p)), 0)
+	if errno != 0 {
+		return &os.PathError{Op: "fanotify_mark", Path: path, Err: errno}
+	}
+	return nil
+}
+
+// MarkMount scans every file opened or written on the mount holding path.
+func (m *Monitor) MarkMount(path string) error {
+	return m.mark(fanMarkAdd|fanMarkMount, fanOpenPerm|fanCloseWrite, path)
+}
+
+// MarkDir scans the files opened or written directly inside dir.
+func (m *Monitor) MarkDir(dir string) error {
+	return m.mark(fanMarkAdd, fanOpenPerm|fanCloseWrite|fanEventOnChild, dir)
+}
+
+// Unmark stops scanning the mount, or the directory, holding path.
+func (m *Monitor) Unmark(path string, mount bool) error {
+	flags := uint(fanMarkRemove)
+	mask := uint64(fanOpenPerm | fanCloseWrite | fanEventOnChild)
+	if mount {
+		flags |= fanMarkMount
+		mask = fanOpenPerm | fanCloseWrite
+	}
+	return m.mark(flags, mask, path)
+}
+
+// event is a decoded fanotify_event_metadata.
+type event struct {
+	mask uint64
+	fd   int
+	pid  int
+}
+
+// Run handles events until Close is called.
+func (m *Monitor) Run() error {
+	m.sem = make(chan struct{}, m.workers())
+	m.pending = make(chan struct{}, m.maxPending())
+	self := os.Getpid()
+	buf := make([]byte, 4096*metadataSize)
+	for {
+		n, err := m.f.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		for off := 0; off+metadataSize <= n; {
+			l := int(binary.LittleEndian.Uint32(buf[off:]))
+			if buf[off+4] != metadataVersion {
+				return fmt.Errorf("fanotify: unsupported metadata version %d", buf[off+4])
+			}
+			ev := event{
+				mask: *(*uint64)(unsafe.Pointer(&buf[off+8])),
+				fd:   int(*(*int32)(unsafe.Pointer(&buf[off+16]))),
+				pid:  int(*(*int32)(unsafe.Pointer(&buf[off+20]))),
+			}
+			if l < metadataSize {
+				return fmt.Errorf("fanotify: bad event length %d", l)
+			}
+			off += l
+			switch {
+			case ev.mask&fanQOverflow != 0:
+				m.logf("fanotify: event queue overflowed, some files were not scanned")
+			case ev.fd < 0:
+			case ev.pid == self:
+				m.finish(ev, true)
+			default:
+				// never wait here: the scans in progress may be waiting
+				// for the opens of this process to be allowed
+				select {
+				case m.pending <- struct{}{}:
+					go func() {
+						m.handle(ev)
+						<-m.pending
+					}()
+				default:
+					m.logf("fanotify: too many pending events, not scanning a file for pid %d", ev.pid)
+					m.finish(ev, !m.DenyOnError)
+				}
+			}
+		}
+	}
+}
+
+// Close stops Run. Pending permission events are answered by the kernel once
+// the group is gone.
+func (m *Monitor) Close() error {
+	return m.f.Close()
+}
+
+// finish answers a permission event and closes its descriptor.
+func (m *Monitor) finish(ev event, allow bool) {
+	if ev.mask&fanOpenPerm != 0 {
+		m.respond(ev.fd, allow)
+	}
+	syscall.Close(ev.fd)
+}
+
+func (m *Monitor) respond(fd int, allow bool) {
+	var r [8]byte
+	binary.LittleEndian.PutUint32(r[:], uint32(fd))
+	resp := uint32(fanAllow)
+	if !allow {
+		resp = fanDeny
+	}
+	binary.LittleEndian.PutUint32(r[4:], resp)
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	if _, err := m.f.Write(r[:]); err != nil {
+		m.logf("fanotify: answering event: %v", err)
+	}
+}
+
+func (m *Monitor) handle(ev event) {
+	perm := ev.mask&fanOpenPerm != 0
+	path, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(ev.fd))
+	if err != nil || m.excluded(path) {
+		m.finish(ev, true)
+		return
+	}
+
+	// the decision is made once, by the scan or by the timer
+	var once sync.Once
+	decide := func(allow bool) {
+		once.Do(func() {
+			if perm {
+				m.respond(ev.fd, allow)
+			}
+		})
+	}
+	if perm {
+		t := time.AfterFunc(m.timeout(), func() {
+			m.logf("fanotify: scanning %s for pid %d timed out", path, ev.pid)
+			decide(!m.DenyOnError)
+		})
+		defer t.Stop()
+	}
+
+	m.sem <- struct{}{}
+	res, err := m.Scanner.ScanFd(ev.fd, m.options(), clamav.WithAttrs(path, slog.String("path", path), slog.Int("pid", int(ev.pid))))
+	<-m.sem
+	allow := true
+	switch {
+	case err != nil:
+		m.logf("fanotify: error scanning %s: %v", path, err)
+		allow = !m.DenyOnError
+	case res.Infected():
+		allow = false
+	}
+	denied := false
+	once.Do(func() {
+		if perm {
+			m.respond(ev.fd, allow)
+			denied = !allow
+		}
+	})
+	syscall.Close(ev.fd)
+
+	if err == nil && res.Infected() && m.OnInfected != nil {
+		res.Path = path
+		m.OnInfected(path, res, ev.pid, denied)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package fanotify
+
+import "github.com/mirtchovski/clamav"
+
+type sys struct{}
+
+// New returns ErrUnsupported: fanotify is Linux only.
+func New(s clamav.Scanner) (*Monitor, error) {
+	return nil, ErrUnsupported
+}
+
+// MarkMount returns ErrUnsupported.
+func (m *Monitor) MarkMount(path string) error {
+	return ErrUnsupported
+}
+
+// MarkDir returns ErrUnsupported.
+func (m *Monitor) MarkDir(dir string) error {
+	return ErrUnsupported
+}
+
+// Unmark returns ErrUnsupported.
+func (m *Monitor) Unmark(path string, mount bool) error {
+	return ErrUnsupported
+}
+
+// Run returns ErrUnsupported.
+func (m *Monitor) Run() error {
+	return ErrUnsupported
+}
+
+// Close does nothing.
+func (m *Monitor) Close() error {
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package fanotify
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+	"github.com/mirtchovski/clamav/internal/scantest"
+)
+
+func TestMonitor(t *testing.T) {
+	m, err := New(&scantest.Scanner{})
+	if err != nil {
+		t.Skipf("fanotify not available: %v", err)
+	}
+	defer m.Close()
+
+	tmp, err := ioutil.TempDir("", "fanotify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := m.MarkDir(tmp); err != nil {
+		t.Skipf("can not mark %s: %v", tmp, err)
+	}
+	infected := make(chan string, 10)
+	m.OnInfected = func(path string, res *clamav.Result, pid int, denied bool) {
+		infected <- path
+	}
+	go m.Run()
+
+	// our own opens are not scanned, so the test can write the files
+	bad := filepath.Join(tmp, "eicar")
+	good := filepath.Join(tmp, "clean")
+	ioutil.WriteFile(bad, scantest.EICAR, 0644)
+	ioutil.WriteFile(good, []byte("hello\n"), 0644)
+
+	if out, err := exec.Command("cat", good).CombinedOutput(); err != nil {
+		t.Errorf("clean file denied: %v: %s", err, out)
+	}
+	if out, err := exec.Command("cat", bad).CombinedOutput(); err == nil {
+		t.Errorf("infected file allowed: %s", out)
+	}
+	select {
+	case p := <-infected:
+		if p != bad {
+			t.Errorf("OnInfected(%s), want %s", p, bad)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("OnInfected not called")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+// FieldType is the type of the value of an engine field
+type FieldType int
+
+// Engine field types
+const (
+	FieldUint32 FieldType = iota // set with SetNum
+	FieldUint64                  // set with SetNum
+	FieldString                  // set with SetString
+	FieldTime                    // a time_t, read with GetNum
+)
+
+// FieldInfo describes an engine field for configuration files and tools.
+type FieldInfo struct {
+	Field    EngineField
+	Name     string // e.g. "max_scansize"
+	Type     FieldType
+	ReadOnly bool // set by libclamav when the databases are loaded
+}
+
+// Fields lists the engine fields, in the order of enum cl_engine_field.
+var Fields = []FieldInfo{
+	{EngineMaxScansize, "max_scansize", FieldUint64, false},
+	{EngineMaxFilesize, "max_filesize", FieldUint64, false},
+	{EngineMaxRecursion, "max_recursion", FieldUint32, false},
+	{EngineMaxFiles, "max_files", FieldUint32, false},
+	{EngineMinCcCount, "min_cc_count", FieldUint32, false},
+	{EngineMinSsnCount, "min_ssn_count", FieldUint32, false},
+	{EnginePuaCategories, "pua_categories", FieldString, false},
+	{EngineDbOptions, "db_options", FieldUint32, true},
+	{EngineDbVersion, "db_version", FieldUint32, true},
+	{EngineDbTime, "db_time", FieldTime, true},
+	{EngineAcOnly, "ac_only", FieldUint32, false},
+	{EngineAcMindepth, "ac_mindepth", FieldUint32, false},
+	{EngineAcMaxdepth, "ac_maxdepth", FieldUint32, false},
+	{EngineTmpdir, "tmpdir", FieldString, false},
+	{EngineKeeptmp, "keeptmp", FieldUint32, false},
+	{EngineBytecodeSecurity, "bytecode_security", FieldUint32, false},
+	{EngineBytecodeTimeout, "bytecode_timeout", FieldUint32, false},
+	{EngineBytecodeMode, "bytecode_mode", FieldUint32, false},
+	{EngineMaxEmbeddedpe, "max_embeddedpe", FieldUint64, false},
+	{EngineMaxHtmlnormalize, "max_htmlnormalize", FieldUint64, false},
+	{EngineMaxHtmlnotags, "max_htmlnotags", FieldUint64, false},
+	{EngineMaxScriptnormalize, "max_scriptnormalize", FieldUint64, false},
+	{EngineMaxZiptypercg, "max_ziptypercg", FieldUint64, false},
+	{EngineForcetodisk, "forcetodisk", FieldUint32, false},
+	{EngineDisableCache, "disable_cache", FieldUint32, false},
+	{EngineDisablePEStats, "disable_pe_stats", FieldUint32, false},
+	{EngineStatsTimeout, "stats_timeout", FieldUint32, false},
+	{EngineMaxPartitions, "max_partitions", FieldUint32, false},
+	{EngineMaxIconspe, "max_iconspe", FieldUint32, false},
+}
+
+// FieldByName returns the description of the field called name.
+func FieldByName(name string) (FieldInfo, bool) {
+	for _, f := range Fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return FieldInfo{}, false
+}
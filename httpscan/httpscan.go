@@ -0,0 +1,392 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+// Package httpscan exposes a ClamAV scanner as an HTTP service.
+//
+// The Handler serves three endpoints:
+//
+//	POST /scan     scan the request body, or each file in a multipart/form-data body
+//	GET  /healthz  report the loaded databases
+//	GET  /readyz   as /healthz, but fails when no signatures are loaded or the databases are too old
+//
+// Scan verdicts are returned as JSON. Bodies larger than the memory limit are
+// spooled to disk before scanning. When the Handler allows it, /scan?debug=1
+// also returns the libclamav debug messages of each scan, see clamav.WithDebug.
+// /scan?profile=name scans with a profile of a clamav.ProfileScanner, see
+// clamav.WithProfile, and /scan?tree=1 returns the tree of the objects found
+// in each file, see clamav.WithTree.
+//
+// Middleware scans the uploads of an existing handler in the same way before
+// passing them on.
+package httpscan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// Defaults used when the corresponding Handler field is zero.
+const (
+	DefaultMaxBodySize  = 256 << 20
+	DefaultOptions      = clamav.ScanStdopt | clamav.ScanAllmatches
+	DefaultQueueTimeout = 30 * time.Second
+)
+
+// RequestIDHeader is the request header whose value tags the messages logged
+// by libclamav while scanning the request's body.
+const RequestIDHeader = "X-Request-Id"
+
+// Verdicts reported for each scanned object.
+const (
+	VerdictClean    = "clean"
+	VerdictInfected = "infected"
+	VerdictError    = "error"
+)
+
+// Handler is an http.Handler that scans uploaded objects with Scanner.
+type Handler struct {
+	Scanner clamav.Scanner
+
+	Options       uint          // scan options, DefaultOptions if zero
+	MaxBodySize   int64         // largest accepted request body, DefaultMaxBodySize if zero
+	MemoryLimit   int64         // bodies above this size are spooled to TempDir, clamav.DefaultSpoolLimit if zero
+	TempDir       string        // directory for spooled bodies, the system default if empty
+	MaxConcurrent int           // number of bodies spooled and scanned at once, runtime.NumCPU() if zero
+	QueueTimeout  time.Duration // longest wait for a free scan slot before answering 503, DefaultQueueTimeout if zero
+	MaxDBAge      time.Duration // databases older than this fail /readyz; no limit if zero
+	AllowDebug    bool          // honor /scan?debug=1; traced scans run one at a time
+	Profile       string        // scan profile unless the request names one, the scanner's default if empty
+
+	once sync.Once
+	sem  chan struct{}
+}
+
+// NewHandler returns a Handler scanning with s using the default settings.
+func NewHandler(s clamav.Scanner) *Handler {
+	return &Handler{Scanner: s}
+}
+
+// FileResult is the verdict on a single scanned object.
+type FileResult struct {
+	Name     string   `json:"name,omitempty"`
+	Verdict  string   `json:"verdict"`
+	Matches  []string `json:"matches,omitempty"`
+	Size     int64    `json:"size"`
+	Scanned  uint64   `json:"scanned"`
+	Duration float64  `json:"duration_ms"`
+	Error    string   `json:"error,omitempty"`
+	Debug    string   `json:"debug,omitempty"` // libclamav debug messages, for /scan?debug=1
+
+	Conditions clamav.Condition `json:"conditions,omitempty"` // why the file was not fully scanned, e.g. ["maxsize"]
+	Tree       *clamav.Object   `json:"tree,omitempty"`       // the objects found in the file, for /scan?tree=1
+}
+
+// ScanResponse is the body returned by /scan.
+type ScanResponse struct {
+	Verdict   string       `json:"verdict"` // the worst of the individual verdicts
+	Files     []FileResult `json:"files"`
+	DBVersion uint         `json:"db_version"`
+	DBTime    time.Time    `json:"db_time"`
+	Elapsed   float64      `json:"elapsed_ms"`
+}
+
+// HealthResponse is the body returned by /healthz and /readyz.
+type HealthResponse struct {
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	DBVersion  uint      `json:"db_version"`
+	DBTime     time.Time `json:"db_time"`
+	DBAge      float64   `json:"db_age_seconds"`
+	Signatures uint      `json:"signatures"`
+}
+
+func (h *Handler) init() {
+	n := h.MaxConcurrent
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	h.sem = make(chan struct{}, n)
+}
+
+func (h *Handler) options() uint {
+	if h.Options == 0 {
+		return DefaultOptions
+	}
+	return h.Options
+}
+
+func (h *Handler) queueTimeout() time.Duration {
+	if h.QueueTimeout <= 0 {
+		return DefaultQueueTimeout
+	}
+	return h.QueueTimeout
+}
+
+func (h *Handler) maxBodySize() int64 {
+	if h.MaxBodySize <= 0 {
+		return DefaultMaxBodySize
+	}
+	return h.MaxBodySize
+}
+
+func (h *Handler) memoryLimit() int64 {
+	if h.MemoryLimit <= 0 {
+		return clamav.DefaultSpoolLimit
+	}
+	return h.MemoryLimit
+}
+
+// ServeHTTP dispatches to the scan and health endpoints.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.once.Do(h.init)
+
+	switch r.URL.Path {
+	case "/scan":
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		h.serveScan(w, r)
+	case "/healthz":
+		h.serveHealth(w, false)
+	case "/readyz":
+		h.serveHealth(w, true)
+	default:
+		httpError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (h *Handler) serveScan(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if wantDebug(r) && !h.AllowDebug {
+		httpError(w, http.StatusForbidden, "debug traces are not enabled")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxBodySize())
+
+	var resp ScanResponse
+	var err error
+	if mr, merr := r.MultipartReader(); merr == nil {
+		err = h.scanMultipart(r, mr, &resp)
+	} else {
+		var fr FileResult
+		fr, err = h.scanStream(r, r.URL.Query().Get("name"), r.Body)
+		if err == nil {
+			resp.Files = append(resp.Files, fr)
+		}
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			httpError(w, http.StatusRequestEntityTooLarge, err.Error())
+		} else if err == errBusy {
+			httpError(w, http.StatusServiceUnavailable, err.Error())
+		} else {
+			httpError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+
+	resp.Verdict = VerdictClean
+	for _, f := range resp.Files {
+		if f.Verdict == VerdictInfected || resp.Verdict == VerdictClean {
+			resp.Verdict = f.Verdict
+		}
+	}
+	if db, err := h.Scanner.DBInfo(); err == nil {
+		resp.DBVersion = db.Version
+		resp.DBTime = db.Time
+	}
+	resp.Elapsed = milliseconds(time.Since(start))
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// scanMultipart scans every file part of a multipart body. Form fields that
+// are not files are skipped.
+func (h *Handler) scanMultipart(r *http.Request, mr *multipart.Reader, resp *ScanResponse) error {
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if p.FileName() == "" {
+			p.Close()
+			continue
+		}
+		fr, err := h.scanStream(r, p.FileName(), p)
+		p.Close()
+		if err != nil {
+			return err
+		}
+		resp.Files = append(resp.Files, fr)
+	}
+}
+
+var errBusy = errors.New("too many scans in progress")
+
+// scanStream waits for a free scan slot, then spools body and scans it, so
+// that no more bodies are spooled at once than scans may run. Errors reading
+// the body are returned; scan errors are reported in the FileResult. The
+// server's ReadTimeout does not cancel the request, so the wait is bounded
+// by QueueTimeout.
+func (h *Handler) scanStream(r *http.Request, name string, body io.Reader) (FileResult, error) {
+	fr := FileResult{Name: name}
+	t := time.NewTimer(h.queueTimeout())
+	defer t.Stop()
+	select {
+	case h.sem <- struct{}{}:
+		defer func() { <-h.sem }()
+	case <-t.C:
+		return fr, errBusy
+	case <-r.Context().Done():
+		return fr, errBusy
+	}
+
+	s, err := clamav.NewSpool(body, h.memoryLimit(), h.TempDir)
+	if err != nil {
+		return fr, err
+	}
+	defer s.Close()
+
+	scanSpool(h.Scanner, h.options(), s, &fr, r, wantDebug(r), wantTree(r), h.profile(r))
+	return fr, nil
+}
+
+// profile returns the scan profile asked for by r.
+func (h *Handler) profile(r *http.Request) string {
+	if p := r.URL.Query().Get("profile"); p != "" {
+		return p
+	}
+	return h.Profile
+}
+
+// wantDebug reports whether r asks for the debug messages of its scans.
+func wantDebug(r *http.Request) bool {
+	return queryFlag(r, "debug")
+}
+
+// wantTree reports whether r asks for the trees of objects of its scans.
+func wantTree(r *http.Request) bool {
+	return queryFlag(r, "tree")
+}
+
+// queryFlag reports whether the query parameter name of r is set and is
+// neither 0 nor false.
+func queryFlag(r *http.Request, name string) bool {
+	v := r.URL.Query().Get(name)
+	return v != "" && v != "0" && v != "false"
+}
+
+// scanContext is the context of the scan of the file called name in the
+// body of r. It tags the messages logged by libclamav with the file name and
+// the request ID, see clamav.SetLogger.
+func scanContext(r *http.Request, name string) interface{} {
+	attrs := []slog.Attr{slog.String("file", name)}
+	if id := r.Header.Get(RequestIDHeader); id != "" {
+		attrs = append(attrs, slog.String("request_id", id))
+	}
+	return clamav.WithAttrs(name, attrs...)
+}
+
+// scanSpool scans s, part of the body of r, with the given profile if not
+// empty, and records the verdict in fr, along with the debug messages of
+// libclamav if debug is set and the tree of objects if tree is.
+func scanSpool(sc clamav.Scanner, opts uint, s *clamav.Spool, fr *FileResult, r *http.Request, debug, tree bool, profile string) {
+	fr.Size = s.Size()
+	context := scanContext(r, fr.Name)
+	if profile != "" {
+		context = clamav.WithProfile(context, profile)
+	}
+	if tree {
+		context = clamav.WithTree(context)
+	}
+	var trace strings.Builder
+	if debug {
+		context = clamav.WithDebug(context, &trace)
+	}
+	res, err := sc.ScanReader(s, opts, context)
+	fr.Debug = trace.String()
+	fr.Scanned = res.Scanned
+	fr.Duration = milliseconds(res.Duration)
+	fr.Matches = res.Matches
+	fr.Conditions = res.Conditions
+	fr.Tree = res.Tree
+	switch {
+	case err != nil:
+		fr.Verdict = VerdictError
+		fr.Error = err.Error()
+		log.Printf("httpscan: error scanning %q: %v", fr.Name, err)
+	case res.Infected():
+		fr.Verdict = VerdictInfected
+	default:
+		fr.Verdict = VerdictClean
+	}
+}
+
+func (h *Handler) serveHealth(w http.ResponseWriter, ready bool) {
+	var resp HealthResponse
+	db, err := h.Scanner.DBInfo()
+	if err == nil {
+		resp.DBVersion = db.Version
+		resp.DBTime = db.Time
+		resp.DBAge = db.Age().Seconds()
+		resp.Signatures = db.Signatures
+		if ready {
+			err = h.checkReady(db)
+		}
+	}
+
+	status := http.StatusOK
+	resp.Status = "ok"
+	if err != nil {
+		status = http.StatusServiceUnavailable
+		resp.Status = "unavailable"
+		resp.Error = err.Error()
+	}
+	writeJSON(w, status, resp)
+}
+
+func (h *Handler) checkReady(db *clamav.DBInfo) error {
+	if db.Signatures == 0 {
+		return fmt.Errorf("no signatures loaded")
+	}
+	if h.MaxDBAge > 0 && db.Age() > h.MaxDBAge {
+		return fmt.Errorf("databases are %v old (limit %v)", db.Age().Truncate(time.Second), h.MaxDBAge)
+	}
+	return nil
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("httpscan: writing response: %v", err)
+	}
+}
+
+func httpError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{strings.TrimSpace(msg)})
+}
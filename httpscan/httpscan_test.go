@@ -0,0 +1,161 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package httpscan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mirtchovski/clamav/internal/scantest"
+)
+
+func postScan(t *testing.T, h http.Handler, ctype string, body io.Reader) (int, ScanResponse) {
+	req := httptest.NewRequest("POST", "/scan", body)
+	if ctype != "" {
+		req.Header.Set("Content-Type", ctype)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var resp ScanResponse
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+	}
+	return w.Code, resp
+}
+
+func TestScanRaw(t *testing.T) {
+	h := NewHandler(&scantest.Scanner{})
+
+	code, resp := postScan(t, h, "", bytes.NewReader(scantest.EICAR))
+	if code != http.StatusOK {
+		t.Fatalf("POST /scan: status %d", code)
+	}
+	if resp.Verdict != VerdictInfected || len(resp.Files) != 1 || len(resp.Files[0].Matches) != 1 {
+		t.Errorf("POST /scan: scantest.EICAR got %+v", resp)
+	}
+
+	code, resp = postScan(t, h, "", strings.NewReader("hello"))
+	if code != http.StatusOK || resp.Verdict != VerdictClean {
+		t.Errorf("POST /scan: clean got %d %+v", code, resp)
+	}
+}
+
+func TestScanMultipart(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("comment", string(scantest.EICAR)) // not a file, not scanned
+	fw, _ := mw.CreateFormFile("a", "clean.txt")
+	fw.Write([]byte("hello"))
+	fw, _ = mw.CreateFormFile("b", "eicar.com")
+	fw.Write(scantest.EICAR)
+	mw.Close()
+
+	// force the second file to disk
+	h := &Handler{Scanner: &scantest.Scanner{}, MemoryLimit: 16}
+	code, resp := postScan(t, h, mw.FormDataContentType(), &body)
+	if code != http.StatusOK {
+		t.Fatalf("POST /scan: status %d", code)
+	}
+	if len(resp.Files) != 2 {
+		t.Fatalf("POST /scan: %d files, want 2", len(resp.Files))
+	}
+	if resp.Files[0].Verdict != VerdictClean || resp.Files[1].Verdict != VerdictInfected {
+		t.Errorf("POST /scan: got %+v", resp.Files)
+	}
+	if resp.Verdict != VerdictInfected {
+		t.Errorf("POST /scan: verdict %s, want %s", resp.Verdict, VerdictInfected)
+	}
+}
+
+func TestScanTooLarge(t *testing.T) {
+	h := &Handler{Scanner: &scantest.Scanner{}, MaxBodySize: 16}
+	code, _ := postScan(t, h, "", bytes.NewReader(scantest.EICAR))
+	if code != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST /scan: status %d, want %d", code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+// countReader counts the bytes read from r.
+type countReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += n
+	return n, err
+}
+
+func TestScanBusy(t *testing.T) {
+	h := &Handler{Scanner: &scantest.Scanner{}, MaxConcurrent: 1}
+	h.once.Do(h.init)
+	h.sem <- struct{}{} // a scan in progress
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	body := &countReader{r: bytes.NewReader(scantest.EICAR)}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/scan", body).WithContext(ctx))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("POST /scan while busy: status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if body.n != 0 {
+		t.Errorf("POST /scan while busy: %d bytes spooled", body.n)
+	}
+
+	// the request is never canceled, but the wait is bounded
+	h.QueueTimeout = 10 * time.Millisecond
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/scan", bytes.NewReader(scantest.EICAR)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("POST /scan while busy past the queue timeout: status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestScanDebug(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		h := &Handler{Scanner: &scantest.Scanner{}, AllowDebug: allow}
+		req := httptest.NewRequest("POST", "/scan?debug=1", bytes.NewReader(scantest.EICAR))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		want := http.StatusForbidden
+		if allow {
+			want = http.StatusOK
+		}
+		if w.Code != want {
+			t.Errorf("POST /scan?debug=1 (allowed %v): status %d, want %d", allow, w.Code, want)
+		}
+	}
+}
+
+func TestReady(t *testing.T) {
+	for _, tt := range []struct {
+		age  time.Duration
+		code int
+	}{
+		{0, http.StatusOK},
+		{time.Hour, http.StatusOK},
+		{time.Nanosecond, http.StatusServiceUnavailable},
+	} {
+		h := &Handler{Scanner: &scantest.Scanner{}, MaxDBAge: tt.age}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		if w.Code != tt.code {
+			t.Errorf("GET /readyz (max age %v): status %d, want %d", tt.age, w.Code, tt.code)
+		}
+	}
+}
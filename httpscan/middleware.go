@@ -0,0 +1,238 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package httpscan
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// DefaultRejectStatus is the status returned for infected requests unless the
+// Middleware sets its own.
+const DefaultRejectStatus = http.StatusForbidden
+
+// Middleware scans request bodies before passing the requests to Next. A
+// multipart/form-data body has each file part scanned separately; any other
+// body is scanned as a whole. Infected requests are answered with
+// RejectStatus and never reach Next.
+//
+// Each part is read once into a spool, in memory or on disk depending on its
+// size, and the handler is given a body that replays the spools.
+type Middleware struct {
+	Scanner clamav.Scanner
+	Next    http.Handler
+
+	Options      uint   // scan options, DefaultOptions if zero
+	RejectStatus int    // status for infected requests, DefaultRejectStatus if zero
+	MaxBodySize  int64  // largest accepted request body, DefaultMaxBodySize if zero
+	MemoryLimit  int64  // parts above this size are spooled to TempDir, clamav.DefaultSpoolLimit if zero
+	TempDir      string // directory for spooled parts, the system default if empty
+	Profile      string // scan profile of a clamav.ProfileScanner, its default if empty
+
+	// OnReject, if set, writes the response to infected requests and to
+	// requests that could not be scanned instead of the default JSON
+	// ScanResponse.
+	OnReject func(w http.ResponseWriter, r *http.Request, status int, files []FileResult)
+}
+
+// NewMiddleware returns a Middleware that scans with s before calling next.
+func NewMiddleware(s clamav.Scanner, next http.Handler) *Middleware {
+	return &Middleware{Scanner: s, Next: next}
+}
+
+func (m *Middleware) options() uint {
+	if m.Options == 0 {
+		return DefaultOptions
+	}
+	return m.Options
+}
+
+func (m *Middleware) memoryLimit() int64 {
+	if m.MemoryLimit <= 0 {
+		return clamav.DefaultSpoolLimit
+	}
+	return m.MemoryLimit
+}
+
+// ServeHTTP scans the body of r and calls Next if it is clean.
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		m.Next.ServeHTTP(w, r)
+		return
+	}
+	max := m.MaxBodySize
+	if max <= 0 {
+		max = DefaultMaxBodySize
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, max)
+
+	var body *replayBody
+	var files []FileResult
+	var err error
+	if mt, params, perr := mime.ParseMediaType(r.Header.Get("Content-Type")); perr == nil && mt == "multipart/form-data" && params["boundary"] != "" {
+		body, files, err = m.scanMultipart(r, params["boundary"])
+	} else {
+		body, files, err = m.scanBody(r)
+	}
+	if body != nil {
+		defer body.release()
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			httpError(w, http.StatusRequestEntityTooLarge, err.Error())
+		} else {
+			httpError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+
+	status := 0
+	for _, f := range files {
+		switch f.Verdict {
+		case VerdictInfected:
+			status = m.RejectStatus
+			if status == 0 {
+				status = DefaultRejectStatus
+			}
+		case VerdictError:
+			if status == 0 {
+				status = http.StatusServiceUnavailable
+			}
+		}
+	}
+	if status != 0 {
+		m.reject(w, r, status, files)
+		return
+	}
+
+	r.Body = body
+	r.ContentLength = body.size
+	r.Header.Set("Content-Length", fmt.Sprint(body.size))
+	m.Next.ServeHTTP(w, r)
+}
+
+func (m *Middleware) reject(w http.ResponseWriter, r *http.Request, status int, files []FileResult) {
+	if m.OnReject != nil {
+		m.OnReject(w, r, status, files)
+		return
+	}
+	resp := ScanResponse{Verdict: VerdictError, Files: files}
+	if status != http.StatusServiceUnavailable {
+		resp.Verdict = VerdictInfected
+	}
+	if db, err := m.Scanner.DBInfo(); err == nil {
+		resp.DBVersion = db.Version
+		resp.DBTime = db.Time
+	}
+	writeJSON(w, status, resp)
+}
+
+func (m *Middleware) scanBody(r *http.Request) (*replayBody, []FileResult, error) {
+	s, err := clamav.NewSpool(r.Body, m.memoryLimit(), m.TempDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	body := &replayBody{spools: []*clamav.Spool{s}, size: s.Size()}
+	var fr FileResult
+	scanSpool(m.Scanner, m.options(), s, &fr, r, false, false, m.Profile)
+	if err := s.Rewind(); err != nil {
+		return body, nil, err
+	}
+	body.r = s
+	return body, []FileResult{fr}, nil
+}
+
+// scanMultipart spools every part of a multipart body, scanning the file
+// parts, and assembles a body that reproduces the parts from the spools.
+func (m *Middleware) scanMultipart(r *http.Request, boundary string) (*replayBody, []FileResult, error) {
+	body := &replayBody{}
+	var files []FileResult
+	var readers []io.Reader
+	mr := multipart.NewReader(r.Body, boundary)
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return body, files, err
+		}
+		s, err := clamav.NewSpool(p, m.memoryLimit(), m.TempDir)
+		p.Close()
+		if err != nil {
+			return body, files, err
+		}
+		body.spools = append(body.spools, s)
+
+		if p.FileName() != "" {
+			fr := FileResult{Name: p.FileName()}
+			scanSpool(m.Scanner, m.options(), s, &fr, r, false, false, m.Profile)
+			files = append(files, fr)
+			if err := s.Rewind(); err != nil {
+				return body, files, err
+			}
+		}
+
+		var hdr bytes.Buffer
+		fmt.Fprintf(&hdr, "--%s\r\n", boundary)
+		writeHeader(&hdr, p.Header)
+		readers = append(readers, &hdr, s, strings.NewReader("\r\n"))
+		body.size += int64(hdr.Len()) + s.Size() + 2
+	}
+	end := fmt.Sprintf("--%s--\r\n", boundary)
+	readers = append(readers, strings.NewReader(end))
+	body.size += int64(len(end))
+	body.r = io.MultiReader(readers...)
+	return body, files, nil
+}
+
+func writeHeader(w *bytes.Buffer, h textproto.MIMEHeader) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			fmt.Fprintf(w, "%s: %s\r\n", k, v)
+		}
+	}
+	w.WriteString("\r\n")
+}
+
+// replayBody is the request body handed to the wrapped handler. The spools
+// behind it are released once the handler returns.
+type replayBody struct {
+	r      io.Reader
+	spools []*clamav.Spool
+	size   int64
+}
+
+func (b *replayBody) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// Close does nothing: the handler may close the body before the middleware
+// is done with the spools.
+func (b *replayBody) Close() error {
+	return nil
+}
+
+func (b *replayBody) release() {
+	for _, s := range b.spools {
+		s.Close()
+	}
+}
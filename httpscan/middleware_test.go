@@ -0,0 +1,81 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package httpscan
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mirtchovski/clamav/internal/scantest"
+)
+
+// echoHandler returns the uploaded file "f" and form field "comment".
+var echoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		f, _, err := r.FormFile("f")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, _ := ioutil.ReadAll(f)
+		w.Write([]byte(r.FormValue("comment") + ":"))
+		w.Write(b)
+		return
+	}
+	b, _ := ioutil.ReadAll(r.Body)
+	w.Write(b)
+})
+
+func multipartBody(file []byte) (string, *bytes.Buffer) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("comment", "hi")
+	fw, _ := mw.CreateFormFile("f", "upload.bin")
+	fw.Write(file)
+	mw.Close()
+	return mw.FormDataContentType(), &body
+}
+
+var MiddlewareTests = []struct {
+	multipart bool
+	body      []byte
+	status    int
+	echo      string
+}{
+	{false, []byte("hello"), http.StatusOK, "hello"},
+	{false, scantest.EICAR, DefaultRejectStatus, ""},
+	{true, []byte("hello"), http.StatusOK, "hi:hello"},
+	{true, bytes.Repeat([]byte("x"), 100), http.StatusOK, "hi:" + strings.Repeat("x", 100)},
+	{true, scantest.EICAR, DefaultRejectStatus, ""},
+}
+
+func TestMiddleware(t *testing.T) {
+	// spool anything above 32 bytes to disk
+	m := &Middleware{Scanner: &scantest.Scanner{}, Next: echoHandler, MemoryLimit: 32}
+	for i, tt := range MiddlewareTests {
+		var req *http.Request
+		if tt.multipart {
+			ctype, body := multipartBody(tt.body)
+			req = httptest.NewRequest("POST", "/upload", body)
+			req.Header.Set("Content-Type", ctype)
+		} else {
+			req = httptest.NewRequest("POST", "/upload", bytes.NewReader(tt.body))
+		}
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%d: status %d, want %d (%s)", i, w.Code, tt.status, w.Body)
+			continue
+		}
+		if tt.status == http.StatusOK && w.Body.String() != tt.echo {
+			t.Errorf("%d: handler saw %q, want %q", i, w.Body, tt.echo)
+		}
+	}
+}
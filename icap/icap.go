@@ -0,0 +1,530 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+// Package icap implements an ICAP (RFC 3507) antivirus service on top of a
+// ClamAV scanner, for use with Squid and other proxies.
+//
+// The service answers OPTIONS, REQMOD and RESPMOD requests on any service
+// path. Message bodies are scanned as a whole; clean messages are answered with
+// 204 No Content when the client allows it (always after a preview) and
+// echoed back otherwise. Infected messages are replaced by a block page, and
+// the verdict is reported in the X-Infection-Found and X-Virus-ID headers.
+package icap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// Defaults used when the corresponding Server field is zero.
+const (
+	DefaultPreview     = 1024
+	DefaultBlockStatus = 403
+	DefaultOptions     = clamav.ScanStdopt | clamav.ScanAllmatches
+)
+
+// DefaultBlockPage is returned in place of infected messages unless the
+// server is given its own BlockPage.
+var DefaultBlockPage = template.Must(template.New("block").Parse(`<!DOCTYPE html>
+<html><head><title>Virus detected</title></head>
+<body>
+<h1>Virus detected</h1>
+<p>The requested content{{if .URL}} from {{.URL}}{{end}} has been blocked because it contains <b>{{.Virus}}</b>.</p>
+</body></html>
+`))
+
+// BlockInfo is passed to the block page template.
+type BlockInfo struct {
+	Virus   string   // the first virus found
+	Matches []string // all the viruses found
+	URL     string   // the URL of the HTTP request, if known
+}
+
+// Server is an ICAP antivirus service.
+type Server struct {
+	Scanner clamav.Scanner
+
+	Options     uint               // scan options, DefaultOptions if zero
+	Preview     int                // preview size advertised in OPTIONS, DefaultPreview if zero
+	ISTag       string             // service tag; derived from the database version if empty
+	BlockPage   *template.Template // executed with a BlockInfo for infected messages, DefaultBlockPage if nil
+	BlockStatus int                // HTTP status of the block page, DefaultBlockStatus if zero
+	MemoryLimit int64              // bodies above this size are spooled to TempDir, clamav.DefaultSpoolLimit if zero
+	TempDir     string             // directory for spooled bodies, the system default if empty
+	IdleTimeout time.Duration      // close connections idle for this long, no timeout if zero
+	ErrorLog    *log.Logger        // logger for connection errors, the log package's default if nil
+}
+
+// ListenAndServe listens on the TCP address addr and serves ICAP requests.
+// The standard ICAP port is 1344.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and handles each in its own goroutine.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveConn(c)
+	}
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// request is a parsed ICAP request. The encapsulated HTTP headers are kept
+// verbatim.
+type request struct {
+	method  string
+	uri     string
+	header  textproto.MIMEHeader
+	reqHdr  []byte
+	resHdr  []byte
+	hasBody bool
+}
+
+// errorStatus is returned by the request parser with the ICAP status to
+// answer with.
+type errorStatus struct {
+	code int
+	msg  string
+}
+
+func (e *errorStatus) Error() string {
+	return fmt.Sprintf("%d %s", e.code, e.msg)
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	bw := bufio.NewWriter(c)
+	for {
+		if s.IdleTimeout > 0 {
+			c.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+		}
+		req, err := readRequest(br)
+		if err != nil {
+			if es, ok := err.(*errorStatus); ok {
+				writeStatus(bw, es.code, s.istag(), nil)
+				bw.Flush()
+			} else if err != io.EOF {
+				s.logf("icap: %v: %v", c.RemoteAddr(), err)
+			}
+			return
+		}
+		c.SetReadDeadline(time.Time{})
+		if err := s.handle(br, bw, req); err != nil {
+			s.logf("icap: %v: %s %s: %v", c.RemoteAddr(), req.method, req.uri, err)
+			return
+		}
+		if err := bw.Flush(); err != nil {
+			return
+		}
+		if strings.EqualFold(req.header.Get("Connection"), "close") {
+			return
+		}
+	}
+}
+
+// readRequest reads the ICAP request line and headers and the encapsulated
+// HTTP headers. The body, if any, is left unread.
+func readRequest(br *bufio.Reader) (*request, error) {
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	f := strings.Fields(line)
+	if len(f) != 3 || !strings.HasPrefix(f[2], "ICAP/1.") {
+		return nil, &errorStatus{400, "Bad Request"}
+	}
+	h, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, &errorStatus{400, "Bad Request"}
+	}
+	req := &request{method: f[0], uri: f[1], header: h}
+
+	switch req.method {
+	case "OPTIONS":
+		return req, nil
+	case "REQMOD", "RESPMOD":
+	default:
+		return nil, &errorStatus{405, "Method Not Allowed"}
+	}
+
+	sections, err := parseEncapsulated(h.Get("Encapsulated"))
+	if err != nil {
+		return nil, &errorStatus{400, "Bad Request"}
+	}
+	for i, sec := range sections {
+		if strings.HasSuffix(sec.name, "-body") {
+			req.hasBody = sec.name != "null-body"
+			break
+		}
+		if i+1 >= len(sections) {
+			return nil, &errorStatus{400, "Bad Request"}
+		}
+		buf := make([]byte, sections[i+1].offset-sec.offset)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		switch sec.name {
+		case "req-hdr":
+			req.reqHdr = buf
+		case "res-hdr":
+			req.resHdr = buf
+		}
+	}
+	return req, nil
+}
+
+type section struct {
+	name   string
+	offset int
+}
+
+// parseEncapsulated parses an Encapsulated header such as
+// "req-hdr=0, res-hdr=137, res-body=296".
+func parseEncapsulated(v string) ([]section, error) {
+	var secs []section
+	for _, f := range strings.Split(v, ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad Encapsulated header %q", v)
+		}
+		off, err := strconv.Atoi(kv[1])
+		if err != nil || off < 0 || (len(secs) > 0 && off < secs[len(secs)-1].offset) {
+			return nil, fmt.Errorf("bad Encapsulated header %q", v)
+		}
+		secs = append(secs, section{kv[0], off})
+	}
+	if len(secs) == 0 {
+		return nil, errors.New("missing Encapsulated header")
+	}
+	return secs, nil
+}
+
+func (s *Server) handle(br *bufio.Reader, bw *bufio.Writer, req *request) error {
+	if req.method == "OPTIONS" {
+		s.writeOptions(bw)
+		return nil
+	}
+
+	allow204 := strings.Contains(req.header.Get("Allow"), "204")
+	var body io.Reader = strings.NewReader("")
+	if req.hasBody {
+		cr := &chunkReader{br: br}
+		body = cr
+		if req.header.Get("Preview") != "" {
+			preview, err := ioutil.ReadAll(cr)
+			if err != nil {
+				return err
+			}
+			// a 204 is always allowed in response to a preview
+			allow204 = true
+			body = bytes.NewReader(preview)
+			if !cr.ieof {
+				bw.WriteString("ICAP/1.0 100 Continue\r\n\r\n")
+				if err := bw.Flush(); err != nil {
+					return err
+				}
+				body = io.MultiReader(body, &chunkReader{br: br})
+			}
+		}
+	}
+
+	limit := s.MemoryLimit
+	if limit <= 0 {
+		limit = clamav.DefaultSpoolLimit
+	}
+	sp, err := clamav.NewSpool(body, limit, s.TempDir)
+	if err != nil {
+		return err
+	}
+	defer sp.Close()
+
+	url := requestURL(req.reqHdr)
+	res, err := s.Scanner.ScanReader(sp, s.options(), clamav.WithAttrs(url, slog.String("url", url)))
+	switch {
+	case err != nil:
+		s.logf("icap: error scanning %s: %v", url, err)
+		writeStatus(bw, 500, s.istag(), nil)
+		return nil
+	case res.Infected():
+		return s.writeBlock(bw, res, url)
+	case allow204:
+		writeStatus(bw, 204, s.istag(), nil)
+		return nil
+	}
+	if err := sp.Rewind(); err != nil {
+		return err
+	}
+	return s.writeEcho(bw, req, sp)
+}
+
+func (s *Server) options() uint {
+	if s.Options == 0 {
+		return DefaultOptions
+	}
+	return s.Options
+}
+
+// istag returns the service tag, which changes whenever the databases do so
+// that proxies drop cached verdicts.
+func (s *Server) istag() string {
+	if s.ISTag != "" {
+		return s.ISTag
+	}
+	if db, err := s.Scanner.DBInfo(); err == nil {
+		return fmt.Sprintf(`"clamav-%d"`, db.Version)
+	}
+	return `"clamav"`
+}
+
+func (s *Server) writeOptions(bw *bufio.Writer) {
+	preview := s.Preview
+	if preview <= 0 {
+		preview = DefaultPreview
+	}
+	writeStatus(bw, 200, s.istag(), []string{
+		"Methods: REQMOD, RESPMOD",
+		"Service: ClamAV " + clamav.Retver(),
+		"Allow: 204",
+		"Preview: " + strconv.Itoa(preview),
+		"Transfer-Preview: *",
+		"Options-TTL: 3600",
+		"Encapsulated: null-body=0",
+	})
+}
+
+// writeBlock replaces the message with the block page.
+func (s *Server) writeBlock(bw *bufio.Writer, res *clamav.Result, url string) error {
+	tmpl := s.BlockPage
+	if tmpl == nil {
+		tmpl = DefaultBlockPage
+	}
+	var page bytes.Buffer
+	if err := tmpl.Execute(&page, BlockInfo{Virus: res.Virus, Matches: res.Matches, URL: url}); err != nil {
+		return err
+	}
+
+	status := s.BlockStatus
+	if status == 0 {
+		status = DefaultBlockStatus
+	}
+	hdr := fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: %d\r\nCache-Control: no-cache\r\nConnection: close\r\n\r\n",
+		status, statusText(status), page.Len())
+	writeStatus(bw, 200, s.istag(), []string{
+		fmt.Sprintf("X-Infection-Found: Type=0; Resolution=2; Threat=%s;", res.Virus),
+		"X-Virus-ID: " + res.Virus,
+		fmt.Sprintf("Encapsulated: res-hdr=0, res-body=%d", len(hdr)),
+	})
+	bw.WriteString(hdr)
+	writeChunks(bw, bytes.NewReader(page.Bytes()))
+	return nil
+}
+
+// writeEcho returns the message unmodified, for clients that do not accept 204.
+func (s *Server) writeEcho(bw *bufio.Writer, req *request, body *clamav.Spool) error {
+	hdr, name := req.reqHdr, "req"
+	if req.method == "RESPMOD" {
+		hdr, name = req.resHdr, "res"
+	}
+	enc := fmt.Sprintf("Encapsulated: %s-hdr=0, null-body=%d", name, len(hdr))
+	if req.hasBody {
+		enc = fmt.Sprintf("Encapsulated: %s-hdr=0, %s-body=%d", name, name, len(hdr))
+	}
+	writeStatus(bw, 200, s.istag(), []string{enc})
+	bw.Write(hdr)
+	if req.hasBody {
+		return writeChunks(bw, body)
+	}
+	return nil
+}
+
+// writeStatus writes an ICAP status line and headers. Responses without an
+// Encapsulated header in extra get a null body.
+func writeStatus(bw *bufio.Writer, code int, istag string, extra []string) {
+	fmt.Fprintf(bw, "ICAP/1.0 %d %s\r\n", code, statusText(code))
+	fmt.Fprintf(bw, "ISTag: %s\r\n", istag)
+	fmt.Fprintf(bw, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123))
+	enc := false
+	for _, h := range extra {
+		enc = enc || strings.HasPrefix(h, "Encapsulated:")
+		bw.WriteString(h + "\r\n")
+	}
+	if !enc && code != 100 && code != 204 {
+		bw.WriteString("Encapsulated: null-body=0\r\n")
+	}
+	bw.WriteString("\r\n")
+}
+
+func statusText(code int) string {
+	switch code {
+	case 100:
+		return "Continue"
+	case 200:
+		return "OK"
+	case 204:
+		return "No Content"
+	case 400:
+		return "Bad Request"
+	case 403:
+		return "Forbidden"
+	case 405:
+		return "Method Not Allowed"
+	case 500:
+		return "Server Error"
+	}
+	return "Status " + strconv.Itoa(code)
+}
+
+// requestURL extracts the URL from the request line of the encapsulated HTTP
+// request headers.
+func requestURL(hdr []byte) string {
+	line := hdr
+	if i := bytes.IndexByte(hdr, '\n'); i >= 0 {
+		line = hdr[:i]
+	}
+	f := strings.Fields(string(line))
+	if len(f) < 2 {
+		return ""
+	}
+	return f[1]
+}
+
+// writeChunks copies r to bw in chunked encoding, terminated by a zero-length
+// chunk.
+func writeChunks(bw *bufio.Writer, r io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(bw, "%x\r\n", n)
+			bw.Write(buf[:n])
+			bw.WriteString("\r\n")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := bw.WriteString("0\r\n\r\n")
+	return err
+}
+
+// chunkReader decodes an ICAP chunked body. Unlike HTTP chunked encoding,
+// the last chunk may carry the "ieof" extension to mark the end of a preview
+// that holds the whole body.
+type chunkReader struct {
+	br   *bufio.Reader
+	n    int64 // bytes left in the current chunk
+	eof  bool
+	ieof bool
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.eof {
+		return 0, io.EOF
+	}
+	if cr.n == 0 {
+		if err := cr.next(); err != nil {
+			return 0, err
+		}
+		if cr.eof {
+			return 0, io.EOF
+		}
+	}
+	if int64(len(p)) > cr.n {
+		p = p[:cr.n]
+	}
+	n, err := cr.br.Read(p)
+	cr.n -= int64(n)
+	if cr.n == 0 && err == nil {
+		err = cr.crlf()
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// next reads the size line of the next chunk and, after the last chunk, the
+// trailer.
+func (cr *chunkReader) next() error {
+	line, err := cr.br.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	size, ext := line, ""
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		size, ext = line[:i], line[i+1:]
+	}
+	cr.n, err = strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+	if err != nil || cr.n < 0 {
+		return fmt.Errorf("bad chunk size %q", line)
+	}
+	if cr.n > 0 {
+		return nil
+	}
+	cr.eof = true
+	cr.ieof = strings.TrimSpace(ext) == "ieof"
+	for {
+		line, err := cr.br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if strings.TrimRight(line, "\r\n") == "" {
+			return nil
+		}
+	}
+}
+
+func (cr *chunkReader) crlf() error {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(cr.br, b); err != nil {
+		return err
+	}
+	if string(b) != "\r\n" {
+		return errors.New("malformed chunk")
+	}
+	return nil
+}
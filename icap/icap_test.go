@@ -0,0 +1,136 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/mirtchovski/clamav"
+	"github.com/mirtchovski/clamav/internal/scantest"
+)
+
+func startServer(t *testing.T) (net.Conn, *bufio.Reader) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &Server{Scanner: &scantest.Scanner{DB: clamav.DBInfo{Version: 42, Signatures: 1}}}
+	go s.Serve(l)
+	t.Cleanup(func() { l.Close() })
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, bufio.NewReader(c)
+}
+
+func readResponse(t *testing.T, br *bufio.Reader) (int, textproto.MIMEHeader) {
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		t.Fatalf("reading status: %v", err)
+	}
+	var code int
+	if _, err := fmt.Sscanf(line, "ICAP/1.0 %d", &code); err != nil {
+		t.Fatalf("bad status line %q", line)
+	}
+	h, err := tp.ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("reading headers: %v", err)
+	}
+	return code, h
+}
+
+const resHdr = "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\n\r\n"
+const reqHdr = "GET http://example.com/file HTTP/1.1\r\nHost: example.com\r\n\r\n"
+
+func respmod(body []byte, preview int, extra string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "RESPMOD icap://localhost/avscan ICAP/1.0\r\nHost: localhost\r\n%s", extra)
+	fmt.Fprintf(&b, "Encapsulated: req-hdr=0, res-hdr=%d, res-body=%d\r\n", len(reqHdr), len(reqHdr)+len(resHdr))
+	if preview >= 0 {
+		fmt.Fprintf(&b, "Preview: %d\r\n", preview)
+	}
+	b.WriteString("\r\n" + reqHdr + resHdr)
+	if preview >= 0 && preview < len(body) {
+		fmt.Fprintf(&b, "%x\r\n%s\r\n0\r\n\r\n", preview, body[:preview])
+		return b.String()
+	}
+	fmt.Fprintf(&b, "%x\r\n%s\r\n", len(body), body)
+	if preview >= 0 {
+		b.WriteString("0; ieof\r\n\r\n")
+	} else {
+		b.WriteString("0\r\n\r\n")
+	}
+	return b.String()
+}
+
+func TestOptions(t *testing.T) {
+	c, br := startServer(t)
+	io.WriteString(c, "OPTIONS icap://localhost/avscan ICAP/1.0\r\nHost: localhost\r\n\r\n")
+	code, h := readResponse(t, br)
+	if code != 200 {
+		t.Fatalf("OPTIONS: status %d", code)
+	}
+	if h.Get("Methods") != "REQMOD, RESPMOD" || h.Get("Preview") == "" || h.Get("Istag") != `"clamav-42"` {
+		t.Errorf("OPTIONS: headers %v", h)
+	}
+}
+
+func TestRespmodClean(t *testing.T) {
+	c, br := startServer(t)
+	io.WriteString(c, respmod([]byte("hello, world"), 4, ""))
+	code, _ := readResponse(t, br)
+	if code != 100 {
+		t.Fatalf("RESPMOD: preview status %d, want 100", code)
+	}
+	io.WriteString(c, "8\r\no, world\r\n0\r\n\r\n")
+	if code, _ = readResponse(t, br); code != 204 {
+		t.Errorf("RESPMOD: status %d, want 204", code)
+	}
+}
+
+func TestRespmodEcho(t *testing.T) {
+	c, br := startServer(t)
+	io.WriteString(c, respmod([]byte("hello"), -1, ""))
+	code, h := readResponse(t, br)
+	if code != 200 {
+		t.Fatalf("RESPMOD: status %d, want 200", code)
+	}
+	if h.Get("Encapsulated") != fmt.Sprintf("res-hdr=0, res-body=%d", len(resHdr)) {
+		t.Errorf("RESPMOD: Encapsulated %q", h.Get("Encapsulated"))
+	}
+	hdr := make([]byte, len(resHdr))
+	io.ReadFull(br, hdr)
+	body, err := ioutil.ReadAll(&chunkReader{br: br})
+	if string(hdr) != resHdr || string(body) != "hello" || err != nil {
+		t.Errorf("RESPMOD: echoed %q %q (%v)", hdr, body, err)
+	}
+}
+
+func TestRespmodInfected(t *testing.T) {
+	c, br := startServer(t)
+	io.WriteString(c, respmod(scantest.EICAR, 1024, "Allow: 204\r\n"))
+	code, h := readResponse(t, br)
+	if code != 200 {
+		t.Fatalf("RESPMOD: status %d, want 200", code)
+	}
+	if h.Get("X-Virus-Id") != "Eicar-Test-Signature" || !strings.Contains(h.Get("X-Infection-Found"), "Threat=Eicar-Test-Signature;") {
+		t.Errorf("RESPMOD: headers %v", h)
+	}
+	line, _ := br.ReadString('\n')
+	if !strings.HasPrefix(line, "HTTP/1.1 403") {
+		t.Errorf("RESPMOD: block page status %q", line)
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+// Package index keeps a persistent record of the files scanned in earlier
+// runs, so that unchanged files can be skipped. An Index implements
+// clamav.TreeIndex.
+//
+// A file is skipped when its last verdict was clean under the databases
+// loaded now, with the same scan options and scanner settings, and its
+// device, inode, size, modification and change times are as recorded. If only
+// the metadata changed the file is hashed and skipped if its content is the
+// same. Anything else, including new databases, gets the file scanned again.
+// Incomplete scans, see clamav.Result.Incomplete, are never recorded.
+//
+// The index is held in memory and written back by Save. It is meant for one
+// process at a time; concurrent runs on the same index file lose each other's
+// updates but never corrupt it.
+package index
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// version of the file format
+const version = 1
+
+// Entry is what the index remembers about a file.
+type Entry struct {
+	Dev, Ino   uint64
+	Size       int64
+	ModTime    int64 // Unix nanoseconds
+	ChangeTime int64 // Unix nanoseconds
+	SHA256     [sha256.Size]byte
+	Verdict    clamav.ErrorCode // Clean or Virus
+	Matches    []string
+	DBVersion  uint
+	DBTime     int64  // Unix seconds
+	Options    uint   // scan options
+	Settings   string // key of the scanner, see clamav.Keyer
+	Scanned    time.Time
+
+	seen bool // visited since the index was opened
+}
+
+// Index maps paths to entries. It is safe for concurrent use.
+type Index struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]*Entry
+	dirty   bool
+}
+
+// file is the gob-encoded content of an index file.
+type file struct {
+	Version int
+	Entries map[string]*Entry
+}
+
+// Open reads the index stored at path. A missing file yields an empty index.
+func Open(path string) (*Index, error) {
+	ix := &Index{path: path, entries: map[string]*Entry{}}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return ix, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var fl file
+	if err := gob.NewDecoder(f).Decode(&fl); err != nil {
+		return nil, fmt.Errorf("index: %s: %v", path, err)
+	}
+	if fl.Version != version {
+		return nil, fmt.Errorf("index: %s: unsupported version %d", path, fl.Version)
+	}
+	if fl.Entries != nil {
+		ix.entries = fl.Entries
+	}
+	return ix, nil
+}
+
+// Len returns the number of files in the index.
+func (ix *Index) Len() int {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return len(ix.entries)
+}
+
+// Get returns the entry for path.
+func (ix *Index) Get(path string) (*Entry, bool) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	e, ok := ix.entries[path]
+	if !ok {
+		return nil, false
+	}
+	c := *e
+	return &c, true
+}
+
+// Forget removes path from the index.
+func (ix *Index) Forget(path string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if _, ok := ix.entries[path]; ok {
+		delete(ix.entries, path)
+		ix.dirty = true
+	}
+}
+
+func (e *Entry) setStat(fi os.FileInfo) {
+	e.Dev, e.Ino, e.ChangeTime = statKey(fi)
+	e.Size = fi.Size()
+	e.ModTime = fi.ModTime().UnixNano()
+}
+
+func (e *Entry) sameStat(fi os.FileInfo) bool {
+	dev, ino, ctime := statKey(fi)
+	return e.Dev == dev && e.Ino == ino && e.ChangeTime == ctime &&
+		e.Size == fi.Size() && e.ModTime == fi.ModTime().UnixNano()
+}
+
+func hashFile(f *os.File) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	h := sha256.New()
+	// ReadAt leaves the file offset alone for the scanner
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, 1<<62)); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// matches reports whether e was recorded by a scan as k describes.
+func (e *Entry) matches(k clamav.IndexKey) bool {
+	return e.DBVersion == k.DB.Version && e.DBTime == k.DB.Time.Unix() &&
+		e.Options == k.Opts && e.Settings == k.Key
+}
+
+// Skip reports whether f, opened from path, was found clean by a scan as k
+// describes and has not changed since.
+func (ix *Index) Skip(path string, f *os.File, fi os.FileInfo, k clamav.IndexKey) bool {
+	ix.mu.Lock()
+	e, ok := ix.entries[path]
+	if ok {
+		e.seen = true
+	}
+	if !ok || e.Verdict != clamav.Clean || !e.matches(k) {
+		ix.mu.Unlock()
+		return false
+	}
+	if e.sameStat(fi) {
+		ix.mu.Unlock()
+		return true
+	}
+	want := e.SHA256
+	ix.mu.Unlock()
+
+	// the metadata changed but the content may not have
+	sum, err := hashFile(f)
+	if err != nil || sum != want {
+		return false
+	}
+	ix.mu.Lock()
+	e.setStat(fi)
+	ix.dirty = true
+	ix.mu.Unlock()
+	return true
+}
+
+// Record remembers the verdict in res for f, opened from path and described
+// by fi before it was scanned as k describes. Nothing is recorded for a failed
+// or incomplete scan, or if the file changed since fi was taken, and path is
+// forgotten instead.
+func (ix *Index) Record(path string, f *os.File, fi os.FileInfo, res *clamav.Result, k clamav.IndexKey) error {
+	if res.Code != clamav.Clean && res.Code != clamav.Virus || res.Incomplete() {
+		ix.Forget(path)
+		return nil
+	}
+	sum, err := hashFile(f)
+	if err != nil {
+		ix.Forget(path)
+		return err
+	}
+	// a write during the scan or the hashing shows in the change time
+	if now, err := f.Stat(); err != nil || !unchanged(fi, now) {
+		ix.Forget(path)
+		return err
+	}
+	e := &Entry{
+		SHA256:    sum,
+		Verdict:   res.Code,
+		Matches:   res.Matches,
+		DBVersion: k.DB.Version,
+		DBTime:    k.DB.Time.Unix(),
+		Options:   k.Opts,
+		Settings:  k.Key,
+		Scanned:   time.Now(),
+		seen:      true,
+	}
+	e.setStat(fi)
+	ix.mu.Lock()
+	ix.entries[path] = e
+	ix.dirty = true
+	ix.mu.Unlock()
+	return nil
+}
+
+// unchanged reports whether two stats of a file describe the same content.
+func unchanged(a, b os.FileInfo) bool {
+	var e Entry
+	e.setStat(a)
+	return e.sameStat(b)
+}
+
+// Prune forgets the files under the given roots that were not visited since
+// the index was opened, because they were removed, and returns how many.
+func (ix *Index) Prune(roots ...string) int {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	n := 0
+	for p, e := range ix.entries {
+		if e.seen || !under(p, roots) {
+			continue
+		}
+		delete(ix.entries, p)
+		n++
+	}
+	if n > 0 {
+		ix.dirty = true
+	}
+	return n
+}
+
+func under(path string, roots []string) bool {
+	for _, r := range roots {
+		r = filepath.Clean(r)
+		if path == r || strings.HasPrefix(path, strings.TrimSuffix(r, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Save writes the index back to its file if it changed. The file is
+// replaced atomically.
+func (ix *Index) Save() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if !ix.dirty {
+		return nil
+	}
+	f, err := ioutil.TempFile(filepath.Dir(ix.path), filepath.Base(ix.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(&file{Version: version, Entries: ix.entries})
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), ix.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	ix.dirty = false
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+var db1 = &clamav.DBInfo{Version: 1, Time: time.Unix(1500000000, 0)}
+var db2 = &clamav.DBInfo{Version: 2, Time: time.Unix(1500086400, 0)}
+
+var k1 = clamav.IndexKey{DB: db1, Opts: clamav.ScanStdopt, Key: "engine"}
+var k2 = clamav.IndexKey{DB: db2, Opts: clamav.ScanStdopt, Key: "engine"}
+
+// record scans nothing: it opens path and records res for it.
+func record(t *testing.T, ix *Index, path string, res *clamav.Result, k clamav.IndexKey) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, _ := f.Stat()
+	if err := ix.Record(path, f, fi, res, k); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func skip(t *testing.T, ix *Index, path string, k clamav.IndexKey) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, _ := f.Stat()
+	return ix.Skip(path, f, fi, k)
+}
+
+func TestIndex(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	ixPath := filepath.Join(tmp, "index")
+	clean := filepath.Join(tmp, "clean")
+	bad := filepath.Join(tmp, "bad")
+	ioutil.WriteFile(clean, []byte("hello\n"), 0600)
+	ioutil.WriteFile(bad, []byte("bad\n"), 0600)
+	gone := filepath.Join(tmp, "gone")
+	ioutil.WriteFile(gone, []byte("gone\n"), 0600)
+
+	ix, err := Open(ixPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skip(t, ix, clean, k1) {
+		t.Errorf("unknown file skipped")
+	}
+	record(t, ix, clean, &clamav.Result{Code: clamav.Clean}, k1)
+	record(t, ix, bad, &clamav.Result{Code: clamav.Virus}, k1)
+	record(t, ix, gone, &clamav.Result{Code: clamav.Clean}, k1)
+	if err := ix.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	ix, err = Open(ixPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ix.Len() != 3 {
+		t.Fatalf("reopened index has %d entries", ix.Len())
+	}
+	if !skip(t, ix, clean, k1) {
+		t.Errorf("unchanged clean file not skipped")
+	}
+	if skip(t, ix, bad, k1) {
+		t.Errorf("infected file skipped")
+	}
+	if skip(t, ix, clean, k2) {
+		t.Errorf("file skipped under new databases")
+	}
+	other := k1
+	other.Opts |= clamav.ScanAllmatches
+	if skip(t, ix, clean, other) {
+		t.Errorf("file skipped with other scan options")
+	}
+	other = k1
+	other.Key = "profile"
+	if skip(t, ix, clean, other) {
+		t.Errorf("file skipped with other scanner settings")
+	}
+
+	// touching the file changes its metadata but not its content
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(clean, future, future)
+	if !skip(t, ix, clean, k1) {
+		t.Errorf("touched file not skipped")
+	}
+	e, _ := ix.Get(clean)
+	if e.ModTime != future.UnixNano() {
+		t.Errorf("metadata of touched file not updated")
+	}
+
+	ioutil.WriteFile(clean, []byte("changed\n"), 0600)
+	if skip(t, ix, clean, k1) {
+		t.Errorf("modified file skipped")
+	}
+
+	// gone was not visited since the index was opened
+	os.Remove(gone)
+	if n := ix.Prune(tmp); n != 1 {
+		t.Errorf("Prune removed %d entries, want 1", n)
+	}
+	if _, ok := ix.Get(gone); ok {
+		t.Errorf("removed file still indexed")
+	}
+}
+
+func TestIndexIncomplete(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	big := filepath.Join(tmp, "big")
+	ioutil.WriteFile(big, []byte("big\n"), 0600)
+
+	ix, _ := Open(filepath.Join(tmp, "index"))
+	record(t, ix, big, &clamav.Result{Code: clamav.Clean}, k1)
+	record(t, ix, big, &clamav.Result{Code: clamav.Clean, Conditions: clamav.CondMaxSize}, k1)
+	if _, ok := ix.Get(big); ok {
+		t.Errorf("incomplete scan recorded")
+	}
+	if skip(t, ix, big, k1) {
+		t.Errorf("file skipped after an incomplete scan")
+	}
+}
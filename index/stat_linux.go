@@ -0,0 +1,19 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"os"
+	"syscall"
+)
+
+// statKey returns the device, inode and change time of a file.
+func statKey(fi os.FileInfo) (dev, ino uint64, ctime int64) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, 0
+	}
+	return uint64(st.Dev), uint64(st.Ino), int64(st.Ctim.Sec)*1e9 + int64(st.Ctim.Nsec)
+}
@@ -0,0 +1,79 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ScanInfo describes a scan in progress, see InFlight.
+type ScanInfo struct {
+	ID        uint64      `json:"id"`
+	Path      string      `json:"path,omitempty"` // the scanned file, if scanned by path
+	Context   interface{} `json:"-"`              // the context of the scan, as passed to the callbacks
+	Start     time.Time   `json:"start"`
+	FileType  string      `json:"file_type,omitempty"`  // type of the scanned object, once known
+	InnerType string      `json:"inner_type,omitempty"` // type of the file being scanned, e.g. a member of an archive
+	Files     int         `json:"files"`                // number of files scanned so far, the object itself included
+	Aborted   bool        `json:"aborted,omitempty"`    // AbortScan was called
+}
+
+// Elapsed returns how long the scan has been running.
+func (s *ScanInfo) Elapsed() time.Duration {
+	return time.Since(s.Start)
+}
+
+// InFlight returns the scans in progress made with the Engine methods, oldest
+// first. The inner file types are reported by the pre-scan callback of
+// libclamav, called for the scanned object and for every file found in it.
+func InFlight() []ScanInfo {
+	callbacks.Lock()
+	scans := make([]*scanContext, 0, len(callbacks.cb))
+	for _, sc := range callbacks.cb {
+		scans = append(scans, sc)
+	}
+	callbacks.Unlock()
+
+	infos := make([]ScanInfo, len(scans))
+	for i, sc := range scans {
+		sc.mu.Lock()
+		infos[i] = ScanInfo{
+			ID:        sc.id,
+			Path:      sc.path,
+			Context:   sc.value,
+			Start:     sc.start,
+			FileType:  sc.fileType,
+			InnerType: sc.inner,
+			Files:     sc.files,
+			Aborted:   sc.isAborted(),
+		}
+		sc.mu.Unlock()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// AbortScan asks libclamav to give up the scan with the given ID, and
+// reports whether it is still in progress. The pre-cache and pre-scan
+// callbacks return Break from then on, so the scan stops at the next file it
+// finds in the object; libclamav can not be interrupted in the middle of a
+// file. An aborted scan fails with Etimeout.
+func AbortScan(id uint64) bool {
+	callbacks.Lock()
+	defer callbacks.Unlock()
+	for _, sc := range callbacks.cb {
+		if sc.id == id {
+			atomic.StoreInt32(&sc.aborted, 1)
+			return true
+		}
+	}
+	return false
+}
+
+func (sc *scanContext) isAborted() bool {
+	return sc != nil && atomic.LoadInt32(&sc.aborted) != 0
+}
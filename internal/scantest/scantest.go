@@ -0,0 +1,127 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+// Package scantest provides a fake clamav.Scanner for the tests of the
+// packages that scan, so that they run without libclamav and its databases.
+package scantest
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// EICAR is the anti-virus test file, which Scanner reports as infected.
+var EICAR = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+// Virus is the name Scanner reports for EICAR.
+const Virus = "Eicar-Test-Signature"
+
+// started is the build time of the default databases: recent, and the same
+// for every call, as the caches of verdicts key them by it.
+var started = time.Now()
+
+// Scanner reports any object containing EICAR as infected and counts the
+// scans that reach it. It is safe for concurrent use.
+type Scanner struct {
+	DB     clamav.DBInfo  // reported by DBInfo; version 1 built when the tests started if zero
+	Result *clamav.Result // returned with Err by every scan instead of looking for EICAR, if not nil
+	Err    error
+	During func() // called as each scan starts, if not nil
+
+	mu    sync.Mutex
+	scans int
+	last  []byte
+}
+
+// Scans returns the number of scans so far.
+func (s *Scanner) Scans() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scans
+}
+
+// Last returns the content of the last object scanned.
+func (s *Scanner) Last() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+func (s *Scanner) ScanPath(path string, opts uint, context interface{}) (*clamav.Result, error) {
+	if s.Result != nil {
+		return s.scan(nil)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return &clamav.Result{Path: path, Code: clamav.Eopen}, clamav.ErrorCode(clamav.Eopen)
+	}
+	defer f.Close()
+	res, err := s.scan(f)
+	res.Path = path
+	return res, err
+}
+
+// ScanFd reads the file from the start with pread, leaving its offset alone.
+func (s *Scanner) ScanFd(fd int, opts uint, context interface{}) (*clamav.Result, error) {
+	return s.scan(io.NewSectionReader(readerAtFd(fd), 0, 1<<62))
+}
+
+func (s *Scanner) ScanReader(r io.Reader, opts uint, context interface{}) (*clamav.Result, error) {
+	return s.scan(r)
+}
+
+func (s *Scanner) scan(r io.Reader) (*clamav.Result, error) {
+	s.mu.Lock()
+	s.scans++
+	s.mu.Unlock()
+	if s.During != nil {
+		s.During()
+	}
+	if s.Result != nil {
+		return s.Result, s.Err
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return &clamav.Result{Code: clamav.Eread}, clamav.ErrorCode(clamav.Eread)
+	}
+	s.mu.Lock()
+	s.last = b
+	s.mu.Unlock()
+	res := &clamav.Result{Code: clamav.Clean, Scanned: uint64(len(b))}
+	if bytes.Contains(b, EICAR) {
+		res.Code = clamav.Virus
+		res.Virus = Virus
+		res.Matches = []string{res.Virus}
+	}
+	return res, nil
+}
+
+func (s *Scanner) DBInfo() (*clamav.DBInfo, error) {
+	db := s.DB
+	if db == (clamav.DBInfo{}) {
+		db = clamav.DBInfo{Version: 1, Time: started, Signatures: 1}
+	}
+	return &db, nil
+}
+
+// readerAtFd reads a descriptor with pread.
+type readerAtFd int
+
+func (fd readerAtFd) ReadAt(b []byte, off int64) (int, error) {
+	n, err := syscall.Pread(int(fd), b, off)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 && len(b) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
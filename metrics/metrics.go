@@ -0,0 +1,253 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+// Package metrics collects statistics about ClamAV scans and exposes them in
+// the Prometheus text exposition format.
+//
+// A Collector is fed by wrapping a scanner with Instrument, or by calling
+// Observe with each Result. It is an http.Handler that can be mounted on a
+// service's /metrics path:
+//
+//	c := metrics.New(scanner)
+//	scanner = c.Instrument(scanner)
+//	http.Handle("/metrics", c)
+//
+// The following metrics are exported:
+//
+//	clamav_scans_total{verdict}              scans by verdict: clean, infected or error
+//	clamav_scans_by_filetype_total{filetype} scans by the file type detected by libclamav
+//	clamav_scanned_bytes_total               bytes scanned
+//	clamav_cache_hits_total                  verdicts served from a cache
+//	clamav_scan_duration_seconds             histogram of scan latency
+//	clamav_limits_exceeded_total{limit}      scans cut short by a limit, e.g. maxsize, see clamav.Condition
+//	clamav_callback_errors_total             callbacks that panicked
+//	clamav_engine_reloads_total{result}      database reloads, by success or failure
+//	clamav_signatures                        signatures loaded
+//	clamav_db_version                        version of the loaded databases
+//	clamav_db_timestamp_seconds              build time of the loaded databases
+//	clamav_db_age_seconds                    age of the loaded databases
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the scan latency
+// histogram.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// Collector accumulates scan statistics. It is safe for concurrent use.
+type Collector struct {
+	db func() (*clamav.DBInfo, error)
+
+	mu        sync.Mutex
+	verdicts  map[string]uint64
+	fileTypes map[string]uint64
+	limits    map[string]uint64
+	reloads   map[string]uint64
+	bytes     uint64
+	cacheHits uint64
+	buckets   []float64
+	counts    []uint64 // per bucket, not cumulative
+	sum       float64
+	count     uint64
+}
+
+// New returns a Collector that reports the databases loaded by s. s may be
+// nil if database metrics are not wanted.
+func New(s clamav.Scanner) *Collector {
+	c := &Collector{
+		verdicts:  map[string]uint64{},
+		fileTypes: map[string]uint64{},
+		limits:    map[string]uint64{},
+		reloads:   map[string]uint64{},
+		buckets:   DefaultBuckets,
+		counts:    make([]uint64, len(DefaultBuckets)+1),
+	}
+	if s != nil {
+		c.db = s.DBInfo
+	}
+	return c
+}
+
+// Observe records the outcome of a scan.
+func (c *Collector) Observe(res *clamav.Result, err error) {
+	verdict := "clean"
+	switch {
+	case err != nil || res == nil:
+		verdict = "error"
+	case res.Infected():
+		verdict = "infected"
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.verdicts[verdict]++
+	if res == nil {
+		return
+	}
+	if res.FileType != "" {
+		c.fileTypes[res.FileType]++
+	}
+	for _, name := range (res.Conditions & clamav.CondLimits).Names() {
+		c.limits[name]++
+	}
+	c.bytes += res.Scanned
+	if res.Cached {
+		c.cacheHits++
+	}
+
+	secs := res.Duration.Seconds()
+	i := sort.SearchFloat64s(c.buckets, secs)
+	c.counts[i]++
+	c.sum += secs
+	c.count++
+}
+
+// ObserveReload records a database reload. It can be used directly as the
+// OnReload hook of a clamav.Reloader.
+func (c *Collector) ObserveReload(db *clamav.DBInfo, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.reloads["failure"]++
+	} else {
+		c.reloads["success"]++
+	}
+}
+
+// Instrument returns a Scanner that records every scan made through s.
+func (c *Collector) Instrument(s clamav.Scanner) clamav.Scanner {
+	return &instrumented{s, c}
+}
+
+type instrumented struct {
+	clamav.Scanner
+	c *Collector
+}
+
+// ScanKey returns the key of the instrumented scanner, see clamav.Keyer.
+func (i *instrumented) ScanKey(context interface{}) (string, error) {
+	return clamav.ScanKey(i.Scanner, context)
+}
+
+func (i *instrumented) ScanPath(path string, opts uint, context interface{}) (*clamav.Result, error) {
+	res, err := i.Scanner.ScanPath(path, opts, context)
+	i.c.Observe(res, err)
+	return res, err
+}
+
+func (i *instrumented) ScanFd(fd int, opts uint, context interface{}) (*clamav.Result, error) {
+	res, err := i.Scanner.ScanFd(fd, opts, context)
+	i.c.Observe(res, err)
+	return res, err
+}
+
+func (i *instrumented) ScanReader(r io.Reader, opts uint, context interface{}) (*clamav.Result, error) {
+	res, err := i.Scanner.ScanReader(r, opts, context)
+	i.c.Observe(res, err)
+	return res, err
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.WriteTo(w)
+}
+
+// WriteTo writes the metrics to w in the Prometheus text format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: bufio.NewWriter(w)}
+
+	c.mu.Lock()
+	cw.counterVec("clamav_scans_total", "Scans by verdict.", "verdict", c.verdicts)
+	cw.counterVec("clamav_scans_by_filetype_total", "Scans by the file type detected by libclamav.", "filetype", c.fileTypes)
+	cw.header("clamav_scanned_bytes_total", "Bytes scanned.", "counter")
+	cw.printf("clamav_scanned_bytes_total %d\n", c.bytes)
+	cw.header("clamav_cache_hits_total", "Verdicts served from a cache.", "counter")
+	cw.printf("clamav_cache_hits_total %d\n", c.cacheHits)
+
+	cw.header("clamav_scan_duration_seconds", "Scan latency.", "histogram")
+	cum := uint64(0)
+	for i, b := range c.buckets {
+		cum += c.counts[i]
+		cw.printf("clamav_scan_duration_seconds_bucket{le=\"%g\"} %d\n", b, cum)
+	}
+	cw.printf("clamav_scan_duration_seconds_bucket{le=\"+Inf\"} %d\n", c.count)
+	cw.printf("clamav_scan_duration_seconds_sum %g\n", c.sum)
+	cw.printf("clamav_scan_duration_seconds_count %d\n", c.count)
+
+	cw.counterVec("clamav_limits_exceeded_total", "Scans cut short by a scan limit.", "limit", c.limits)
+	cw.counterVec("clamav_engine_reloads_total", "Database reloads.", "result", c.reloads)
+	c.mu.Unlock()
+
+	cw.header("clamav_callback_errors_total", "Callbacks that panicked.", "counter")
+	cw.printf("clamav_callback_errors_total %d\n", clamav.CallbackErrors())
+
+	if c.db != nil {
+		if db, err := c.db(); err == nil {
+			cw.gauge("clamav_signatures", "Signatures loaded.", float64(db.Signatures))
+			cw.gauge("clamav_db_version", "Version of the loaded databases.", float64(db.Version))
+			cw.gauge("clamav_db_timestamp_seconds", "Build time of the loaded databases.", float64(db.Time.Unix()))
+			cw.gauge("clamav_db_age_seconds", "Age of the loaded databases.", db.Age().Truncate(time.Second).Seconds())
+		}
+	}
+
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// countWriter formats the exposition, keeping the first error.
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) printf(format string, args ...interface{}) {
+	if cw.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(cw.w, format, args...)
+	cw.n += int64(n)
+	cw.err = err
+}
+
+func (cw *countWriter) header(name, help, typ string) {
+	cw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (cw *countWriter) gauge(name, help string, v float64) {
+	cw.header(name, help, "gauge")
+	cw.printf("%s %g\n", name, v)
+}
+
+func (cw *countWriter) counterVec(name, help, label string, m map[string]uint64) {
+	cw.header(name, help, "counter")
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		cw.printf("%s{%s=\"%s\"} %d\n", name, label, escape(k), m[k])
+	}
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
@@ -0,0 +1,59 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+	"github.com/mirtchovski/clamav/internal/scantest"
+)
+
+func TestCollector(t *testing.T) {
+	fs := &scantest.Scanner{DB: clamav.DBInfo{Version: 27000, Time: time.Unix(1500000000, 0), Signatures: 6000000}}
+	c := New(fs)
+	s := c.Instrument(fs)
+
+	fs.Result = &clamav.Result{Code: clamav.Clean, FileType: "CL_TYPE_ZIP", Scanned: 4096, Duration: 3 * time.Millisecond}
+	s.ScanPath("a", 0, nil)
+	// a clean scan that skipped a file over max_filesize
+	fs.Result = &clamav.Result{Code: clamav.Clean, FileType: "CL_TYPE_ZIP", Scanned: 4096, Duration: 3 * time.Millisecond, Conditions: clamav.CondMaxSize | clamav.CondEncryptedArchive}
+	s.ScanPath("b", 0, nil)
+	fs.Result = &clamav.Result{Code: clamav.Virus, FileType: "CL_TYPE_MSEXE", Scanned: 8192, Duration: 2 * time.Second}
+	s.ScanFd(0, 0, nil)
+	fs.Result = &clamav.Result{Code: clamav.Emaxfiles, Duration: time.Minute, Conditions: clamav.CondMaxFiles}
+	fs.Err = clamav.ErrorCode(clamav.Emaxfiles)
+	s.ScanReader(nil, 0, nil)
+	c.ObserveReload(nil, nil)
+
+	var b bytes.Buffer
+	if _, err := c.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	for _, want := range []string{
+		`clamav_scans_total{verdict="clean"} 2`,
+		`clamav_scans_total{verdict="error"} 1`,
+		`clamav_scans_total{verdict="infected"} 1`,
+		`clamav_scans_by_filetype_total{filetype="CL_TYPE_ZIP"} 2`,
+		`clamav_scanned_bytes_total 16384`,
+		`clamav_scan_duration_seconds_bucket{le="0.005"} 2`,
+		`clamav_scan_duration_seconds_bucket{le="2.5"} 3`,
+		`clamav_scan_duration_seconds_bucket{le="+Inf"} 4`,
+		`clamav_scan_duration_seconds_count 4`,
+		`clamav_limits_exceeded_total{limit="maxsize"} 1`,
+		`clamav_limits_exceeded_total{limit="maxfiles"} 1`,
+		`clamav_engine_reloads_total{result="success"} 1`,
+		`clamav_signatures 6e+06`,
+		`clamav_db_version 27000`,
+		`clamav_db_timestamp_seconds 1.5e+09`,
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("missing %q in\n%s", want, b.String())
+		}
+	}
+}
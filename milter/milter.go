@@ -0,0 +1,412 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+// Package milter implements a Sendmail/Postfix mail filter (milter protocol
+// version 6) that scans every message with a ClamAV scanner.
+//
+// Each message is spooled, together with an mbox "From " line built from the
+// envelope sender and its headers, and scanned as a single object with
+// ScanMail so that libclamav decodes the MIME structure and attachments
+// itself. What happens to infected messages and to messages that could not
+// be scanned is configurable.
+package milter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// Action is what the filter tells the MTA to do with a message.
+type Action int
+
+// Actions
+const (
+	Accept     Action = iota // deliver the message
+	Reject                   // reject it with a permanent error
+	Tempfail                 // reject it with a temporary error
+	Discard                  // accept and silently drop it
+	Quarantine               // accept and hold it in the MTA's quarantine; reject it if the MTA can not
+)
+
+var actionNames = []string{"accept", "reject", "tempfail", "discard", "quarantine"}
+
+func (a Action) String() string {
+	if int(a) < len(actionNames) {
+		return actionNames[a]
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+// ParseAction returns the Action with the given name.
+func ParseAction(name string) (Action, error) {
+	for i, n := range actionNames {
+		if strings.EqualFold(n, name) {
+			return Action(i), nil
+		}
+	}
+	return Accept, fmt.Errorf("milter: unknown action %q", name)
+}
+
+// DefaultOptions are the scan options used when Server.Options is zero.
+const DefaultOptions = clamav.ScanStdopt | clamav.ScanMail | clamav.ScanAllmatches
+
+// Server is a milter that scans messages for viruses. The zero actions accept
+// every message; NewServer returns a Server with the usual policy.
+type Server struct {
+	Scanner clamav.Scanner
+
+	Options     uint        // scan options, DefaultOptions if zero; ScanMail is always added
+	OnInfected  Action      // action for infected messages
+	OnError     Action      // action for messages that could not be scanned
+	AddHeaders  bool        // add X-Virus-Scanned and X-Virus-Status to accepted messages, if the MTA allows
+	Hostname    string      // host name reported in X-Virus-Scanned, os.Hostname() if empty
+	MemoryLimit int64       // messages above this size are spooled to TempDir, clamav.DefaultSpoolLimit if zero
+	TempDir     string      // directory for spooled messages, the system default if empty
+	ErrorLog    *log.Logger // logger for errors and verdicts, the log package's default if nil
+}
+
+// NewServer returns a Server scanning with s that rejects infected messages,
+// temporarily fails messages it could not scan and adds the X-Virus headers to
+// the others.
+func NewServer(s clamav.Scanner) *Server {
+	return &Server{
+		Scanner:    s,
+		OnInfected: Reject,
+		OnError:    Tempfail,
+		AddHeaders: true,
+	}
+}
+
+// ListenAndServe listens on the given network ("tcp" or "unix") and address
+// and serves milter connections from the MTA.
+func (s *Server) ListenAndServe(network, addr string) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and handles each in its own goroutine.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveConn(c)
+	}
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// Commands sent by the MTA
+const (
+	cmdAbort   = 'A'
+	cmdBody    = 'B'
+	cmdConnect = 'C'
+	cmdMacro   = 'D'
+	cmdEOB     = 'E'
+	cmdHelo    = 'H'
+	cmdQuitNC  = 'K'
+	cmdHeader  = 'L'
+	cmdMail    = 'M'
+	cmdEOH     = 'N'
+	cmdOptneg  = 'O'
+	cmdQuit    = 'Q'
+	cmdRcpt    = 'R'
+	cmdData    = 'T'
+	cmdUnknown = 'U'
+)
+
+// Replies sent to the MTA
+const (
+	replyAccept     = 'a'
+	replyContinue   = 'c'
+	replyDiscard    = 'd'
+	replyAddHeader  = 'h'
+	replyOptneg     = 'O'
+	replyQuarantine = 'q'
+	replyTempfail   = 't'
+	replyReplyCode  = 'y'
+)
+
+// Negotiated actions and protocol steps
+const (
+	version = 6
+
+	actAddHeaders = 0x01
+	actQuarantine = 0x20
+
+	protoNoConnect = 0x01
+	protoNoHelo    = 0x02
+	protoNoRcpt    = 0x08
+	protoNoUnknown = 0x100
+	protoNoData    = 0x200
+)
+
+// maxPacket bounds the size of a single milter packet.
+const maxPacket = 1 << 20
+
+// conn holds the state of one MTA connection and of the message in progress.
+type conn struct {
+	s      *Server
+	c      net.Conn
+	r      *bufio.Reader
+	queue  string // the MTA's queue id, from the "i" macro
+	sender string
+	msg    *clamav.Spool
+
+	actions uint32 // the actions the MTA allows, from the option negotiation
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	mc := &conn{s: s, c: c, r: bufio.NewReader(c)}
+	defer c.Close()
+	defer mc.reset()
+	for {
+		cmd, data, err := mc.read()
+		if err != nil {
+			if err != io.EOF {
+				s.logf("milter: %v: %v", c.RemoteAddr(), err)
+			}
+			return
+		}
+		if err := mc.handle(cmd, data); err != nil {
+			if err != io.EOF {
+				s.logf("milter: %v: %v", c.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+func (mc *conn) read() (byte, []byte, error) {
+	var n uint32
+	if err := binary.Read(mc.r, binary.BigEndian, &n); err != nil {
+		return 0, nil, err
+	}
+	if n == 0 || n > maxPacket {
+		return 0, nil, fmt.Errorf("bad packet length %d", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(mc.r, buf); err != nil {
+		return 0, nil, err
+	}
+	return buf[0], buf[1:], nil
+}
+
+func (mc *conn) write(cmd byte, data []byte) error {
+	buf := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)+1))
+	buf[4] = cmd
+	copy(buf[5:], data)
+	_, err := mc.c.Write(buf)
+	return err
+}
+
+// reset discards the message in progress.
+func (mc *conn) reset() {
+	if mc.msg != nil {
+		mc.msg.Close()
+		mc.msg = nil
+	}
+	mc.sender = ""
+}
+
+func (mc *conn) handle(cmd byte, data []byte) error {
+	switch cmd {
+	case cmdOptneg:
+		return mc.negotiate(data)
+	case cmdMacro:
+		if len(data) > 0 {
+			macros := splitNul(data[1:])
+			for i := 0; i+1 < len(macros); i += 2 {
+				if macros[i] == "i" || macros[i] == "{i}" {
+					mc.queue = macros[i+1]
+				}
+			}
+		}
+		return nil
+	case cmdMail:
+		mc.reset()
+		if args := splitNul(data); len(args) > 0 {
+			mc.sender = strings.Trim(args[0], "<>")
+		}
+	case cmdHeader:
+		f := splitNul(data)
+		if len(f) < 2 {
+			return errors.New("malformed header")
+		}
+		fmt.Fprintf(mc.message(), "%s: %s\r\n", f[0], f[1])
+	case cmdEOH:
+		io.WriteString(mc.message(), "\r\n")
+	case cmdBody:
+		if _, err := mc.message().Write(data); err != nil {
+			return err
+		}
+	case cmdEOB:
+		if len(data) > 0 {
+			mc.message().Write(data)
+		}
+		err := mc.endOfMessage()
+		mc.reset()
+		return err
+	case cmdAbort:
+		mc.reset()
+		return nil
+	case cmdQuitNC:
+		mc.reset()
+		mc.queue = ""
+		return nil
+	case cmdQuit:
+		return io.EOF
+	case cmdConnect, cmdHelo, cmdRcpt, cmdData, cmdUnknown:
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	return mc.write(replyContinue, nil)
+}
+
+// message returns the spool for the message in progress, starting it with an
+// mbox separator line.
+func (mc *conn) message() *clamav.Spool {
+	if mc.msg == nil {
+		limit := mc.s.MemoryLimit
+		if limit <= 0 {
+			limit = clamav.DefaultSpoolLimit
+		}
+		mc.msg = clamav.NewSpoolWriter(limit, mc.s.TempDir)
+		sender := mc.sender
+		if sender == "" {
+			sender = "MAILER-DAEMON"
+		}
+		fmt.Fprintf(mc.msg, "From %s %s\r\n", sender, time.Now().Format(time.ANSIC))
+	}
+	return mc.msg
+}
+
+func (mc *conn) negotiate(data []byte) error {
+	if len(data) < 12 {
+		return errors.New("short option negotiation")
+	}
+	ver := binary.BigEndian.Uint32(data)
+	actions := binary.BigEndian.Uint32(data[4:])
+	proto := binary.BigEndian.Uint32(data[8:])
+	if ver > version {
+		ver = version
+	}
+
+	mc.actions = actions & (actAddHeaders | actQuarantine)
+
+	reply := make([]byte, 12)
+	binary.BigEndian.PutUint32(reply, ver)
+	binary.BigEndian.PutUint32(reply[4:], mc.actions)
+	binary.BigEndian.PutUint32(reply[8:], proto&(protoNoConnect|protoNoHelo|protoNoRcpt|protoNoUnknown|protoNoData))
+	return mc.write(replyOptneg, reply)
+}
+
+func (mc *conn) endOfMessage() error {
+	s := mc.s
+	opts := s.Options
+	if opts == 0 {
+		opts = DefaultOptions
+	}
+	id := mc.queue
+	if id == "" {
+		id = "NOQUEUE"
+	}
+
+	res, err := s.Scanner.ScanReader(mc.message(), opts|clamav.ScanMail, clamav.WithAttrs(id, slog.String("queue_id", id)))
+	action, status := Accept, "Clean"
+	switch {
+	case err != nil:
+		s.logf("milter: %s: error scanning message from <%s>: %v", id, mc.sender, err)
+		action, status = s.OnError, "Error"
+	case res.Infected():
+		s.logf("milter: %s: message from <%s> infected: %s", id, mc.sender, strings.Join(res.Matches, ", "))
+		action, status = s.OnInfected, fmt.Sprintf("Infected (%s)", res.Virus)
+	}
+	if action == Quarantine && mc.actions&actQuarantine == 0 {
+		s.logf("milter: %s: the MTA can not quarantine, rejecting the message", id)
+		action = Reject
+	}
+
+	switch action {
+	case Reject:
+		msg := "550 5.7.1 Message could not be scanned"
+		if err == nil {
+			msg = fmt.Sprintf("550 5.7.1 Virus found: %s", res.Virus)
+		}
+		return mc.write(replyReplyCode, nulTerminated(msg))
+	case Tempfail:
+		return mc.write(replyTempfail, nil)
+	case Discard:
+		return mc.write(replyDiscard, nil)
+	case Quarantine:
+		if err := mc.write(replyQuarantine, nulTerminated(status)); err != nil {
+			return err
+		}
+	}
+	if s.AddHeaders && mc.actions&actAddHeaders != 0 {
+		if err := mc.addHeader("X-Virus-Scanned", "ClamAV "+clamav.Retver()+" at "+s.hostname()); err != nil {
+			return err
+		}
+		if err := mc.addHeader("X-Virus-Status", status); err != nil {
+			return err
+		}
+	}
+	return mc.write(replyAccept, nil)
+}
+
+func (mc *conn) addHeader(name, value string) error {
+	return mc.write(replyAddHeader, append(nulTerminated(name), nulTerminated(value)...))
+}
+
+func (s *Server) hostname() string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+	h, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return h
+}
+
+func nulTerminated(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// splitNul splits a sequence of NUL-terminated strings.
+func splitNul(b []byte) []string {
+	b = bytes.TrimSuffix(b, []byte{0})
+	if len(b) == 0 {
+		return nil
+	}
+	return strings.Split(string(b), "\x00")
+}
@@ -0,0 +1,152 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package milter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/mirtchovski/clamav/internal/scantest"
+)
+
+type mta struct {
+	t       *testing.T
+	c       net.Conn
+	r       *bufio.Reader
+	actions uint32 // offered in the option negotiation
+}
+
+func newMTA(t *testing.T, s *Server) *mta {
+	c1, c2 := net.Pipe()
+	go s.serveConn(c2)
+	t.Cleanup(func() { c1.Close() })
+	return &mta{t, c1, bufio.NewReader(c1), 0x1ff}
+}
+
+func (m *mta) send(cmd byte, data ...string) {
+	var b []byte
+	for _, d := range data {
+		b = append(b, d...)
+		b = append(b, 0)
+	}
+	if cmd == cmdBody {
+		b = b[:len(b)-1]
+	}
+	hdr := make([]byte, 5)
+	binary.BigEndian.PutUint32(hdr, uint32(len(b)+1))
+	hdr[4] = cmd
+	if _, err := m.c.Write(append(hdr, b...)); err != nil {
+		m.t.Fatalf("write: %v", err)
+	}
+}
+
+func (m *mta) recv() (byte, []byte) {
+	var n uint32
+	if err := binary.Read(m.r, binary.BigEndian, &n); err != nil {
+		m.t.Fatalf("read: %v", err)
+	}
+	buf := make([]byte, n)
+	io.ReadFull(m.r, buf)
+	return buf[0], buf[1:]
+}
+
+func (m *mta) expect(want byte) []byte {
+	cmd, data := m.recv()
+	if cmd != want {
+		m.t.Fatalf("reply %q (%q), want %q", cmd, data, want)
+	}
+	return data
+}
+
+// deliver sends a complete message and returns the replies to end of body.
+func (m *mta) deliver(body []byte) {
+	opt := make([]byte, 12)
+	binary.BigEndian.PutUint32(opt, 6)
+	binary.BigEndian.PutUint32(opt[4:], m.actions)
+	binary.BigEndian.PutUint32(opt[8:], 0x1fffff)
+	hdr := make([]byte, 5)
+	binary.BigEndian.PutUint32(hdr, 13)
+	hdr[4] = cmdOptneg
+	m.c.Write(append(hdr, opt...))
+	m.expect(replyOptneg)
+
+	m.send(cmdMail, "<sender@example.com>")
+	m.expect(replyContinue)
+	m.send(cmdHeader, "Subject", "test")
+	m.expect(replyContinue)
+	m.send(cmdEOH)
+	m.expect(replyContinue)
+	m.send(cmdBody, string(body))
+	m.expect(replyContinue)
+	m.send(cmdEOB)
+}
+
+func TestClean(t *testing.T) {
+	fs := &scantest.Scanner{}
+	m := newMTA(t, NewServer(fs))
+	m.deliver([]byte("hello\r\n"))
+
+	h := m.expect(replyAddHeader)
+	if !bytes.HasPrefix(h, []byte("X-Virus-Scanned\x00")) {
+		t.Errorf("first header %q", h)
+	}
+	h = m.expect(replyAddHeader)
+	if string(h) != "X-Virus-Status\x00Clean\x00" {
+		t.Errorf("second header %q", h)
+	}
+	m.expect(replyAccept)
+
+	if !bytes.HasPrefix(fs.Last(), []byte("From sender@example.com ")) || !bytes.HasSuffix(fs.Last(), []byte("Subject: test\r\n\r\nhello\r\n")) {
+		t.Errorf("scanned message %q", fs.Last())
+	}
+}
+
+func TestInfected(t *testing.T) {
+	for _, tt := range []struct {
+		action Action
+		reply  byte
+	}{
+		{Reject, replyReplyCode},
+		{Tempfail, replyTempfail},
+		{Discard, replyDiscard},
+		{Quarantine, replyQuarantine},
+	} {
+		s := NewServer(&scantest.Scanner{})
+		s.OnInfected = tt.action
+		m := newMTA(t, s)
+		m.deliver(scantest.EICAR)
+		data := m.expect(tt.reply)
+		if tt.action == Reject && !bytes.Contains(data, []byte("Eicar-Test-Signature")) {
+			t.Errorf("reject reply %q", data)
+		}
+		if tt.action == Quarantine {
+			m.expect(replyAddHeader)
+			h := m.expect(replyAddHeader)
+			if string(h) != "X-Virus-Status\x00Infected (Eicar-Test-Signature)\x00" {
+				t.Errorf("status header %q", h)
+			}
+			m.expect(replyAccept)
+		}
+	}
+}
+
+func TestNegotiatedActions(t *testing.T) {
+	// an MTA allowing neither headers nor quarantine
+	m := newMTA(t, NewServer(&scantest.Scanner{}))
+	m.actions = 0
+	m.deliver([]byte("hello\r\n"))
+	m.expect(replyAccept)
+
+	s := NewServer(&scantest.Scanner{})
+	s.OnInfected = Quarantine
+	m = newMTA(t, s)
+	m.actions = actAddHeaders
+	m.deliver(scantest.EICAR)
+	m.expect(replyReplyCode)
+}
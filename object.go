@@ -0,0 +1,283 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Object is a node of the tree of the objects libclamav visited in a scan,
+// see WithTree: the scanned file at the root, the files found in it, such as
+// the members of an archive or the attachments of a message, below.
+//
+// libclamav does not tell the names of the members to the callbacks, so only
+// the root has a Name, when scanned by path.
+type Object struct {
+	Depth    int       `json:"depth"`
+	Type     string    `json:"type,omitempty"` // e.g. CL_TYPE_ZIP, from the pre-scan callback
+	Name     string    `json:"name,omitempty"` // member name where known
+	Size     int64     `json:"size"`           // -1 if unknown
+	MD5      string    `json:"md5,omitempty"`
+	Code     ErrorCode `json:"code"`             // verdict of the object, its children included
+	Virus    string    `json:"virus,omitempty"`  // name reported for the object, not for its children
+	Cached   bool      `json:"cached,omitempty"` // found clean in the cache of libclamav and not scanned
+	Children []*Object `json:"children,omitempty"`
+
+	Extracted string `json:"extracted,omitempty"` // the copy of the object made by an Extractor
+
+	tempPath string // the temporary file of libclamav the object was scanned from, see Extractor
+}
+
+// WithTree returns a scan context asking for the tree of the objects visited
+// by the scan in Result.Tree. The objects are read once more to compute
+// their MD5, where libclamav does not report it.
+func WithTree(context interface{}) interface{} {
+	ac := wrapContext(context)
+	ac.tree = true
+	return ac
+}
+
+// WantsTree reports whether context asks for the tree of the scan, see
+// WithTree. Scanners returning verdicts without scanning, such as caches,
+// pass such scans on.
+func WantsTree(context interface{}) bool {
+	ac, ok := context.(*attrContext)
+	return ok && ac.tree
+}
+
+// Walk calls fn for o and every object below it, parents first.
+func (o *Object) Walk(fn func(*Object)) {
+	fn(o)
+	for _, c := range o.Children {
+		c.Walk(fn)
+	}
+}
+
+// Detections returns, for every object reported infected none of whose
+// children were, the chain of objects from the root down to it: which file
+// in which archive in which message matched.
+func (o *Object) Detections() [][]*Object {
+	var chains [][]*Object
+	var walk func(o *Object, chain []*Object)
+	walk = func(o *Object, chain []*Object) {
+		chain = append(chain[:len(chain):len(chain)], o)
+		found := false
+		for _, c := range o.Children {
+			if c.hasVirus() {
+				walk(c, chain)
+				found = true
+			}
+		}
+		if !found && o.Virus != "" {
+			chains = append(chains, chain)
+		}
+	}
+	if o.hasVirus() {
+		walk(o, nil)
+	}
+	return chains
+}
+
+func (o *Object) hasVirus() bool {
+	if o.Virus != "" {
+		return true
+	}
+	for _, c := range o.Children {
+		if c.hasVirus() {
+			return true
+		}
+	}
+	return false
+}
+
+// String describes the object, e.g. "report.zip (CL_TYPE_ZIP, 2048 bytes)".
+func (o *Object) String() string {
+	s := o.Name
+	if s == "" {
+		s = fmt.Sprintf("object at depth %d", o.Depth)
+	}
+	s += " (" + o.Type
+	if o.Size >= 0 {
+		s += fmt.Sprintf(", %d bytes", o.Size)
+	}
+	s += ")"
+	if o.Virus != "" {
+		s += ": " + o.Virus
+	}
+	return s
+}
+
+// ChainString joins a chain returned by Detections with " > ".
+func ChainString(chain []*Object) string {
+	s := make([]string, len(chain))
+	for i, o := range chain {
+		s[i] = o.String()
+	}
+	return strings.Join(s, " > ")
+}
+
+// treeBuilder follows the callbacks of a scan to build its tree. The
+// pre-cache callback announces an object, the pre-scan callback starts
+// scanning it and the post-scan callback ends it; objects found in the cache
+// of libclamav get no other callback. The hash callback tells the MD5 of the
+// detected objects.
+type treeBuilder struct {
+	root    *Object
+	stack   []*Object // the objects being scanned, innermost last
+	pending *Object   // announced by the pre-cache callback
+	tmpdir  string    // the temporary directory of an Extractor
+}
+
+// precache records a new object below the one being scanned.
+func (t *treeBuilder) precache(fd int, ftype string) {
+	t.settle()
+	o := &Object{Depth: len(t.stack), Type: ftype, Size: fdSize(fd), Code: Clean}
+	if n := len(t.stack); n > 0 {
+		t.stack[n-1].Children = append(t.stack[n-1].Children, o)
+	} else if t.root == nil {
+		t.root = o
+	} else {
+		return
+	}
+	t.pending = o
+}
+
+// settle marks an object announced but never scanned as cached.
+func (t *treeBuilder) settle() {
+	if t.pending != nil {
+		t.pending.Cached = true
+		t.pending = nil
+	}
+}
+
+// objectFile is what is read from the file of an object as it is scanned,
+// the hashing of which is left out of the lock of the scan.
+type objectFile struct {
+	md5  string
+	temp string // see tempPath
+}
+
+// file reads the file open on fd for prescan. It uses only the fields set
+// when the builder is made, so it can be called without the lock.
+func (t *treeBuilder) file(fd int) objectFile {
+	f := objectFile{md5: fdMD5(fd)}
+	if t.tmpdir != "" {
+		f.temp = tempPath(fd, t.tmpdir)
+	}
+	return f
+}
+
+// prescan starts scanning the announced object, whose type is now known.
+func (t *treeBuilder) prescan(fd int, ftype string, f objectFile) {
+	o := t.pending
+	t.pending = nil
+	if o == nil {
+		o = &Object{Size: fdSize(fd), Code: Clean}
+		if n := len(t.stack); n > 0 {
+			o.Depth = n
+			t.stack[n-1].Children = append(t.stack[n-1].Children, o)
+		} else if t.root == nil {
+			t.root = o
+		}
+	}
+	o.Type = ftype
+	if o.MD5 == "" {
+		o.MD5 = f.md5
+	}
+	o.tempPath = f.temp
+	t.stack = append(t.stack, o)
+}
+
+// postscan ends the innermost object with its verdict.
+func (t *treeBuilder) postscan(code ErrorCode, virname string) {
+	t.settle()
+	n := len(t.stack)
+	if n == 0 {
+		return
+	}
+	o := t.stack[n-1]
+	t.stack = t.stack[:n-1]
+	o.Code = code
+	if virname != "" && !o.hasVirus() {
+		// a container reports the name found in its children
+		o.Virus = virname
+	}
+}
+
+// hash records the MD5 of the innermost object, reported when it is detected.
+func (t *treeBuilder) hash(size uint64, md5 []byte, virname string) {
+	n := len(t.stack)
+	if n == 0 {
+		return
+	}
+	o := t.stack[n-1]
+	o.MD5 = hex.EncodeToString(md5)
+	o.Size = int64(size)
+	if virname != "" {
+		o.Virus = virname
+	}
+}
+
+// finish returns the tree once the scan is over.
+func (t *treeBuilder) finish(path string, code ErrorCode, virname string) *Object {
+	t.settle()
+	if t.root == nil {
+		return nil
+	}
+	t.root.Name = path
+	if code == Virus && !t.root.hasVirus() {
+		t.root.Virus = virname
+		t.root.Code = code
+	}
+	return t.root
+}
+
+// tempPath returns the path of the file open on fd if it is in dir, or an
+// empty string.
+func tempPath(fd int, dir string) string {
+	if fd < 0 {
+		return ""
+	}
+	path, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+	if err != nil || !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return ""
+	}
+	return path
+}
+
+// fdMD5 returns the MD5 of the file open on fd, read with pread so that the
+// offset libclamav works with is left alone, or an empty string if it can
+// not be read.
+func fdMD5(fd int) string {
+	if fd < 0 {
+		return ""
+	}
+	h := md5.New()
+	if _, err := io.Copy(h, io.NewSectionReader(readerAtFd(fd), 0, 1<<62)); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readerAtFd reads a descriptor with pread.
+type readerAtFd int
+
+func (fd readerAtFd) ReadAt(b []byte, off int64) (int, error) {
+	n, err := syscall.Pread(int(fd), b, off)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 && len(b) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
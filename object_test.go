@@ -0,0 +1,65 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTreeBuilder(t *testing.T) {
+	f, err := ioutil.TempFile("", "clamav-tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.WriteString("hello\n")
+	fd := int(f.Fd())
+
+	// a message with a clean text part and a zip holding an infected
+	// executable, the callbacks as libclamav makes them
+	var tb treeBuilder
+	tb.precache(fd, "CL_TYPE_MAIL")
+	tb.prescan(fd, "CL_TYPE_MAIL", tb.file(fd))
+	tb.precache(-1, "CL_TYPE_TEXT_ASCII")
+	tb.precache(-1, "CL_TYPE_ZIP") // the text part was in the cache
+	tb.prescan(-1, "CL_TYPE_ZIP", objectFile{})
+	tb.precache(-1, "CL_TYPE_MSEXE")
+	tb.prescan(-1, "CL_TYPE_MSEXE", objectFile{})
+	tb.hash(68, make([]byte, 16), "Win.Test.EICAR_HDB-1")
+	tb.postscan(Virus, "Win.Test.EICAR_HDB-1")
+	tb.postscan(Virus, "Win.Test.EICAR_HDB-1")
+	tb.postscan(Virus, "Win.Test.EICAR_HDB-1")
+	root := tb.finish("mail.eml", Virus, "Win.Test.EICAR_HDB-1")
+
+	if root == nil || root.Name != "mail.eml" || root.Size != 6 || root.MD5 != "b1946ac92492d2347c6235b4d2611184" {
+		t.Fatalf("root: %+v", root)
+	}
+	if len(root.Children) != 2 || !root.Children[0].Cached || root.Children[1].Type != "CL_TYPE_ZIP" {
+		t.Fatalf("children: %+v", root.Children)
+	}
+	exe := root.Children[1].Children[0]
+	if exe.Depth != 2 || exe.Size != 68 || exe.MD5 != "00000000000000000000000000000000" {
+		t.Errorf("exe: %+v", exe)
+	}
+	n := 0
+	root.Walk(func(*Object) { n++ })
+	if n != 4 {
+		t.Errorf("Walk: %d objects, want 4", n)
+	}
+
+	chains := root.Detections()
+	if len(chains) != 1 {
+		t.Fatalf("Detections: %d chains, want 1", len(chains))
+	}
+	want := "mail.eml (CL_TYPE_MAIL, 6 bytes) > " +
+		"object at depth 1 (CL_TYPE_ZIP) > " +
+		"object at depth 2 (CL_TYPE_MSEXE, 68 bytes): Win.Test.EICAR_HDB-1"
+	if got := ChainString(chains[0]); got != want {
+		t.Errorf("ChainString:\ngot  %s\nwant %s", got, want)
+	}
+}
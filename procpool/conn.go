@@ -0,0 +1,175 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package procpool
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// request is sent by the pool to a worker
+type request struct {
+	Op   string `json:"op"`             // opScan or opReload
+	Path string `json:"path,omitempty"` // scanned by path when no descriptor comes along
+	Opts uint   `json:"opts,omitempty"`
+}
+
+const (
+	opScan   = "scan"
+	opReload = "reload"
+)
+
+// response is sent by a worker when it is ready and after every request
+type response struct {
+	Result *clamav.Result   `json:"result,omitempty"`
+	DB     *clamav.DBInfo   `json:"db,omitempty"`
+	Key    string           `json:"key,omitempty"`  // of the engine settings, see clamav.Keyer
+	Code   clamav.ErrorCode `json:"code,omitempty"` // set when the error is an ErrorCode
+	Err    string           `json:"err,omitempty"`
+}
+
+func (r *response) setErr(err error) {
+	if err == nil {
+		return
+	}
+	if code, ok := err.(clamav.ErrorCode); ok {
+		r.Code = code
+	}
+	r.Err = err.Error()
+}
+
+func (r *response) err() error {
+	switch {
+	case r.Code != clamav.Success:
+		return r.Code
+	case r.Err != "":
+		return errors.New(r.Err)
+	}
+	return nil
+}
+
+// conn carries newline terminated JSON messages over a Unix socket, along
+// with at most one file descriptor per message. Only one message may be in
+// flight in each direction, so that descriptors are matched to the messages
+// they came with.
+type conn struct {
+	c   *net.UnixConn
+	buf []byte // read past the end of the last message
+	fds []int  // received and not yet handed out
+}
+
+func newConn(f *os.File) (*conn, error) {
+	c, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		return nil, errors.New("procpool: not a Unix socket")
+	}
+	return &conn{c: uc}, nil
+}
+
+// send writes v, passing fd along unless it is negative.
+func (c *conn) send(v interface{}, fd int) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	var oob []byte
+	if fd >= 0 {
+		oob = syscall.UnixRights(fd)
+	}
+	n, _, err := c.c.WriteMsgUnix(b, oob, nil)
+	if err == nil && n < len(b) {
+		_, err = c.c.Write(b[n:])
+	}
+	return err
+}
+
+// recv reads the next message into v and returns the descriptor that came
+// with it, or -1. The descriptor must be closed by the caller.
+func (c *conn) recv(v interface{}) (int, error) {
+	for {
+		if i := bytes.IndexByte(c.buf, '\n'); i >= 0 {
+			line := c.buf[:i]
+			c.buf = c.buf[i+1:]
+			fd := -1
+			if len(c.fds) > 0 {
+				fd, c.fds = c.fds[0], c.fds[1:]
+			}
+			if err := json.Unmarshal(line, v); err != nil {
+				if fd >= 0 {
+					syscall.Close(fd)
+				}
+				return -1, err
+			}
+			return fd, nil
+		}
+		b := make([]byte, 4096)
+		oob := make([]byte, syscall.CmsgSpace(4))
+		n, oobn, _, _, err := c.c.ReadMsgUnix(b, oob)
+		if oobn > 0 {
+			c.parseRights(oob[:oobn])
+		}
+		if n == 0 && err == nil {
+			err = io.EOF
+		}
+		if err != nil {
+			return -1, err
+		}
+		c.buf = append(c.buf, b[:n]...)
+	}
+}
+
+func (c *conn) parseRights(oob []byte) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+	for i := range msgs {
+		fds, err := syscall.ParseUnixRights(&msgs[i])
+		if err == nil {
+			c.fds = append(c.fds, fds...)
+		}
+	}
+}
+
+// Close closes the socket and the descriptors not handed out.
+func (c *conn) Close() error {
+	for _, fd := range c.fds {
+		syscall.Close(fd)
+	}
+	c.fds = nil
+	return c.c.Close()
+}
+
+// socketPair returns the two ends of a connected Unix stream socket: the
+// pool's end and the file handed to the worker.
+func socketPair() (*conn, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair", err)
+	}
+	syscall.CloseOnExec(fds[0])
+	syscall.CloseOnExec(fds[1])
+	f := os.NewFile(uintptr(fds[0]), "procpool")
+	c, err := newConn(f)
+	f.Close() // net.FileConn made its own copy
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+	return c, os.NewFile(uintptr(fds[1]), "procpool-worker"), nil
+}
@@ -0,0 +1,619 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+// Package procpool scans in worker processes, so that a crash of libclamav
+// takes down a worker and the scan it was running instead of the whole
+// program.
+//
+// A Pool is a clamav.Scanner. It starts its workers by running the program
+// again with the same arguments, or Config.Args, and an environment variable
+// telling them apart. In a worker, New serves the requests of the pool and
+// exits instead of returning, so the program must call New early, with the
+// same Config, before doing anything a worker should not do such as
+// listening on a port:
+//
+//	clamav.Init(clamav.InitDefault)
+//	pool, err := procpool.New(procpool.Config{Workers: 4, Setup: setLimits})
+//
+// Each worker loads its own engine. Files are scanned by path or through
+// descriptors passed over a Unix socket; streams are copied to a temporary
+// file first. A worker that dies during a scan fails it with a *CrashError
+// naming the file, and is replaced.
+//
+// The scan context is not passed to the workers: callbacks set by Setup run
+// in the worker with a nil context, and WithAttrs, WithDebug and WithTree have
+// no effect.
+package procpool
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// Config describes the workers of a pool. Setup runs in the workers, which
+// see the Config built by their own run of the program.
+type Config struct {
+	Workers   int                        // number of worker processes, runtime.NumCPU() if zero
+	DB        string                     // database directory, clamav.DBDir() if empty
+	DBOptions uint                       // clamav.DbStdopt if zero
+	Setup     func(*clamav.Engine) error // called on each engine of a worker before it is compiled
+	Args      []string                   // arguments of the workers, those of the program if nil
+	TempDir   string                     // directory for the streams passed to ScanReader, the system default if empty
+
+	MaxMemory uint64        // limit on the address space of a worker (RLIMIT_AS), in bytes; none if zero
+	MaxCPU    time.Duration // CPU time a single scan may use before its worker is killed; no limit if zero
+
+	// OnCrash, if set, is called for every worker that dies, with the error
+	// failing the scan it was running.
+	OnCrash func(err *CrashError)
+
+	// ErrorLog logs crashes and restarts, the log package's default if nil.
+	ErrorLog *log.Logger
+}
+
+func (c *Config) db() string {
+	if c.DB == "" {
+		return clamav.DBDir()
+	}
+	return c.DB
+}
+
+func (c *Config) dbOptions() uint {
+	if c.DBOptions == 0 {
+		return clamav.DbStdopt
+	}
+	return c.DBOptions
+}
+
+func (c *Config) logf(format string, args ...interface{}) {
+	if c.ErrorLog != nil {
+		c.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// CrashError is returned by the scans during which their worker died. The
+// Result returned with it has Code set to clamav.Estate.
+type CrashError struct {
+	Path    string      // the scanned file, empty for descriptors and streams
+	Context interface{} // the context of the scan, see clamav.ContextValue
+	Pid     int
+	State   string // how the worker ended, e.g. "SIGSEGV: segmentation violation"
+}
+
+func (e *CrashError) Error() string {
+	what := e.Path
+	if what == "" {
+		what = fmt.Sprint(e.Context)
+	}
+	return fmt.Sprintf("procpool: worker %d died scanning %s: %s", e.Pid, what, e.State)
+}
+
+// ErrClosed is returned by the scans of a closed Pool.
+var ErrClosed = errors.New("procpool: pool closed")
+
+// Pool is a clamav.Scanner handing the scans to worker processes.
+type Pool struct {
+	cfg   Config
+	idle  chan *worker
+	stale chan *worker // done scanning but not reloaded yet, or nil for one that died; see Reload
+
+	// OnReload, if set, is called after the workers reload their databases,
+	// as for clamav.Reloader.
+	OnReload func(db *clamav.DBInfo, err error)
+
+	reloadMu sync.Mutex // one Reload at a time
+
+	mu     sync.Mutex
+	db     *clamav.DBInfo
+	key    string // of the engine settings of the workers, see clamav.Keyer
+	stat   *clamav.Stat
+	gen    int // incremented by Reload
+	live   int // workers running
+	nstale int // of those, the ones left for Reload
+	closed bool
+}
+
+// worker is the pool's end of a worker process
+type worker struct {
+	cmd  *exec.Cmd
+	c    *conn
+	gen  int           // the Reload generation of its databases
+	done chan struct{} // closed once the process has been waited for
+	out  *crashLog
+}
+
+// crashLog passes the output of a worker on to stderr and keeps the first
+// line of a crash report of the Go runtime, which names the signal.
+type crashLog struct {
+	mu     sync.Mutex
+	reason string
+}
+
+var crashPrefixes = []string{"SIG", "fatal error: ", "panic: "}
+
+func (l *crashLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	if l.reason == "" {
+		for _, line := range strings.Split(string(p), "\n") {
+			for _, prefix := range crashPrefixes {
+				if strings.HasPrefix(line, prefix) && strings.Contains(line, ":") {
+					l.reason = line
+					break
+				}
+			}
+			if l.reason != "" {
+				break
+			}
+		}
+	}
+	l.mu.Unlock()
+	return os.Stderr.Write(p)
+}
+
+func (l *crashLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.reason
+}
+
+// New starts the workers and waits for them to load their databases. In a
+// worker process, it serves the pool that started it and exits.
+func New(cfg Config) (*Pool, error) {
+	if IsWorker() {
+		os.Exit(runWorker(&cfg))
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = runtime.NumCPU()
+	}
+	p := &Pool{cfg: cfg, idle: make(chan *worker, cfg.Workers), stale: make(chan *worker, cfg.Workers)}
+	errc := make(chan error, cfg.Workers)
+	for i := 0; i < cfg.Workers; i++ {
+		go func() {
+			w, err := p.start()
+			if err == nil {
+				p.put(w)
+			}
+			errc <- err
+		}()
+	}
+	var err error
+	for i := 0; i < cfg.Workers; i++ {
+		if e := <-errc; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	stat := new(clamav.Stat)
+	if err := clamav.StatIniDir(cfg.db(), stat); err == nil {
+		p.stat = stat
+	}
+	return p, nil
+}
+
+// start runs a worker process and waits for its engine to be ready.
+func (p *Pool) start() (*worker, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	c, f, err := socketPair()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	args := p.cfg.Args
+	if args == nil {
+		args = os.Args[1:]
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Env = append(os.Environ(), workerEnv+"=1")
+	out := new(crashLog)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.ExtraFiles = []*os.File{f}
+	if err := cmd.Start(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	w := &worker{cmd: cmd, c: c, done: make(chan struct{}), out: out}
+	go func() {
+		cmd.Wait()
+		close(w.done)
+	}()
+
+	var ready response
+	if _, err := c.recv(&ready); err != nil {
+		c.Close()
+		<-w.done
+		return nil, fmt.Errorf("procpool: worker %d: %s", cmd.Process.Pid, cmd.ProcessState)
+	}
+	if err := ready.err(); err != nil {
+		c.Close()
+		<-w.done
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		w.stop()
+		return nil, ErrClosed
+	}
+	w.gen = p.gen
+	p.live++
+	p.db = ready.DB
+	p.key = ready.Key
+	return w, nil
+}
+
+// stop closes the socket of the worker, which makes it exit, and waits for it.
+func (w *worker) stop() {
+	w.c.Close()
+	<-w.done
+}
+
+func (w *worker) exited() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Pool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// get waits for an idle worker.
+func (p *Pool) get() (*worker, error) {
+	for {
+		w, ok := <-p.idle
+		if !ok {
+			return nil, ErrClosed
+		}
+		if p.alive(w) {
+			return w, nil
+		}
+	}
+}
+
+// alive reports whether the idle worker w is still running, and replaces it
+// if not.
+func (p *Pool) alive(w *worker) bool {
+	if !w.exited() {
+		return true
+	}
+	// died while idle, e.g. killed by the OOM killer
+	p.cfg.logf("procpool: worker %d died: %s", w.cmd.Process.Pid, w.cmd.ProcessState)
+	p.replace(w)
+	return false
+}
+
+// put returns w to the pool, or hands it to Reload if its databases are due
+// to be reloaded.
+func (p *Pool) put(w *worker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		w.stop()
+		return
+	}
+	if w.gen < p.gen {
+		p.stale <- w
+		return
+	}
+	p.idle <- w
+}
+
+// replace starts another worker in place of the dead w in the background,
+// retrying with a growing delay until it is ready.
+func (p *Pool) replace(w *worker) {
+	w.c.Close()
+	p.mu.Lock()
+	p.live--
+	if w.gen < p.gen && !p.closed {
+		// the new worker starts with the new databases
+		p.nstale--
+		p.stale <- nil
+	}
+	p.mu.Unlock()
+	go func() {
+		delay := time.Second
+		for !p.isClosed() {
+			nw, err := p.start()
+			if err == ErrClosed {
+				return
+			}
+			if err == nil {
+				p.put(nw)
+				return
+			}
+			p.cfg.logf("procpool: starting a worker: %v, retrying in %v", err, delay)
+			time.Sleep(delay)
+			if delay < time.Minute {
+				delay *= 2
+			}
+		}
+	}()
+}
+
+// do sends req, with fd if not negative, to an idle worker and waits for the
+// response.
+func (p *Pool) do(req *request, fd int, context interface{}) (*response, error) {
+	w, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	return p.call(w, req, fd, context)
+}
+
+// call sends req to w and waits for the response. w is returned to the pool,
+// or replaced if it dies meanwhile.
+func (p *Pool) call(w *worker, req *request, fd int, context interface{}) (*response, error) {
+	resp, err := p.exchange(w, req, fd, context)
+	if err == nil {
+		p.put(w)
+	}
+	return resp, err
+}
+
+// exchange sends req to w and waits for the response, leaving w to the
+// caller. w is replaced if it dies meanwhile.
+func (p *Pool) exchange(w *worker, req *request, fd int, context interface{}) (*response, error) {
+	var resp response
+	err := w.c.send(req, fd)
+	if err == nil {
+		_, err = w.c.recv(&resp)
+	}
+	if err == nil {
+		return &resp, nil
+	}
+	w.c.Close()
+	<-w.done
+	crash := &CrashError{
+		Path:    req.Path,
+		Context: clamav.ContextValue(context),
+		Pid:     w.cmd.Process.Pid,
+		State:   w.cmd.ProcessState.String(),
+	}
+	if w.cmd.ProcessState.ExitCode() == exitCPU {
+		crash.State = fmt.Sprintf("exceeded %v of CPU time", p.cfg.MaxCPU)
+	} else if reason := w.out.String(); reason != "" {
+		crash.State = reason
+	}
+	p.cfg.logf("%v", crash)
+	if p.cfg.OnCrash != nil {
+		p.cfg.OnCrash(crash)
+	}
+	p.replace(w)
+	return nil, crash
+}
+
+func (p *Pool) scan(req *request, fd int, context interface{}) (*clamav.Result, error) {
+	req.Op = opScan
+	resp, err := p.do(req, fd, context)
+	if err != nil {
+		return &clamav.Result{Path: req.Path, Code: clamav.Estate}, err
+	}
+	res := resp.Result
+	if res == nil {
+		res = &clamav.Result{Path: req.Path, Code: resp.Code}
+	}
+	return res, resp.err()
+}
+
+// ScanPath scans the file at path in a worker.
+func (p *Pool) ScanPath(path string, opts uint, context interface{}) (*clamav.Result, error) {
+	return p.scan(&request{Path: path, Opts: opts}, -1, context)
+}
+
+// ScanFd passes the descriptor fd to a worker and scans it there.
+func (p *Pool) ScanFd(fd int, opts uint, context interface{}) (*clamav.Result, error) {
+	return p.scan(&request{Opts: opts}, fd, context)
+}
+
+// ScanReader scans the stream r in a worker. Unless r is a clamav.Spool kept
+// in a file, it is first copied to a temporary file.
+func (p *Pool) ScanReader(r io.Reader, opts uint, context interface{}) (*clamav.Result, error) {
+	if s, ok := r.(*clamav.Spool); ok && s.File() != nil {
+		return p.ScanFd(int(s.File().Fd()), opts, context)
+	}
+	f, err := ioutil.TempFile(p.cfg.TempDir, "procpool")
+	if err != nil {
+		return &clamav.Result{Code: clamav.Etmpfile}, err
+	}
+	os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return &clamav.Result{Code: clamav.Ewrite}, err
+	}
+	return p.ScanFd(int(f.Fd()), opts, context)
+}
+
+// DBInfo describes the databases loaded by the most recently started or
+// reloaded worker.
+func (p *Pool) DBInfo() (*clamav.DBInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.db == nil {
+		return nil, ErrClosed
+	}
+	db := *p.db
+	return &db, nil
+}
+
+// ScanKey returns the key of the engine settings reported by the most
+// recently started or reloaded worker, see clamav.Keyer. The workers all run
+// the same Setup.
+func (p *Pool) ScanKey(context interface{}) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.db == nil {
+		return "", ErrClosed
+	}
+	return p.key, nil
+}
+
+// Reload has every worker reload its databases, one at a time so that the
+// others keep scanning. It returns once every worker has been reloaded,
+// waiting for the busy ones to finish their scans. The idle workers are
+// reloaded first; a busy one is reloaded when its scan is done instead of
+// going back to the pool.
+func (p *Pool) Reload() error {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrClosed
+	}
+	// all that can be left by the last Reload is news of dead workers
+	for len(p.stale) > 0 {
+		<-p.stale
+	}
+	p.gen++
+	gen := p.gen
+	p.nstale = p.live
+	p.mu.Unlock()
+
+	// the workers idle now are ahead of those put back since
+	idle := p.idle
+	var firstErr error
+	for p.left() > 0 {
+		var w *worker
+		var ok bool
+		select {
+		case w, ok = <-idle:
+			if ok && w.gen >= gen {
+				// the idle workers have all been taken
+				p.put(w)
+				idle = nil
+				continue
+			}
+		case w, ok = <-p.stale:
+		}
+		if !ok {
+			return ErrClosed
+		}
+		if w == nil || !p.alive(w) {
+			// died, and replaced by a worker started with the new databases
+			continue
+		}
+		resp, err := p.exchange(w, &request{Op: opReload}, -1, "reload")
+		if err != nil {
+			// died reloading, and replaced the same way
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		p.mu.Lock()
+		p.nstale--
+		w.gen = gen // if it failed, tried again by the next Reload
+		if err := resp.err(); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			p.db = resp.DB
+			p.key = resp.Key
+		}
+		p.mu.Unlock()
+		p.put(w)
+	}
+	if p.OnReload != nil {
+		db, _ := p.DBInfo()
+		p.OnReload(db, firstErr)
+	}
+	return firstErr
+}
+
+// left returns the number of workers Reload has yet to reload.
+func (p *Pool) left() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.nstale
+}
+
+// Check reloads the databases if they changed since they were last loaded,
+// and reports whether they did.
+func (p *Pool) Check() (bool, error) {
+	p.mu.Lock()
+	changed := p.stat != nil && clamav.StatChkDir(p.stat)
+	if changed {
+		clamav.StatFree(p.stat)
+		p.stat = nil
+		stat := new(clamav.Stat)
+		if err := clamav.StatIniDir(p.cfg.db(), stat); err == nil {
+			p.stat = stat
+		}
+	}
+	p.mu.Unlock()
+	if !changed {
+		return false, nil
+	}
+	return true, p.Reload()
+}
+
+// Watch calls Check every interval until stop is closed.
+func (p *Pool) Watch(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if changed, err := p.Check(); err != nil {
+				p.cfg.logf("procpool: reloading %s: %v", p.cfg.db(), err)
+			} else if changed {
+				p.cfg.logf("procpool: reloaded %s", p.cfg.db())
+			}
+		}
+	}
+}
+
+// Close stops the workers once their scans finish. The Pool must not be used
+// afterwards.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.idle)
+	close(p.stale)
+	if p.stat != nil {
+		clamav.StatFree(p.stat)
+		p.stat = nil
+	}
+	p.mu.Unlock()
+	for w := range p.idle {
+		w.stop()
+	}
+	for w := range p.stale {
+		if w != nil {
+			w.stop()
+		}
+	}
+}
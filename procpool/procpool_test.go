@@ -0,0 +1,145 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package procpool
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+func TestConn(t *testing.T) {
+	pc, f, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	wc, err := newConn(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wc.Close()
+
+	tmp, err := ioutil.TempFile("", "procpool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	tmp.WriteString("scan me")
+
+	// two messages in a row, the first with a descriptor
+	if err := pc.send(&request{Op: opScan, Opts: 7}, int(tmp.Fd())); err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.send(&request{Op: opScan, Path: "/etc/passwd"}, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	var req request
+	fd, err := wc.recv(&req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fd < 0 || req.Op != opScan || req.Opts != 7 {
+		t.Fatalf("recv: got %+v and fd %d", req, fd)
+	}
+	b := make([]byte, 16)
+	n, err := syscall.Pread(fd, b, 0)
+	syscall.Close(fd)
+	if err != nil || string(b[:n]) != "scan me" {
+		t.Errorf("reading the passed descriptor: %q, %v", b[:n], err)
+	}
+	if fd, err = wc.recv(&req); err != nil || fd >= 0 || req.Path != "/etc/passwd" {
+		t.Errorf("recv: got %+v, fd %d, %v", req, fd, err)
+	}
+
+	resp := &response{Result: &clamav.Result{Code: clamav.Emaxsize}}
+	resp.setErr(clamav.ErrorCode(clamav.Emaxsize))
+	if err := wc.send(resp, -1); err != nil {
+		t.Fatal(err)
+	}
+	var got response
+	if _, err := pc.recv(&got); err != nil {
+		t.Fatal(err)
+	}
+	if err := got.err(); err != clamav.ErrorCode(clamav.Emaxsize) {
+		t.Errorf("response error %v, want %v", err, clamav.ErrorCode(clamav.Emaxsize))
+	}
+
+	wc.Close()
+	if _, err := pc.recv(&got); err == nil {
+		t.Errorf("recv after the other end closed: no error")
+	}
+}
+
+// fakeWorker answers the reload requests of the pool on its end of a socket
+// and counts them.
+func fakeWorker(t *testing.T, reloads chan<- int, id int) *worker {
+	pc, f, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wc, err := newConn(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer wc.Close()
+		var req request
+		for {
+			if _, err := wc.recv(&req); err != nil {
+				return
+			}
+			reloads <- id
+			wc.send(&response{DB: &clamav.DBInfo{Version: 2}}, -1)
+		}
+	}()
+	return &worker{c: pc, done: make(chan struct{})}
+}
+
+func TestReloadBusy(t *testing.T) {
+	reloads := make(chan int, 10)
+	a, b := fakeWorker(t, reloads, 1), fakeWorker(t, reloads, 2)
+	defer a.c.Close()
+	defer b.c.Close()
+	p := &Pool{cfg: Config{Workers: 2}, idle: make(chan *worker, 2), stale: make(chan *worker, 2), live: 2, db: &clamav.DBInfo{Version: 1}}
+
+	// b is busy scanning while a is reloaded, and comes back after
+	p.put(a)
+	done := make(chan error)
+	go func() { done <- p.Reload() }()
+	if id := <-reloads; id != 1 {
+		t.Fatalf("worker %d reloaded first, want 1", id)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Reload returned (%v) before the busy worker was reloaded", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// meanwhile a is back to scanning
+	select {
+	case w := <-p.idle:
+		p.put(w)
+	case <-time.After(time.Second):
+		t.Fatalf("no idle worker while Reload waits for the busy one")
+	}
+	p.put(b)
+	if id := <-reloads; id != 2 {
+		t.Fatalf("worker %d reloaded, want 2", id)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if a.gen != 1 || b.gen != 1 || len(p.idle) != 2 {
+		t.Errorf("after Reload: generations %d and %d, %d idle workers", a.gen, b.gen, len(p.idle))
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package procpool
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// workerEnv marks the processes started by a Pool. The socket to the pool is
+// their first extra file, descriptor 3.
+const workerEnv = "CLAMAV_PROCPOOL_WORKER"
+
+// Exit statuses of a worker
+const (
+	exitOK    = 0
+	exitSetup = 1 // the engine could not be loaded
+	exitCPU   = 3 // a scan used more than MaxCPU
+)
+
+// IsWorker reports whether the process was started by a Pool to scan.
+func IsWorker() bool {
+	return os.Getenv(workerEnv) != ""
+}
+
+// runWorker loads an engine as set by cfg and serves the requests of the
+// pool until it closes the socket. It returns the exit status.
+func runWorker(cfg *Config) int {
+	f := os.NewFile(3, "procpool")
+	c, err := newConn(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "procpool worker: %v\n", err)
+		return exitSetup
+	}
+	defer c.Close()
+
+	if err := setMemoryLimit(cfg.MaxMemory); err != nil {
+		c.send(&response{Err: err.Error()}, -1)
+		return exitSetup
+	}
+	r, err := clamav.NewReloader(cfg.db(), cfg.dbOptions(), cfg.Setup)
+	if err != nil {
+		c.send(&response{Err: err.Error()}, -1)
+		return exitSetup
+	}
+	defer r.Close()
+	db, _ := r.DBInfo()
+	key, _ := r.ScanKey(nil)
+	if err := c.send(&response{DB: db, Key: key}, -1); err != nil {
+		return exitOK
+	}
+
+	if cfg.MaxCPU > 0 {
+		xcpu := make(chan os.Signal, 1)
+		signal.Notify(xcpu, syscall.SIGXCPU)
+		go func() {
+			<-xcpu
+			fmt.Fprintf(os.Stderr, "procpool worker: scan exceeded %v of CPU time\n", cfg.MaxCPU)
+			os.Exit(exitCPU)
+		}()
+	}
+
+	for {
+		var req request
+		fd, err := c.recv(&req)
+		if err != nil {
+			return exitOK
+		}
+		var resp response
+		switch req.Op {
+		case opScan:
+			resp.Result, err = scan(r, &req, fd, cfg.MaxCPU)
+			resp.setErr(err)
+		case opReload:
+			resp.setErr(r.Reload())
+			resp.DB, _ = r.DBInfo()
+			resp.Key, _ = r.ScanKey(nil)
+		default:
+			resp.Err = "unknown request " + req.Op
+		}
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+		if err := c.send(&resp, -1); err != nil {
+			return exitOK
+		}
+	}
+}
+
+// scan scans the descriptor passed along with req, or its path, within the
+// CPU time allowed.
+func scan(r *clamav.Reloader, req *request, fd int, maxCPU time.Duration) (*clamav.Result, error) {
+	if maxCPU > 0 {
+		defer limitCPU(maxCPU)()
+	}
+	if fd >= 0 {
+		return r.ScanFd(fd, req.Opts, nil)
+	}
+	return r.ScanPath(req.Path, req.Opts, nil)
+}
+
+// limitCPU lowers the CPU time limit of the process to d past the time used
+// so far, for the kernel to send SIGXCPU when a scan runs away. It returns
+// the function lifting the limit.
+func limitCPU(d time.Duration) func() {
+	var old syscall.Rlimit
+	var ru syscall.Rusage
+	if syscall.Getrlimit(syscall.RLIMIT_CPU, &old) != nil || syscall.Getrusage(syscall.RUSAGE_SELF, &ru) != nil {
+		return func() {}
+	}
+	used := time.Duration(syscall.TimevalToNsec(ru.Utime) + syscall.TimevalToNsec(ru.Stime))
+	secs := uint64((used + d + time.Second - 1) / time.Second)
+	if secs >= old.Max {
+		return func() {}
+	}
+	syscall.Setrlimit(syscall.RLIMIT_CPU, &syscall.Rlimit{Cur: secs, Max: old.Max})
+	return func() { syscall.Setrlimit(syscall.RLIMIT_CPU, &old) }
+}
+
+// setMemoryLimit limits the address space of the process to n bytes.
+func setMemoryLimit(n uint64) error {
+	if n == 0 {
+		return nil
+	}
+	lim := syscall.Rlimit{Cur: n, Max: n}
+	if err := syscall.Setrlimit(syscall.RLIMIT_AS, &lim); err != nil {
+		return fmt.Errorf("procpool: setting the memory limit: %v", err)
+	}
+	return nil
+}
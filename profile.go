@@ -0,0 +1,309 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Profile bundles the scan options and engine limits suited to a kind of
+// scan, e.g. mail or uploads.
+type Profile struct {
+	Name    string
+	Options uint                   // scan options, added to those passed to the scan
+	Limits  map[EngineField]uint64 // engine fields set after the setup of the engine
+}
+
+// DefaultProfiles are a starting point for mail gateways, uploads to web
+// services, and the thorough scans of forensic analysis.
+var DefaultProfiles = []Profile{
+	{
+		Name:    "mail",
+		Options: ScanStdopt | ScanPartialMessage,
+		Limits: map[EngineField]uint64{
+			EngineMaxFilesize:  25 << 20,
+			EngineMaxScansize:  100 << 20,
+			EngineMaxRecursion: 16,
+			EngineMaxFiles:     10000,
+		},
+	},
+	{
+		Name:    "upload",
+		Options: ScanStdopt | ScanBlockencrypted | ScanBlockbroken,
+		Limits: map[EngineField]uint64{
+			EngineMaxFilesize:  100 << 20,
+			EngineMaxScansize:  400 << 20,
+			EngineMaxRecursion: 10,
+			EngineMaxFiles:     5000,
+		},
+	},
+	{
+		Name:    "forensic",
+		Options: ScanStdopt | ScanAllmatches | ScanHeuristicPrecedence,
+		Limits: map[EngineField]uint64{
+			EngineMaxFilesize:  4<<30 - 1,
+			EngineMaxScansize:  16 << 30,
+			EngineMaxRecursion: 64,
+			EngineMaxFiles:     1000000,
+		},
+	},
+}
+
+// ProfileByName returns the profile called name among profiles.
+func ProfileByName(profiles []Profile, name string) (Profile, bool) {
+	for _, p := range profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Profile{}, false
+}
+
+// Apply sets the limits of the profile on the engine, which must not be
+// compiled yet.
+func (p *Profile) Apply(e *Engine) error {
+	for f, v := range p.Limits {
+		if err := e.SetNum(f, v); err != nil {
+			return fmt.Errorf("profile %s: field %d: %v", p.Name, f, err)
+		}
+	}
+	return nil
+}
+
+// limitsKey identifies the limits of the profile, so that profiles differing
+// only in their options share an engine.
+func (p *Profile) limitsKey() string {
+	keys := make([]string, 0, len(p.Limits))
+	for f, v := range p.Limits {
+		keys = append(keys, fmt.Sprintf("%d=%d", f, v))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// WithProfile returns a scan context selecting the profile called name of a
+// ProfileScanner. Other scanners ignore it.
+func WithProfile(context interface{}, name string) interface{} {
+	ac := wrapContext(context)
+	ac.profile = name
+	return ac
+}
+
+// profileOf returns the profile selected by context, if any.
+func profileOf(context interface{}) string {
+	if ac, ok := context.(*attrContext); ok {
+		return ac.profile
+	}
+	return ""
+}
+
+// ProfileScanner is a Scanner choosing the engine and options of each scan by
+// the profile selected with WithProfile, the first one if none is. Engine
+// limits apply to every scan of an engine, so each distinct set of limits
+// needs its own engine, with its own copy of the databases. Profiles with the
+// same limits share an engine, and the engines follow the updates of the
+// databases as a Reloader does.
+type ProfileScanner struct {
+	profiles  []Profile
+	engines   map[string]*Reloader // by profile name
+	reloaders []*Reloader
+
+	// OnReload, if set, is called after every reload with the databases of
+	// the first profile, or the first error.
+	OnReload func(db *DBInfo, err error)
+}
+
+// NewProfileScanner loads the databases in dir into an engine for each
+// distinct set of limits among profiles. setup, if not nil, is called on
+// every engine before the limits of the profile are set.
+func NewProfileScanner(dir string, dbopts uint, setup func(*Engine) error, profiles ...Profile) (*ProfileScanner, error) {
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("NewProfileScanner: no profiles")
+	}
+	ps := &ProfileScanner{profiles: profiles, engines: map[string]*Reloader{}}
+	byLimits := map[string]*Reloader{}
+	for i := range profiles {
+		p := &profiles[i]
+		if _, dup := ps.engines[p.Name]; dup {
+			ps.Close()
+			return nil, fmt.Errorf("NewProfileScanner: duplicate profile %s", p.Name)
+		}
+		key := p.limitsKey()
+		r := byLimits[key]
+		if r == nil {
+			var err error
+			r, err = NewReloader(dir, dbopts, func(e *Engine) error {
+				if setup != nil {
+					if err := setup(e); err != nil {
+						return err
+					}
+				}
+				return p.Apply(e)
+			})
+			if err != nil {
+				ps.Close()
+				return nil, err
+			}
+			byLimits[key] = r
+			ps.reloaders = append(ps.reloaders, r)
+		}
+		ps.engines[p.Name] = r
+	}
+	return ps, nil
+}
+
+// Profiles returns the profiles of the scanner.
+func (ps *ProfileScanner) Profiles() []Profile {
+	return ps.profiles
+}
+
+// Engines returns the number of engines loaded for the profiles.
+func (ps *ProfileScanner) Engines() int {
+	return len(ps.reloaders)
+}
+
+// profile returns the profile selected by context.
+func (ps *ProfileScanner) profile(context interface{}) (*Profile, error) {
+	name := profileOf(context)
+	if name == "" {
+		return &ps.profiles[0], nil
+	}
+	for i := range ps.profiles {
+		if ps.profiles[i].Name == name {
+			return &ps.profiles[i], nil
+		}
+	}
+	return nil, fmt.Errorf("clamav: unknown scan profile %q", name)
+}
+
+// pick returns the engine and options of the profile selected by context.
+func (ps *ProfileScanner) pick(opts uint, context interface{}) (*Reloader, uint, error) {
+	p, err := ps.profile(context)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ps.engines[p.Name], opts | p.Options, nil
+}
+
+// ScanKey returns the key of the settings of the engine of the profile
+// selected by context, with the options of the profile, see Keyer. Profiles
+// sharing an engine differ only in their options.
+func (ps *ProfileScanner) ScanKey(context interface{}) (string, error) {
+	p, err := ps.profile(context)
+	if err != nil {
+		return "", err
+	}
+	k, err := ps.engines[p.Name].ScanKey(context)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%x", k, p.Options), nil
+}
+
+// ScanPath scans a file with the engine of the profile selected by context.
+func (ps *ProfileScanner) ScanPath(path string, opts uint, context interface{}) (*Result, error) {
+	r, opts, err := ps.pick(opts, context)
+	if err != nil {
+		return &Result{Path: path, Code: Earg}, err
+	}
+	return r.ScanPath(path, opts, context)
+}
+
+// ScanFd scans an open file with the engine of the profile selected by
+// context.
+func (ps *ProfileScanner) ScanFd(fd int, opts uint, context interface{}) (*Result, error) {
+	r, opts, err := ps.pick(opts, context)
+	if err != nil {
+		return &Result{Code: Earg}, err
+	}
+	return r.ScanFd(fd, opts, context)
+}
+
+// ScanReader scans a stream with the engine of the profile selected by
+// context.
+func (ps *ProfileScanner) ScanReader(rd io.Reader, opts uint, context interface{}) (*Result, error) {
+	r, opts, err := ps.pick(opts, context)
+	if err != nil {
+		return &Result{Code: Earg}, err
+	}
+	return r.ScanReader(rd, opts, context)
+}
+
+// DBInfo describes the databases loaded for the first profile.
+func (ps *ProfileScanner) DBInfo() (*DBInfo, error) {
+	return ps.engines[ps.profiles[0].Name].DBInfo()
+}
+
+// Reload reloads the databases of every engine.
+func (ps *ProfileScanner) Reload() error {
+	var firstErr error
+	for _, r := range ps.reloaders {
+		if err := r.Reload(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	ps.reloaded(firstErr)
+	return firstErr
+}
+
+// Check reloads the databases of the engines if they changed since they were
+// last loaded, and reports whether they did.
+func (ps *ProfileScanner) Check() (bool, error) {
+	var changed bool
+	var firstErr error
+	for _, r := range ps.reloaders {
+		c, err := r.Check()
+		changed = changed || c
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if changed {
+		ps.reloaded(firstErr)
+	}
+	return changed, firstErr
+}
+
+func (ps *ProfileScanner) reloaded(err error) {
+	if ps.OnReload == nil {
+		return
+	}
+	if err != nil {
+		ps.OnReload(nil, err)
+		return
+	}
+	ps.OnReload(ps.DBInfo())
+}
+
+// Watch calls Check every interval until stop is closed.
+func (ps *ProfileScanner) Watch(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if changed, err := ps.Check(); err != nil {
+				log.Printf("clamav: reloading the profile engines: %v", err)
+			} else if changed {
+				log.Printf("clamav: reloaded the profile engines")
+			}
+		}
+	}
+}
+
+// Close frees the engines. The ProfileScanner must not be used afterwards.
+func (ps *ProfileScanner) Close() {
+	for _, r := range ps.reloaders {
+		r.Close()
+	}
+	ps.reloaders = nil
+}
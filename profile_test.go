@@ -0,0 +1,79 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"log/slog"
+	"testing"
+)
+
+func TestProfilePick(t *testing.T) {
+	mail, upload := &Reloader{}, &Reloader{}
+	ps := &ProfileScanner{
+		profiles: []Profile{{Name: "mail", Options: ScanMail}, {Name: "upload"}},
+		engines:  map[string]*Reloader{"mail": mail, "upload": upload},
+	}
+	for _, tt := range []struct {
+		context interface{}
+		engine  *Reloader
+		opts    uint
+		err     bool
+	}{
+		{"plain", mail, ScanStdopt | ScanMail, false},
+		{WithProfile(nil, "upload"), upload, ScanStdopt, false},
+		{WithProfile(WithAttrs("x", slog.String("file", "x")), "mail"), mail, ScanStdopt | ScanMail, false},
+		{WithProfile("x", "forensic"), nil, 0, true},
+	} {
+		r, opts, err := ps.pick(ScanStdopt, tt.context)
+		if r != tt.engine || opts != tt.opts || (err != nil) != tt.err {
+			t.Errorf("pick(%v): got %p %#x %v", tt.context, r, opts, err)
+		}
+	}
+	if _, err := ps.ScanKey(WithProfile("x", "forensic")); err == nil {
+		t.Errorf("ScanKey of an unknown profile: no error")
+	}
+
+	// the profile survives other context wrappers
+	ctx := WithAttrs(WithProfile("x", "upload"), slog.Int("n", 1))
+	if p := profileOf(ctx); p != "upload" {
+		t.Errorf("profile of %v: %q, want upload", ctx, p)
+	}
+	if v := ContextValue(ctx); v != "x" {
+		t.Errorf("ContextValue: %v, want x", v)
+	}
+}
+
+func TestProfileLimitsKey(t *testing.T) {
+	a := Profile{Limits: map[EngineField]uint64{EngineMaxFiles: 10, EngineMaxRecursion: 4}}
+	b := Profile{Options: ScanAllmatches, Limits: map[EngineField]uint64{EngineMaxRecursion: 4, EngineMaxFiles: 10}}
+	c := Profile{Limits: map[EngineField]uint64{EngineMaxFiles: 11, EngineMaxRecursion: 4}}
+	if a.limitsKey() != b.limitsKey() {
+		t.Errorf("same limits, different keys %q and %q", a.limitsKey(), b.limitsKey())
+	}
+	if a.limitsKey() == c.limitsKey() {
+		t.Errorf("different limits, same key %q", a.limitsKey())
+	}
+}
+
+func TestProfileEncryptedPolicy(t *testing.T) {
+	var profiles []Profile
+	engines := map[string]*Reloader{}
+	for _, p := range DefaultProfiles {
+		profiles = append(profiles, p)
+		engines[p.Name] = &Reloader{}
+	}
+	ps := &ProfileScanner{profiles: profiles, engines: engines}
+
+	// the options WithEncryptedPolicy passes down survive every profile
+	for _, p := range []EncryptedPolicy{EncryptedReport, EncryptedBlock} {
+		want := p.Options(0)
+		for _, prof := range profiles {
+			_, opts, err := ps.pick(p.Options(ScanStdopt), WithProfile(nil, prof.Name))
+			if err != nil || opts&want != want || opts&prof.Options != prof.Options {
+				t.Errorf("%v with profile %s: options %#x %v", p, prof.Name, opts, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package quarantine
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted content is split into chunks of chunkSize bytes, each sealed with
+// AES-GCM under a nonce made of a random prefix, the chunk number and a flag
+// marking the last chunk, so that chunks can not be reordered, dropped or
+// truncated without detection. The prefix is stored at the start of the file.
+const (
+	chunkSize   = 64 << 10
+	prefixSize  = 7
+	chunkNonces = 1 << 32
+)
+
+var errCorrupt = errors.New("quarantine: encrypted content is corrupt or the key is wrong")
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (s *Store) encoder(w io.Writer, enc string) (io.WriteCloser, error) {
+	switch enc {
+	case Plain:
+		return nopWriteCloser{w}, nil
+	case Neutered:
+		return nopWriteCloser{&xorWriter{w: w}}, nil
+	case Encrypted:
+		aead, err := newAEAD(s.Key)
+		if err != nil {
+			return nil, err
+		}
+		sw := &sealWriter{w: w, aead: aead}
+		if _, err := rand.Read(sw.prefix[:]); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(sw.prefix[:]); err != nil {
+			return nil, err
+		}
+		return sw, nil
+	}
+	return nil, fmt.Errorf("quarantine: unknown encoding %q", enc)
+}
+
+func (s *Store) decoder(r io.Reader, enc string) (io.Reader, error) {
+	switch enc {
+	case Plain:
+		return r, nil
+	case Neutered:
+		return &xorReader{r: r}, nil
+	case Encrypted:
+		if s.Key == nil {
+			return nil, errors.New("quarantine: entry is encrypted and no key is set")
+		}
+		aead, err := newAEAD(s.Key)
+		if err != nil {
+			return nil, err
+		}
+		or := &openReader{r: bufio.NewReader(r), aead: aead}
+		if _, err := io.ReadFull(or.r, or.prefix[:]); err != nil {
+			return nil, errCorrupt
+		}
+		return or, nil
+	}
+	return nil, fmt.Errorf("quarantine: unknown encoding %q", enc)
+}
+
+type xorWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (x *xorWriter) Write(p []byte) (int, error) {
+	if cap(x.buf) < len(p) {
+		x.buf = make([]byte, len(p))
+	}
+	b := x.buf[:len(p)]
+	for i, c := range p {
+		b[i] = c ^ NeuterByte
+	}
+	return x.w.Write(b)
+}
+
+type xorReader struct {
+	r io.Reader
+}
+
+func (x *xorReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= NeuterByte
+	}
+	return n, err
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix [prefixSize]byte, n uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix[:])
+	binary.BigEndian.PutUint32(nonce[prefixSize:], uint32(n))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type sealWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix [prefixSize]byte
+	n      uint64
+	buf    []byte
+}
+
+// Write seals full chunks only once more data follows them, so that the last
+// chunk is always sealed by Close.
+func (sw *sealWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		if len(sw.buf) == chunkSize {
+			if err := sw.seal(false); err != nil {
+				return 0, err
+			}
+		}
+		m := chunkSize - len(sw.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		sw.buf = append(sw.buf, p[:m]...)
+		p = p[m:]
+	}
+	return written, nil
+}
+
+func (sw *sealWriter) seal(last bool) error {
+	if sw.n == chunkNonces {
+		return errors.New("quarantine: file too large to encrypt")
+	}
+	out := sw.aead.Seal(nil, chunkNonce(sw.prefix, sw.n, last), sw.buf, nil)
+	sw.n++
+	sw.buf = sw.buf[:0]
+	_, err := sw.w.Write(out)
+	return err
+}
+
+func (sw *sealWriter) Close() error {
+	return sw.seal(true)
+}
+
+type openReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	prefix [prefixSize]byte
+	n      uint64
+	buf    []byte // opened data not yet returned
+	done   bool
+}
+
+func (or *openReader) Read(p []byte) (int, error) {
+	for len(or.buf) == 0 {
+		if or.done {
+			return 0, io.EOF
+		}
+		if err := or.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, or.buf)
+	or.buf = or.buf[n:]
+	return n, nil
+}
+
+func (or *openReader) open() error {
+	chunk := make([]byte, chunkSize+or.aead.Overhead())
+	n, err := io.ReadFull(or.r, chunk)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	last := false
+	if _, perr := or.r.Peek(1); perr == io.EOF {
+		last = true
+	}
+	if or.n == chunkNonces {
+		return errCorrupt
+	}
+	plain, err := or.aead.Open(chunk[:0], chunkNonce(or.prefix, or.n, last), chunk[:n], nil)
+	if err != nil {
+		return errCorrupt
+	}
+	or.n++
+	or.buf = plain
+	or.done = last
+	return nil
+}
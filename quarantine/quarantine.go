@@ -0,0 +1,453 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+// Package quarantine keeps infected files in a locked-down directory, together
+// with a record of where they came from and why they were quarantined, so
+// that they can later be inspected, restored or purged.
+//
+// Every entry is stored as two files named after a random ID: ID.dat holds
+// the content, plain, neutered or encrypted, and ID.json holds the Entry
+// describing it. The directory and the files are only accessible to their
+// owner.
+//
+// Files are always copied through a descriptor that was opened without
+// following symlinks, normally the one that was scanned, so a quarantined
+// copy is exactly what the scanner saw even if the path was replaced in the
+// meantime. Moving a file is a copy followed by removing the original, which
+// works across file systems; the original is only removed if the path still
+// refers to the file that was copied.
+package quarantine
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// Encodings of the stored content
+const (
+	Plain     = "plain"   // stored as is
+	Neutered  = "xor"     // every byte XORed with NeuterByte
+	Encrypted = "aes-gcm" // encrypted with the store's Key
+)
+
+// NeuterByte is XORed with every byte of a neutered file, so that it can not
+// be run or opened by accident and is not detected again by other scanners.
+const NeuterByte = 0xa5
+
+// ErrNotFound is returned for an ID that is not in the store.
+var ErrNotFound = errors.New("quarantine: no such entry")
+
+// ErrChanged is returned when a file is not removed because its path no
+// longer refers to the file that was quarantined.
+var ErrChanged = errors.New("quarantine: file changed since it was opened")
+
+// Entry describes a quarantined file.
+type Entry struct {
+	ID          string      `json:"id"`
+	Path        string      `json:"path"` // original location
+	UID         int         `json:"uid"`
+	GID         int         `json:"gid"`
+	Mode        os.FileMode `json:"mode"`
+	ModTime     time.Time   `json:"mtime"`
+	Size        int64       `json:"size"`
+	MD5         string      `json:"md5"`
+	SHA1        string      `json:"sha1"`
+	SHA256      string      `json:"sha256"`
+	Matches     []string    `json:"matches,omitempty"`
+	DBVersion   uint        `json:"db_version,omitempty"`
+	DBTime      time.Time   `json:"db_time,omitempty"`
+	Quarantined time.Time   `json:"quarantined"`
+	Removed     bool        `json:"removed"` // whether the original was removed
+	Encoding    string      `json:"encoding"`
+}
+
+// Store is a quarantine directory.
+type Store struct {
+	dir string
+
+	// Key, if set, is a 16, 24 or 32 byte AES key used to encrypt the
+	// content of new entries. It is needed to restore them.
+	Key []byte
+
+	// Neuter stores the content of new entries XORed with NeuterByte when
+	// no Key is set.
+	Neuter bool
+}
+
+// Open opens the quarantine in dir, creating it if needed. The directory must
+// not be accessible to anyone but its owner.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("quarantine: %s is not a directory", dir)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("quarantine: %s is accessible to other users (mode %v)", dir, fi.Mode().Perm())
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Dir returns the quarantine directory.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// OpenFile opens path for reading without following a symlink in its last
+// element, and checks that it is a regular file.
+func OpenFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("quarantine: %s is not a regular file", path)
+	}
+	return f, nil
+}
+
+// Remove removes path if it still refers to the open file f.
+func Remove(f *os.File, path string) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	lfi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(fi, lfi) {
+		return ErrChanged
+	}
+	return os.Remove(path)
+}
+
+func (s *Store) encoding() string {
+	switch {
+	case s.Key != nil:
+		return Encrypted
+	case s.Neuter:
+		return Neutered
+	}
+	return Plain
+}
+
+// Add copies the file f, opened from path, into the quarantine and records
+// the scan result and the databases that produced it; either may be nil. If
+// remove is set the original is removed afterwards, see Remove. The entry is
+// returned even if only the removal failed.
+func (s *Store) Add(f *os.File, path string, res *clamav.Result, db *clamav.DBInfo, remove bool) (*Entry, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("quarantine: %s is not a regular file", path)
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	e := &Entry{
+		ID:          id,
+		Path:        path,
+		Mode:        fi.Mode(),
+		ModTime:     fi.ModTime(),
+		Quarantined: time.Now(),
+		Encoding:    s.encoding(),
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		e.UID, e.GID = int(st.Uid), int(st.Gid)
+	}
+	if res != nil {
+		e.Matches = res.Matches
+		if len(e.Matches) == 0 && res.Virus != "" {
+			e.Matches = []string{res.Virus}
+		}
+	}
+	if db != nil {
+		e.DBVersion, e.DBTime = db.Version, db.Time
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := s.writeData(e, f); err != nil {
+		return nil, err
+	}
+	if err := s.writeEntry(e); err != nil {
+		os.Remove(s.dataPath(id))
+		return nil, err
+	}
+
+	if remove {
+		if err := Remove(f, path); err != nil {
+			return e, err
+		}
+		e.Removed = true
+		if err := s.writeEntry(e); err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
+
+// writeData stores the content read from r, filling in the size and hashes.
+func (s *Store) writeData(e *Entry, r io.Reader) error {
+	name := s.dataPath(e.ID)
+	out, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	h5, h1, h256 := md5.New(), sha1.New(), sha256.New()
+	w, err := s.encoder(out, e.Encoding)
+	if err == nil {
+		e.Size, err = io.Copy(io.MultiWriter(w, h5, h1, h256), r)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(name, 0400)
+	}
+	if err != nil {
+		os.Remove(name)
+		return err
+	}
+	e.MD5 = hex.EncodeToString(h5.Sum(nil))
+	e.SHA1 = hex.EncodeToString(h1.Sum(nil))
+	e.SHA256 = hex.EncodeToString(h256.Sum(nil))
+	return nil
+}
+
+// writeEntry atomically replaces the metadata of e.
+func (s *Store) writeEntry(e *Entry) error {
+	b, err := json.MarshalIndent(e, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.dir, ".tmp-"+e.ID)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.entryPath(e.ID))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *Store) dataPath(id string) string {
+	return filepath.Join(s.dir, id+".dat")
+}
+
+func (s *Store) entryPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func newID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// Get returns the entry with the given ID.
+func (s *Store) Get(id string) (*Entry, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	b, err := ioutil.ReadFile(s.entryPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	e := new(Entry)
+	if err := json.Unmarshal(b, e); err != nil {
+		return nil, fmt.Errorf("quarantine: %s: %v", id, err)
+	}
+	return e, nil
+}
+
+// List returns every entry in the store, oldest first.
+func (s *Store) List() ([]*Entry, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var list []*Entry
+	for _, n := range names {
+		e, err := s.Get(strings.TrimSuffix(filepath.Base(n), ".json"))
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return list, err
+		}
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Quarantined.Before(list[j].Quarantined)
+	})
+	return list, nil
+}
+
+// Content returns the original content of a quarantined file. Encrypted
+// content is authenticated as it is read.
+func (s *Store) Content(e *Entry) (io.ReadCloser, error) {
+	f, err := os.Open(s.dataPath(e.ID))
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.decoder(f, e.Encoding)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
+
+// Restore writes a quarantined file back to dest, or to its original path if
+// dest is empty, and deletes the entry. An existing file is never
+// overwritten. The mode and modification time are restored, and the owner
+// too when permitted.
+func (s *Store) Restore(id, dest string) (string, error) {
+	e, err := s.Get(id)
+	if err != nil {
+		return "", err
+	}
+	if dest == "" {
+		dest = e.Path
+	}
+	r, err := s.Content(e)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), r)
+	if err == nil && hex.EncodeToString(h.Sum(nil)) != e.SHA256 {
+		err = fmt.Errorf("quarantine: %s: content does not match its SHA256", id)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dest)
+		return "", err
+	}
+	if err := os.Lchown(dest, e.UID, e.GID); err != nil && !os.IsPermission(err) {
+		return dest, err
+	}
+	if err := os.Chmod(dest, e.Mode.Perm()); err != nil {
+		return dest, err
+	}
+	if err := os.Chtimes(dest, e.ModTime, e.ModTime); err != nil {
+		return dest, err
+	}
+	return dest, s.Delete(id)
+}
+
+// Delete removes an entry and its content from the store.
+func (s *Store) Delete(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	err := os.Remove(s.dataPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(s.entryPath(id))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Purge deletes every entry quarantined before t and returns how many were
+// deleted.
+func (s *Store) Purge(t time.Time) (int, error) {
+	list, err := s.List()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range list {
+		if !e.Quarantined.Before(t) {
+			break
+		}
+		if err := s.Delete(e.ID); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package quarantine
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+var eicar = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+var StoreTests = []struct {
+	name    string
+	key     []byte
+	neuter  bool
+	content []byte
+}{
+	{"plain", nil, false, eicar},
+	{"neutered", nil, true, eicar},
+	{"encrypted", bytes.Repeat([]byte{7}, 32), false, eicar},
+	{"encrypted empty", bytes.Repeat([]byte{7}, 16), false, nil},
+	{"encrypted chunks", bytes.Repeat([]byte{7}, 32), false, bytes.Repeat(eicar, 3*chunkSize/len(eicar)+1)},
+	{"encrypted exact chunk", bytes.Repeat([]byte{7}, 32), false, bytes.Repeat([]byte{'x'}, chunkSize)},
+}
+
+func TestStore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, tt := range StoreTests {
+		s, err := Open(filepath.Join(tmp, "q"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Key, s.Neuter = tt.key, tt.neuter
+
+		path := filepath.Join(tmp, "infected")
+		if err := ioutil.WriteFile(path, tt.content, 0640); err != nil {
+			t.Fatal(err)
+		}
+		f, err := OpenFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := &clamav.Result{Virus: "Eicar-Test-Signature", Code: clamav.Virus}
+		db := &clamav.DBInfo{Version: 25000, Time: time.Unix(1500000000, 0)}
+		e, err := s.Add(f, path, res, db, true)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: Add: %v", tt.name, err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: original not removed: %v", tt.name, err)
+		}
+		if !e.Removed || e.Size != int64(len(tt.content)) || e.DBVersion != 25000 || len(e.Matches) != 1 {
+			t.Errorf("%s: bad entry %+v", tt.name, e)
+		}
+		stored, err := ioutil.ReadFile(s.dataPath(e.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tt.content) > 0 && (tt.neuter || tt.key != nil) && bytes.Contains(stored, tt.content[:10]) {
+			t.Errorf("%s: stored content not encoded", tt.name)
+		}
+
+		list, err := s.List()
+		if err != nil || len(list) != 1 || list[0].ID != e.ID || list[0].SHA256 != e.SHA256 {
+			t.Fatalf("%s: List = %v, %v", tt.name, list, err)
+		}
+
+		dest, err := s.Restore(e.ID, "")
+		if err != nil {
+			t.Fatalf("%s: Restore: %v", tt.name, err)
+		}
+		got, err := ioutil.ReadFile(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, tt.content) {
+			t.Errorf("%s: restored %d bytes, want %d", tt.name, len(got), len(tt.content))
+		}
+		if fi, err := os.Stat(dest); err != nil || fi.Mode().Perm() != 0640 {
+			t.Errorf("%s: restored mode %v, %v", tt.name, fi.Mode(), err)
+		}
+		if _, err := s.Get(e.ID); err != ErrNotFound {
+			t.Errorf("%s: entry not deleted after restore: %v", tt.name, err)
+		}
+		os.Remove(dest)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	s, err := Open(filepath.Join(tmp, "q"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Key = bytes.Repeat([]byte{1}, 32)
+	path := filepath.Join(tmp, "infected")
+	ioutil.WriteFile(path, eicar, 0600)
+	f, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := s.Add(f, path, nil, nil, false)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Key = bytes.Repeat([]byte{2}, 32)
+	if _, err := s.Restore(e.ID, filepath.Join(tmp, "restored")); err != errCorrupt {
+		t.Errorf("Restore with the wrong key: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "restored")); !os.IsNotExist(err) {
+		t.Errorf("partial restore left behind: %v", err)
+	}
+}
+
+func TestRemoveChanged(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "infected")
+	ioutil.WriteFile(path, eicar, 0600)
+	f, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// replace the file after it was opened
+	os.Rename(path, path+".old")
+	ioutil.WriteFile(path, []byte("clean"), 0600)
+	if err := Remove(f, path); err != ErrChanged {
+		t.Errorf("Remove = %v, want ErrChanged", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("replacement removed: %v", err)
+	}
+
+	os.Symlink(path+".old", path+".link")
+	if _, err := OpenFile(path + ".link"); err == nil {
+		t.Errorf("OpenFile followed a symlink")
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Reloader is a Scanner that keeps an engine loaded with the databases in a
+// directory and replaces it with a freshly loaded engine when they change.
+// Scans in progress during a reload finish on the old engine, which is freed
+// by the last of them.
+type Reloader struct {
+	dir    string
+	dbopts uint
+	setup  func(*Engine) error
+
+	// OnReload, if set, is called after every reload attempt with the new
+	// databases or the error that prevented loading them.
+	OnReload func(db *DBInfo, err error)
+
+	mu   sync.RWMutex
+	eng  *Engine
+	stat *Stat
+}
+
+// NewReloader loads the databases in dir into a new engine. If setup is not
+// nil it is called on every new engine before it is compiled, to set limits
+// and callbacks.
+func NewReloader(dir string, dbopts uint, setup func(*Engine) error) (*Reloader, error) {
+	r := &Reloader{dir: dir, dbopts: dbopts, setup: setup}
+	eng, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	r.eng = eng
+	r.stat = r.statDir()
+	return r, nil
+}
+
+func (r *Reloader) load() (*Engine, error) {
+	eng := New()
+	if r.setup != nil {
+		if err := r.setup(eng); err != nil {
+			eng.Free()
+			return nil, err
+		}
+	}
+	if _, err := eng.Load(r.dir, r.dbopts); err != nil {
+		eng.Free()
+		return nil, err
+	}
+	if err := eng.Compile(); err != nil {
+		eng.Free()
+		return nil, err
+	}
+	return eng, nil
+}
+
+// statDir records the state of the database directory for Check. It returns
+// nil if the databases are not in a directory that can be watched.
+func (r *Reloader) statDir() *Stat {
+	stat := new(Stat)
+	if err := StatIniDir(r.dir, stat); err != nil {
+		return nil
+	}
+	return stat
+}
+
+// Reload loads the databases into a new engine and swaps it in. On error the
+// current engine is kept.
+func (r *Reloader) Reload() error {
+	eng, err := r.load()
+	if err != nil {
+		if r.OnReload != nil {
+			r.OnReload(nil, err)
+		}
+		return err
+	}
+	stat := r.statDir()
+
+	r.mu.Lock()
+	old, oldStat := r.eng, r.stat
+	r.eng, r.stat = eng, stat
+	r.mu.Unlock()
+
+	old.Free()
+	if oldStat != nil {
+		StatFree(oldStat)
+	}
+	if r.OnReload != nil {
+		db, err := eng.DBInfo()
+		r.OnReload(db, err)
+	}
+	return nil
+}
+
+// Check reloads the databases if they changed since they were last loaded,
+// and reports whether they did.
+func (r *Reloader) Check() (bool, error) {
+	r.mu.RLock()
+	changed := r.stat != nil && StatChkDir(r.stat)
+	r.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	return true, r.Reload()
+}
+
+// Watch calls Check every interval until stop is closed.
+func (r *Reloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if changed, err := r.Check(); err != nil {
+				log.Printf("clamav: reloading %s: %v", r.dir, err)
+			} else if changed {
+				log.Printf("clamav: reloaded %s", r.dir)
+			}
+		}
+	}
+}
+
+// Close frees the engine. The Reloader must not be used afterwards.
+func (r *Reloader) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.eng.Free()
+	r.eng = nil
+	if r.stat != nil {
+		StatFree(r.stat)
+		r.stat = nil
+	}
+}
+
+// engine returns the current engine with a reference added, which the caller
+// drops with Free, so that a scan does not hold up the swap of a reload.
+func (r *Reloader) engine() (*Engine, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if err := r.eng.Addref(); err != nil {
+		return nil, err
+	}
+	return r.eng, nil
+}
+
+// ScanPath scans a file with the current engine.
+func (r *Reloader) ScanPath(path string, opts uint, context interface{}) (*Result, error) {
+	eng, err := r.engine()
+	if err != nil {
+		return &Result{Path: path, Code: Estate}, err
+	}
+	defer eng.Free()
+	return eng.ScanPath(path, opts, context)
+}
+
+// ScanFd scans an open file with the current engine.
+func (r *Reloader) ScanFd(fd int, opts uint, context interface{}) (*Result, error) {
+	eng, err := r.engine()
+	if err != nil {
+		return &Result{Code: Estate}, err
+	}
+	defer eng.Free()
+	return eng.ScanFd(fd, opts, context)
+}
+
+// ScanReader scans a stream with the current engine.
+func (r *Reloader) ScanReader(rd io.Reader, opts uint, context interface{}) (*Result, error) {
+	eng, err := r.engine()
+	if err != nil {
+		return &Result{Code: Estate}, err
+	}
+	defer eng.Free()
+	return eng.ScanReader(rd, opts, context)
+}
+
+// DBInfo describes the databases loaded into the current engine.
+func (r *Reloader) DBInfo() (*DBInfo, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.eng.DBInfo()
+}
+
+// Snapshot reads the fields of the current engine.
+func (r *Reloader) Snapshot() (*Snapshot, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.eng.Snapshot()
+}
+
+// ScanKey returns the key of the settings of the current engine, see Keyer.
+func (r *Reloader) ScanKey(context interface{}) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.eng.ScanKey(context)
+}
@@ -0,0 +1,286 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+/*
+#include <clamav.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Result describes the outcome of a single scan.
+type Result struct {
+	Path     string        `json:"path,omitempty"`      // the scanned file, if the object was a file
+	Virus    string        `json:"virus,omitempty"`     // the virus name reported by libclamav
+	Matches  []string      `json:"matches,omitempty"`   // every virus name reported during the scan
+	FileType string        `json:"file_type,omitempty"` // type of the scanned object as detected by libclamav, e.g. "CL_TYPE_ZIP"
+	Scanned  uint64        `json:"scanned"`             // bytes scanned, in CountPrecision increments
+	Code     ErrorCode     `json:"code"`                // Clean, Virus or the error that stopped the scan
+	Duration time.Duration `json:"duration"`
+	Cached   bool          `json:"cached,omitempty"` // the verdict came from a cache, not from libclamav
+
+	Conditions Condition `json:"conditions,omitempty"` // why the scan was incomplete or suspicious
+	Heuristics []string  `json:"heuristics,omitempty"` // the Heuristics.* names among Matches
+
+	Tree *Object `json:"tree,omitempty"` // the objects visited, if asked for with WithTree
+}
+
+// Infected reports whether the scan found a virus.
+func (r *Result) Infected() bool {
+	return r.Code == Virus
+}
+
+// DBInfo describes the virus databases loaded into an engine.
+type DBInfo struct {
+	Version    uint      `json:"version"`
+	Time       time.Time `json:"time"`
+	Signatures uint      `json:"signatures"`
+}
+
+// Age returns how long ago the databases were built.
+func (d *DBInfo) Age() time.Duration {
+	return time.Since(d.Time)
+}
+
+// Scanner is implemented by anything that can scan files and streams for
+// viruses. *Engine is the in-process implementation. The context is passed to
+// the callbacks set on the engine, if any.
+//
+// A scan that completes returns a Result with Code set to Clean or Virus and a
+// nil error. A scan that fails returns the Result so far and the error that
+// stopped it, usually an ErrorCode. The Result is never nil.
+type Scanner interface {
+	ScanPath(path string, opts uint, context interface{}) (*Result, error)
+	ScanFd(fd int, opts uint, context interface{}) (*Result, error)
+	ScanReader(r io.Reader, opts uint, context interface{}) (*Result, error)
+	DBInfo() (*DBInfo, error)
+}
+
+// Keyer is implemented by the Scanners that can tell which engine settings a
+// scan with the given context would use, as a key such as Snapshot.Key.
+// Verdicts of scans with different keys may differ even for the same content,
+// databases and options, so caches of verdicts add the key to theirs.
+type Keyer interface {
+	ScanKey(context interface{}) (string, error)
+}
+
+// ScanKey returns the key of the settings of a scan of s with context, see
+// Keyer, or an empty string if s can not tell.
+func ScanKey(s Scanner, context interface{}) (string, error) {
+	if k, ok := s.(Keyer); ok {
+		return k.ScanKey(context)
+	}
+	return "", nil
+}
+
+// sigCounter keeps the number of signatures loaded into each engine, which
+// libclamav does not report once the databases are loaded, until the last
+// reference to the engine is dropped.
+type sigCounter struct {
+	sync.Mutex
+	sigs map[*Engine]uint
+	refs map[*Engine]int // added by Addref
+}
+
+var loaded = sigCounter{
+	sigs: map[*Engine]uint{},
+	refs: map[*Engine]int{},
+}
+
+func (c *sigCounter) add(e *Engine, n uint) {
+	c.Lock()
+	defer c.Unlock()
+	c.sigs[e] += n
+}
+
+func (c *sigCounter) get(e *Engine) uint {
+	c.Lock()
+	defer c.Unlock()
+	return c.sigs[e]
+}
+
+func (c *sigCounter) addref(e *Engine) {
+	c.Lock()
+	defer c.Unlock()
+	c.refs[e]++
+}
+
+// release drops a reference to e, and forgets e with the last one.
+func (c *sigCounter) release(e *Engine) {
+	c.Lock()
+	defer c.Unlock()
+	if c.refs[e] > 0 {
+		c.refs[e]--
+		return
+	}
+	delete(c.refs, e)
+	delete(c.sigs, e)
+}
+
+// Signatures returns the number of signatures loaded into the engine with Load.
+func (e *Engine) Signatures() uint {
+	return loaded.get(e)
+}
+
+// DBInfo returns the version, build time and signature count of the databases
+// loaded into the engine.
+func (e *Engine) DBInfo() (*DBInfo, error) {
+	ver, err := e.GetNum(EngineDbVersion)
+	if err != nil {
+		return nil, err
+	}
+	t, err := e.GetNum(EngineDbTime)
+	if err != nil {
+		return nil, err
+	}
+	return &DBInfo{
+		Version:    uint(ver),
+		Time:       time.Unix(int64(t), 0),
+		Signatures: e.Signatures(),
+	}, nil
+}
+
+// scan runs fn, which calls one of the libclamav scan functions on an object
+// of the given size, or -1 if unknown, with a fresh scan context and collects
+// its outcome into a Result.
+func (e *Engine) scan(path string, size int64, context interface{}, fn func(name **C.char, scanned *C.ulong, cctx unsafe.Pointer) C.int) (*Result, error) {
+	var name *C.char
+	var scanned C.ulong
+
+	sc := newScanContext(path, context)
+	end, err := beginScan(sc)
+	if err != nil {
+		return &Result{Path: path, Code: Eopen}, fmt.Errorf("capturing debug messages: %v", err)
+	}
+	defer end()
+	cctx := setContext(sc)
+	defer deleteContext(cctx)
+
+	start := time.Now()
+	code := ErrorCode(fn(&name, &scanned, cctx))
+	res := &Result{
+		Path:     path,
+		Scanned:  uint64(scanned) * CountPrecision,
+		Code:     code,
+		Duration: time.Since(start),
+	}
+	if code == Virus {
+		res.Virus = C.GoString(name)
+		sc.addMatch(res.Virus)
+	}
+	if code == Clean && sc.isAborted() {
+		// the files left were skipped, the scan is not clean
+		code, res.Code = Etimeout, Etimeout
+	}
+	res.Matches = sc.matches
+	res.FileType = sc.fileType
+	var conds Condition
+	res.Heuristics, conds = heuristics(res.Matches)
+	sc.mu.Lock()
+	res.Conditions = conds | sc.conds | conditionOf(code) | e.limitsHit(size, res.Scanned)
+	if sc.tree != nil {
+		res.Tree = sc.tree.finish(path, code, res.Virus)
+	}
+	sc.mu.Unlock()
+	if code != Clean && code != Virus {
+		return res, code
+	}
+	return res, nil
+}
+
+// limitsHit returns CondMaxSize if an object of the given size, scanned up to
+// scanned bytes, went over max_filesize or max_scansize. libclamav skips a
+// file larger than max_filesize and stops scanning once max_scansize bytes
+// were scanned, without telling.
+func (e *Engine) limitsHit(size int64, scanned uint64) Condition {
+	if max, err := e.GetNum(EngineMaxFilesize); err == nil && max > 0 && size > int64(max) {
+		return CondMaxSize
+	}
+	if max, err := e.GetNum(EngineMaxScansize); err == nil && max > 0 && scanned >= max {
+		return CondMaxSize
+	}
+	return 0
+}
+
+// fdSize returns the size of the file open on fd, -1 if unknown.
+func fdSize(fd int) int64 {
+	var st syscall.Stat_t
+	if syscall.Fstat(fd, &st) != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return -1
+	}
+	return st.Size
+}
+
+// ScanPath scans the file at path and reports every virus found in it when opts
+// includes ScanAllmatches.
+func (e *Engine) ScanPath(path string, opts uint, context interface{}) (*Result, error) {
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+	var size int64 = -1
+	if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+		size = fi.Size()
+	}
+	return e.scan(path, size, context, func(name **C.char, scanned *C.ulong, cctx unsafe.Pointer) C.int {
+		return C.cl_scanfile_callback(cpath, name, scanned, (*C.struct_cl_engine)(e), C.uint(opts), cctx)
+	})
+}
+
+// ScanFd scans the file open on the descriptor fd.
+func (e *Engine) ScanFd(fd int, opts uint, context interface{}) (*Result, error) {
+	return e.scan("", fdSize(fd), context, func(name **C.char, scanned *C.ulong, cctx unsafe.Pointer) C.int {
+		return C.cl_scandesc_callback(C.int(fd), name, scanned, (*C.struct_cl_engine)(e), C.uint(opts), cctx)
+	})
+}
+
+// ScanBytes scans an object held in memory. The buffer is copied so that
+// libclamav never holds on to Go memory.
+func (e *Engine) ScanBytes(buf []byte, opts uint, context interface{}) (*Result, error) {
+	if len(buf) == 0 {
+		return &Result{Code: Clean}, nil
+	}
+	cbuf := C.CBytes(buf)
+	defer C.free(cbuf)
+	fmap := C.cl_fmap_open_memory(cbuf, C.size_t(len(buf)))
+	if fmap == nil {
+		return &Result{Code: Emap}, ErrorCode(Emap)
+	}
+	defer C.cl_fmap_close(fmap)
+	return e.scan("", int64(len(buf)), context, func(name **C.char, scanned *C.ulong, cctx unsafe.Pointer) C.int {
+		return C.cl_scanmap_callback(fmap, name, scanned, (*C.struct_cl_engine)(e), C.uint(opts), cctx)
+	})
+}
+
+// ScanReader scans everything that can be read from r. Files are scanned
+// through their descriptor and spools in place; any other reader is first
+// spooled, in memory up to DefaultSpoolLimit bytes and on disk beyond that.
+func (e *Engine) ScanReader(r io.Reader, opts uint, context interface{}) (*Result, error) {
+	switch r := r.(type) {
+	case *Spool:
+		if f := r.File(); f != nil {
+			return e.ScanFd(int(f.Fd()), opts, context)
+		}
+		return e.ScanBytes(r.Bytes(), opts, context)
+	case *os.File:
+		res, err := e.ScanFd(int(r.Fd()), opts, context)
+		res.Path = r.Name()
+		return res, err
+	}
+	s, err := NewSpool(r, DefaultSpoolLimit, "")
+	if err != nil {
+		return &Result{Code: Eread}, err
+	}
+	defer s.Close()
+	return e.ScanReader(s, opts, context)
+}
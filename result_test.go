@@ -0,0 +1,68 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+var SpoolTests = []struct {
+	size, limit int64
+	onDisk      bool
+}{
+	{0, 16, false},
+	{16, 16, false},
+	{17, 16, true},
+	{1 << 20, 1024, true},
+}
+
+func TestSpool(t *testing.T) {
+	for _, tt := range SpoolTests {
+		data := bytes.Repeat([]byte{'a'}, int(tt.size))
+		s, err := NewSpool(bytes.NewReader(data), tt.limit, "")
+		if err != nil {
+			t.Fatalf("NewSpool(%d, %d): %v", tt.size, tt.limit, err)
+		}
+		if s.Size() != tt.size {
+			t.Errorf("NewSpool(%d, %d): size %d", tt.size, tt.limit, s.Size())
+		}
+		if (s.File() != nil) != tt.onDisk {
+			t.Errorf("NewSpool(%d, %d): on disk = %v, want %v", tt.size, tt.limit, s.File() != nil, tt.onDisk)
+		}
+		for i := 0; i < 2; i++ {
+			b, err := ioutil.ReadAll(s)
+			if err != nil || !bytes.Equal(b, data) {
+				t.Errorf("NewSpool(%d, %d): read %d bytes back (%v)", tt.size, tt.limit, len(b), err)
+			}
+			s.Rewind()
+		}
+		if err := s.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	}
+}
+
+func TestScanReader(t *testing.T) {
+	eng, err := testInitAll()
+	if err != nil {
+		t.Fatalf("testInitAll: %v", err)
+	}
+	defer eng.Free()
+
+	res, err := eng.ScanReader(bytes.NewReader(eicar), ScanStdopt|ScanAllmatches, nil)
+	if err != nil {
+		t.Fatalf("ScanReader: %v", err)
+	}
+	if !res.Infected() || len(res.Matches) == 0 {
+		t.Errorf("ScanReader: eicar not detected: %+v", res)
+	}
+
+	res, err = eng.ScanReader(bytes.NewReader([]byte("hello")), ScanStdopt, nil)
+	if err != nil || res.Infected() {
+		t.Errorf("ScanReader: clean data: %+v %v", res, err)
+	}
+}
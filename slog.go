@@ -0,0 +1,101 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// logger receives the messages of libclamav, see SetLogger
+var logger atomic.Value // *slog.Logger
+
+func currentLogger() *slog.Logger {
+	l, _ := logger.Load().(*slog.Logger)
+	return l
+}
+
+// SetLogger sends the messages of libclamav to l instead of stderr: verbose
+// information at slog.LevelInfo, warnings at slog.LevelWarn and errors at
+// slog.LevelError. Messages logged during a scan carry the path of the file,
+// when scanned by path, and the attributes added to the scan's context with
+// WithAttrs. A nil l discards the messages. A callback set with
+// SetMsgCallback is still called.
+//
+// Like SetMsgCallback, SetLogger should be called before Init so that the
+// messages of Init itself are not lost.
+func SetLogger(l *slog.Logger) {
+	logger.Store(l)
+	setMsgHook()
+}
+
+// attrContext is a scan context carrying log attributes, see WithAttrs, the
+// writer of its debug messages, see WithDebug, its profile, see WithProfile,
+// whether the tree of objects is wanted, see WithTree, and the temporary
+// directory of an Extractor.
+type attrContext struct {
+	value   interface{}
+	attrs   []slog.Attr
+	debug   io.Writer
+	profile string
+	tree    bool
+	tmpdir  string
+}
+
+// wrapContext returns a copy of context if it is an attrContext, or a new
+// attrContext wrapping it.
+func wrapContext(context interface{}) *attrContext {
+	if ac, ok := context.(*attrContext); ok {
+		c := *ac
+		c.attrs = append([]slog.Attr(nil), ac.attrs...)
+		return &c
+	}
+	return &attrContext{value: context}
+}
+
+// WithAttrs returns a scan context that attaches attrs, such as a request ID,
+// to the messages logged by libclamav while scanning with it. The callbacks
+// set on the engine receive context itself. The attributes of a context
+// already returned by WithAttrs are kept.
+func WithAttrs(context interface{}, attrs ...slog.Attr) interface{} {
+	ac := wrapContext(context)
+	ac.attrs = append(ac.attrs, attrs...)
+	return ac
+}
+
+// ContextValue returns the context wrapped by WithAttrs, WithDebug,
+// WithProfile and WithTree, or context itself.
+func ContextValue(context interface{}) interface{} {
+	if ac, ok := context.(*attrContext); ok {
+		return ac.value
+	}
+	return context
+}
+
+// msgLevels maps the severities of libclamav to slog levels
+var msgLevels = map[Msg]slog.Level{
+	MsgInfoVerbose: slog.LevelInfo,
+	MsgWarn:        slog.LevelWarn,
+	MsgError:       slog.LevelError,
+}
+
+func logMsg(l *slog.Logger, severity Msg, msg string, sc *scanContext) {
+	level, ok := msgLevels[severity]
+	if !ok {
+		level = slog.LevelError
+	}
+	ctx := context.Background()
+	if !l.Enabled(ctx, level) {
+		return
+	}
+	var attrs []slog.Attr
+	if sc != nil {
+		attrs = append(attrs, sc.attrs...)
+	}
+	l.LogAttrs(ctx, level, strings.TrimSpace(msg), append(attrs, slog.String("source", "libclamav"))...)
+}
@@ -0,0 +1,222 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// Snapshot is a readable copy of the fields of an engine, keyed by the names
+// in Fields. Unlike Settings it can be compared, see Diff, and saved as
+// JSON, a flat object such as {"max_files": 10000, "tmpdir": "/tmp"}.
+type Snapshot struct {
+	Nums    map[string]uint64 // fields of type FieldUint32, FieldUint64 and FieldTime
+	Strings map[string]string // fields of type FieldString
+}
+
+func newSnapshot() *Snapshot {
+	return &Snapshot{Nums: map[string]uint64{}, Strings: map[string]string{}}
+}
+
+// Snapshot reads every field of the engine. The read-only fields describe the
+// databases, and are zero until they are loaded.
+func (e *Engine) Snapshot() (*Snapshot, error) {
+	s := newSnapshot()
+	for _, f := range Fields {
+		if err := s.read(e, f); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Snapshot) read(e *Engine, f FieldInfo) error {
+	if f.Type == FieldString {
+		v, err := e.GetString(f.Field)
+		if err != nil {
+			return fmt.Errorf("Snapshot: %s: %v", f.Name, err)
+		}
+		s.Strings[f.Name] = v
+		return nil
+	}
+	v, err := e.GetNum(f.Field)
+	if err != nil {
+		return fmt.Errorf("Snapshot: %s: %v", f.Name, err)
+	}
+	s.Nums[f.Name] = v
+	return nil
+}
+
+// Snapshot reads the fields held by the settings, by applying them to a
+// scratch engine. The read-only fields are not part of the settings and are
+// left out.
+func (st *Settings) Snapshot() (*Snapshot, error) {
+	e := New()
+	defer e.Free()
+	if err := e.ApplySettings(st); err != nil {
+		return nil, err
+	}
+	s := newSnapshot()
+	for _, f := range Fields {
+		if f.ReadOnly {
+			continue
+		}
+		if err := s.read(e, f); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Apply sets the fields of the snapshot on an engine that is not compiled
+// yet. Read-only fields are skipped, as are empty strings, which stand for
+// the defaults of libclamav.
+func (s *Snapshot) Apply(e *Engine) error {
+	for _, f := range Fields {
+		if f.ReadOnly {
+			continue
+		}
+		if f.Type == FieldString {
+			if v := s.Strings[f.Name]; v != "" {
+				if err := e.SetString(f.Field, v); err != nil {
+					return fmt.Errorf("Apply: %s: %v", f.Name, err)
+				}
+			}
+			continue
+		}
+		if v, ok := s.Nums[f.Name]; ok {
+			if err := e.SetNum(f.Field, v); err != nil {
+				return fmt.Errorf("Apply: %s: %v", f.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// neutralFields are the writable fields that do not change the verdicts of
+// the scans, left out of Snapshot.Key.
+var neutralFields = map[string]bool{
+	"tmpdir":           true,
+	"keeptmp":          true,
+	"forcetodisk":      true,
+	"disable_cache":    true,
+	"disable_pe_stats": true,
+	"stats_timeout":    true,
+}
+
+// Key returns a digest of the fields of the snapshot that may change the
+// verdict of a scan, such as the limits. The read-only fields, which describe
+// the databases, are left out. Engines with the same databases and key report
+// the same verdicts for the same content and scan options.
+func (s *Snapshot) Key() string {
+	h := sha256.New()
+	for _, f := range Fields {
+		if f.ReadOnly || neutralFields[f.Name] {
+			continue
+		}
+		if v, ok := s.value(f); ok {
+			fmt.Fprintf(h, "%s=%v\n", f.Name, v)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// ScanKey returns the Key of the snapshot of the engine.
+func (e *Engine) ScanKey(context interface{}) (string, error) {
+	s, err := e.Snapshot()
+	if err != nil {
+		return "", err
+	}
+	return s.Key(), nil
+}
+
+// value returns the value of the field and whether the snapshot has it.
+func (s *Snapshot) value(f FieldInfo) (interface{}, bool) {
+	if f.Type == FieldString {
+		v, ok := s.Strings[f.Name]
+		return v, ok
+	}
+	v, ok := s.Nums[f.Name]
+	return v, ok
+}
+
+// MarshalJSON encodes the snapshot as a flat object.
+func (s *Snapshot) MarshalJSON() ([]byte, error) {
+	m := map[string]interface{}{}
+	for _, f := range Fields {
+		if v, ok := s.value(f); ok {
+			m[f.Name] = v
+		}
+	}
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON decodes a flat object, rejecting unknown fields and values of
+// the wrong type.
+func (s *Snapshot) UnmarshalJSON(b []byte) error {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	*s = *newSnapshot()
+	for name, raw := range m {
+		f, ok := FieldByName(name)
+		if !ok {
+			return fmt.Errorf("clamav: unknown engine field %q", name)
+		}
+		if f.Type == FieldString {
+			var v string
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return fmt.Errorf("clamav: engine field %s: want a string", name)
+			}
+			s.Strings[name] = v
+			continue
+		}
+		var v uint64
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return fmt.Errorf("clamav: engine field %s: want a non-negative number", name)
+		}
+		s.Nums[name] = v
+	}
+	return nil
+}
+
+// FieldDiff is a field whose value differs between two snapshots. Old or New
+// is nil if the field is missing from that snapshot.
+type FieldDiff struct {
+	Name     string      `json:"name"`
+	Old      interface{} `json:"old"`
+	New      interface{} `json:"new"`
+	ReadOnly bool        `json:"read_only,omitempty"` // describes the databases, not the configuration
+}
+
+func (d FieldDiff) String() string {
+	return fmt.Sprintf("%s: %v -> %v", d.Name, d.Old, d.New)
+}
+
+// Diff returns the fields that differ between two snapshots, in the order of
+// Fields.
+func Diff(from, to *Snapshot) []FieldDiff {
+	var diffs []FieldDiff
+	for _, f := range Fields {
+		o, inOld := from.value(f)
+		n, inNew := to.value(f)
+		if inOld == inNew && o == n {
+			continue
+		}
+		d := FieldDiff{Name: f.Name, ReadOnly: f.ReadOnly}
+		if inOld {
+			d.Old = o
+		}
+		if inNew {
+			d.New = n
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs
+}
@@ -0,0 +1,76 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotJSON(t *testing.T) {
+	s := &Snapshot{
+		Nums:    map[string]uint64{"max_files": 10000, "db_time": 1500000000},
+		Strings: map[string]string{"tmpdir": "/var/tmp"},
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"db_time":1500000000,"max_files":10000,"tmpdir":"/var/tmp"}`; string(b) != want {
+		t.Errorf("Marshal: got %s, want %s", b, want)
+	}
+	var got Snapshot
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, s) {
+		t.Errorf("Unmarshal: got %+v, want %+v", got, s)
+	}
+
+	for _, bad := range []string{`{"max_fies": 1}`, `{"tmpdir": 1}`, `{"max_files": -1}`, `[]`} {
+		if err := json.Unmarshal([]byte(bad), &got); err == nil {
+			t.Errorf("Unmarshal(%s): no error", bad)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := &Snapshot{
+		Nums:    map[string]uint64{"max_files": 10000, "max_recursion": 16, "db_version": 25000},
+		Strings: map[string]string{"tmpdir": "/tmp"},
+	}
+	b := &Snapshot{
+		Nums:    map[string]uint64{"max_files": 5000, "max_recursion": 16, "db_version": 25001, "keeptmp": 1},
+		Strings: map[string]string{"tmpdir": "/tmp"},
+	}
+	want := []FieldDiff{
+		{Name: "max_files", Old: uint64(10000), New: uint64(5000)},
+		{Name: "db_version", Old: uint64(25000), New: uint64(25001), ReadOnly: true},
+		{Name: "keeptmp", New: uint64(1)},
+	}
+	if got := Diff(a, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff: got %v, want %v", got, want)
+	}
+	if got := Diff(a, a); len(got) != 0 {
+		t.Errorf("Diff of a snapshot with itself: %v", got)
+	}
+}
+
+func TestSnapshotKey(t *testing.T) {
+	snap := func(maxFiles, dbVersion uint64, tmpdir string) *Snapshot {
+		return &Snapshot{
+			Nums:    map[string]uint64{"max_files": maxFiles, "db_version": dbVersion},
+			Strings: map[string]string{"tmpdir": tmpdir},
+		}
+	}
+	k := snap(10000, 1, "/tmp").Key()
+	if snap(10000, 2, "/var/tmp").Key() != k {
+		t.Errorf("key changed with the databases or the temporary directory")
+	}
+	if snap(100, 1, "/tmp").Key() == k {
+		t.Errorf("key did not change with max_files")
+	}
+}
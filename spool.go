@@ -0,0 +1,138 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// DefaultSpoolLimit is the number of bytes ScanReader keeps in memory before
+// spooling a stream to disk.
+const DefaultSpoolLimit = 4 << 20
+
+// A Spool holds a copy of a stream so that it can be scanned as a whole and
+// then read back, from memory when it is small and from a temporary file
+// otherwise. A Spool is an io.ReadSeeker positioned at the start of the data.
+type Spool struct {
+	limit int64
+	dir   string
+	buf   []byte
+	f     *os.File
+	r     io.ReadSeeker
+	size  int64
+}
+
+// NewSpool reads r to the end. Up to limit bytes are kept in memory; larger
+// streams are written to a temporary file in dir, or in the default temporary
+// directory if dir is empty. The spool must be closed to release the file.
+func NewSpool(r io.Reader, limit int64, dir string) (*Spool, error) {
+	s := NewSpoolWriter(limit, dir)
+	_, err := io.Copy(s, r)
+	if err == nil {
+		err = s.Rewind()
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewSpoolWriter returns an empty spool to be filled with Write, for data that
+// arrives piecemeal. The limit and dir are as for NewSpool.
+func NewSpoolWriter(limit int64, dir string) *Spool {
+	return &Spool{limit: limit, dir: dir}
+}
+
+// Write appends p to the spool, moving the data to disk once it outgrows the
+// memory limit. Write must not be called once the spool has been read.
+func (s *Spool) Write(p []byte) (int, error) {
+	if s.f == nil && s.size+int64(len(p)) > s.limit {
+		f, err := ioutil.TempFile(s.dir, "clamav-spool")
+		if err != nil {
+			return 0, err
+		}
+		if _, err := f.Write(s.buf); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return 0, err
+		}
+		s.f, s.buf = f, nil
+	}
+	if s.f != nil {
+		n, err := s.f.Write(p)
+		s.size += int64(n)
+		return n, err
+	}
+	s.buf = append(s.buf, p...)
+	s.size += int64(len(p))
+	return len(p), nil
+}
+
+// Read reads from the spooled data.
+func (s *Spool) Read(p []byte) (int, error) {
+	if s.r == nil {
+		if err := s.Rewind(); err != nil {
+			return 0, err
+		}
+	}
+	return s.r.Read(p)
+}
+
+// Seek sets the offset for the next Read.
+func (s *Spool) Seek(offset int64, whence int) (int64, error) {
+	if s.r == nil {
+		if err := s.Rewind(); err != nil {
+			return 0, err
+		}
+	}
+	return s.r.Seek(offset, whence)
+}
+
+// Rewind positions the spool at the start of the data.
+func (s *Spool) Rewind() error {
+	if s.f == nil {
+		s.r = bytes.NewReader(s.buf)
+		return nil
+	}
+	s.r = s.f
+	_, err := s.f.Seek(0, io.SeekStart)
+	return err
+}
+
+// Size returns the number of bytes spooled.
+func (s *Spool) Size() int64 {
+	return s.size
+}
+
+// Bytes returns the spooled data if it is held in memory, nil otherwise.
+func (s *Spool) Bytes() []byte {
+	if s.f != nil {
+		return nil
+	}
+	return s.buf
+}
+
+// File returns the temporary file holding the data if it was spooled to disk,
+// nil otherwise.
+func (s *Spool) File() *os.File {
+	return s.f
+}
+
+// Close releases the spooled data, removing the temporary file if any.
+func (s *Spool) Close() error {
+	s.buf, s.r = nil, nil
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	if rerr := os.Remove(s.f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -0,0 +1,186 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// TreeIndex remembers the outcome of earlier scans so that a Tree can skip
+// files that have not changed since they were found clean. The index
+// package provides a persistent implementation.
+type TreeIndex interface {
+	// Skip reports whether the file f, opened from path and described by
+	// fi, is known to be clean under the scans of k.
+	Skip(path string, f *os.File, fi os.FileInfo, k IndexKey) bool
+	// Record remembers the outcome of scanning f as k describes.
+	Record(path string, f *os.File, fi os.FileInfo, res *Result, k IndexKey) error
+}
+
+// IndexKey is what the verdicts of a TreeIndex depend on besides the
+// content: the databases, the scan options and the key of the scanner, see
+// Keyer.
+type IndexKey struct {
+	DB   *DBInfo
+	Opts uint
+	Key  string
+}
+
+// TreeStats counts what a Tree walk did.
+type TreeStats struct {
+	Directories uint64
+	Files       uint64 // files scanned
+	Skipped     uint64 // files skipped by the index
+	Infected    uint64
+	Errors      uint64 // files that could not be opened or scanned, and unreadable directories
+}
+
+// Tree scans every regular file under a set of directories with a pool of
+// workers. Symlinks are not followed. Files are scanned through a descriptor
+// opened without following symlinks, so that the index records exactly what
+// was scanned.
+type Tree struct {
+	Scanner Scanner
+	Options uint      // scan options, ScanStdopt if zero
+	Workers int       // number of concurrent scans, 1 if zero
+	Index   TreeIndex // optional index of earlier verdicts
+
+	// Result, if set, is called from the workers with the outcome of every
+	// file scanned. res is never nil.
+	Result func(path string, res *Result, err error)
+
+	// Skipped, if set, is called from the workers for every file skipped
+	// because the index knows it to be clean.
+	Skipped func(path string)
+
+	// WalkError, if set, is called for every directory or file that could
+	// not be examined.
+	WalkError func(path string, err error)
+
+	// IndexError, if set, is called for every verdict the index could not
+	// record. The file is still counted as scanned.
+	IndexError func(path string, err error)
+}
+
+// Walk scans the trees rooted at roots, which may also name single files,
+// and returns once every file has been scanned.
+func (t *Tree) Walk(roots ...string) *TreeStats {
+	st := new(TreeStats)
+	workers := t.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	paths := make(chan string, 1024)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for p := range paths {
+				t.scan(p, st)
+			}
+		}()
+	}
+	for _, r := range roots {
+		t.walk(r, paths, st)
+	}
+	close(paths)
+	wg.Wait()
+	return st
+}
+
+func (t *Tree) walkError(path string, err error, st *TreeStats) {
+	atomic.AddUint64(&st.Errors, 1)
+	if t.WalkError != nil {
+		t.WalkError(path, err)
+	}
+}
+
+func (t *Tree) walk(path string, paths chan<- string, st *TreeStats) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.walkError(path, err, st)
+		return
+	}
+	switch {
+	case fi.IsDir():
+		atomic.AddUint64(&st.Directories, 1)
+		ents, err := ioutil.ReadDir(path)
+		if err != nil {
+			t.walkError(path, err, st)
+			return
+		}
+		for _, e := range ents {
+			t.walk(filepath.Join(path, e.Name()), paths, st)
+		}
+	case fi.Mode().IsRegular():
+		paths <- path
+	}
+}
+
+func (t *Tree) scan(path string, st *TreeStats) {
+	opts := t.Options
+	if opts == 0 {
+		opts = ScanStdopt
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.result(path, &Result{Path: path, Code: Eopen}, err, st)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.result(path, &Result{Path: path, Code: Estat}, err, st)
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		return
+	}
+
+	var k IndexKey
+	if t.Index != nil {
+		k.DB, _ = t.Scanner.DBInfo()
+		k.Opts = opts
+		if key, err := ScanKey(t.Scanner, path); err != nil {
+			k.DB = nil
+		} else {
+			k.Key = key
+		}
+		if k.DB != nil && t.Index.Skip(path, f, fi, k) {
+			atomic.AddUint64(&st.Skipped, 1)
+			if t.Skipped != nil {
+				t.Skipped(path)
+			}
+			return
+		}
+	}
+	res, err := t.Scanner.ScanFd(int(f.Fd()), opts, path)
+	res.Path = path
+	if k.DB != nil && err == nil {
+		if ierr := t.Index.Record(path, f, fi, res, k); ierr != nil && t.IndexError != nil {
+			t.IndexError(path, ierr)
+		}
+	}
+	t.result(path, res, err, st)
+}
+
+func (t *Tree) result(path string, res *Result, err error, st *TreeStats) {
+	atomic.AddUint64(&st.Files, 1)
+	switch {
+	case err != nil:
+		atomic.AddUint64(&st.Errors, 1)
+	case res.Infected():
+		atomic.AddUint64(&st.Infected, 1)
+	}
+	if t.Result != nil {
+		t.Result(path, res, err)
+	}
+}
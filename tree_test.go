@@ -0,0 +1,106 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package clamav
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// treeScanner reports files containing the EICAR string as infected.
+type treeScanner struct{}
+
+func (treeScanner) ScanPath(path string, opts uint, context interface{}) (*Result, error) {
+	return &Result{Code: Clean}, nil
+}
+
+func (treeScanner) ScanFd(fd int, opts uint, context interface{}) (*Result, error) {
+	b := make([]byte, 4096)
+	n, _ := syscall.Pread(fd, b, 0)
+	if n > 0 && bytes.Contains(b[:n], eicar) {
+		return &Result{Code: Virus, Virus: "Eicar-Test-Signature"}, nil
+	}
+	return &Result{Code: Clean}, nil
+}
+
+func (treeScanner) ScanReader(r io.Reader, opts uint, context interface{}) (*Result, error) {
+	return &Result{Code: Clean}, nil
+}
+
+func (treeScanner) DBInfo() (*DBInfo, error) {
+	return &DBInfo{Version: 1}, nil
+}
+
+// mapIndex skips the files it recorded as clean.
+type mapIndex struct {
+	sync.Mutex
+	clean map[string]bool
+	err   error // returned by Record, if set
+}
+
+func (m *mapIndex) Skip(path string, f *os.File, fi os.FileInfo, k IndexKey) bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.clean[path]
+}
+
+func (m *mapIndex) Record(path string, f *os.File, fi os.FileInfo, res *Result, k IndexKey) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.clean[path] = res.Code == Clean
+	return nil
+}
+
+func TestTree(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	os.MkdirAll(filepath.Join(tmp, "a", "b"), 0700)
+	ioutil.WriteFile(filepath.Join(tmp, "a", "clean"), []byte("hello"), 0600)
+	ioutil.WriteFile(filepath.Join(tmp, "a", "b", "eicar"), eicar, 0600)
+	os.Symlink(filepath.Join(tmp, "a", "b", "eicar"), filepath.Join(tmp, "link"))
+
+	tr := &Tree{Scanner: treeScanner{}, Workers: 2, Index: &mapIndex{clean: map[string]bool{}}}
+	st := tr.Walk(tmp)
+	if st.Directories != 3 || st.Files != 2 || st.Infected != 1 || st.Skipped != 0 || st.Errors != 0 {
+		t.Errorf("first walk: %+v", st)
+	}
+	st = tr.Walk(tmp)
+	if st.Files != 1 || st.Infected != 1 || st.Skipped != 1 {
+		t.Errorf("second walk: %+v", st)
+	}
+}
+
+func TestTreeIndexError(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	ioutil.WriteFile(filepath.Join(tmp, "clean"), []byte("hello"), 0600)
+
+	var failed []string
+	tr := &Tree{
+		Scanner:    treeScanner{},
+		Index:      &mapIndex{clean: map[string]bool{}, err: errors.New("disk full")},
+		IndexError: func(path string, err error) { failed = append(failed, path) },
+	}
+	st := tr.Walk(tmp)
+	if st.Files != 1 || st.Errors != 0 || len(failed) != 1 {
+		t.Errorf("walk with a failing index: %+v, IndexError called for %q", st, failed)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package watch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	errNotDir = errors.New("not a directory")
+	errLimit  = errors.New("inotify watch limit reached")
+)
+
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF |
+	syscall.IN_ONLYDIR | syscall.IN_DONT_FOLLOW | syscall.IN_EXCL_UNLINK
+
+// sys holds the inotify instance and its watch descriptors.
+type sys struct {
+	f   *os.File
+	fd  int
+	wmu sync.Mutex
+	wds map[int]watched // watch descriptor to directory
+}
+
+// watched is a watched directory. inotify returns the same watch descriptor
+// when the directory is watched again under a new name.
+type watched struct {
+	path     string
+	dev, ino uint64
+}
+
+func (w *Watcher) init() error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	// a non-blocking descriptor is handled by the runtime poller, so that
+	// closing the file interrupts a pending read
+	w.f = os.NewFile(uintptr(fd), "inotify")
+	w.fd = fd
+	w.wds = map[int]watched{}
+	return nil
+}
+
+func (w *Watcher) close() error {
+	return w.f.Close()
+}
+
+func (w *Watcher) watchDir(dir string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, watchMask)
+	if err == syscall.ENOSPC {
+		return errLimit
+	}
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	d := watched{path: dir}
+	var st syscall.Stat_t
+	if syscall.Lstat(dir, &st) == nil {
+		d.dev, d.ino = uint64(st.Dev), uint64(st.Ino)
+	}
+	w.wmu.Lock()
+	w.wds[wd] = d
+	w.wmu.Unlock()
+	return nil
+}
+
+// movedOut reports whether the directory d, which was moved, is no longer at
+// its path: it was not watched again under a new name in a watched tree.
+func movedOut(d watched) bool {
+	var st syscall.Stat_t
+	err := syscall.Lstat(d.path, &st)
+	return err != nil || uint64(st.Dev) != d.dev || uint64(st.Ino) != d.ino
+}
+
+func (w *Watcher) readEvents() {
+	defer w.wg.Done()
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			select {
+			case <-w.done:
+			default:
+				w.logf("watch: reading inotify events: %v", err)
+			}
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			w.handle(int(ev.Wd), ev.Mask, string(trimNul(name)))
+		}
+	}
+}
+
+func trimNul(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
+
+func (w *Watcher) handle(wd int, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.logf("watch: inotify event queue overflowed, rescanning")
+		w.rescanLater()
+		return
+	}
+	w.wmu.Lock()
+	d, ok := w.wds[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.wds, wd)
+	}
+	// a directory moved within a watched tree was watched again under its
+	// new name when its new parent reported it, which comes first, and
+	// keeps its watch descriptor; one moved out is forgotten
+	out := ok && mask&syscall.IN_MOVE_SELF != 0 && movedOut(d)
+	if out {
+		delete(w.wds, wd)
+	}
+	w.wmu.Unlock()
+	if !ok {
+		return
+	}
+	dir := d.path
+
+	switch {
+	case mask&syscall.IN_MOVE_SELF != 0:
+		if out {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+		}
+	case mask&syscall.IN_ISDIR != 0:
+		if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			// watched right away, for the events that follow
+			var files []string
+			w.addTree(filepath.Join(dir, name), &files)
+			w.sendLater(files)
+		}
+	case mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0:
+		w.event(filepath.Join(dir, name))
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package watch
+
+import "errors"
+
+var (
+	errNotDir = errors.New("not a directory")
+	errLimit  = errors.New("watch limit reached")
+)
+
+// sys is empty: without inotify every directory is polled.
+type sys struct{}
+
+func (w *Watcher) init() error {
+	return nil
+}
+
+func (w *Watcher) close() error {
+	return nil
+}
+
+func (w *Watcher) watchDir(dir string) error {
+	return errors.New("directory notifications not supported on this system")
+}
+
+func (w *Watcher) readEvents() {
+	w.wg.Done()
+}
@@ -0,0 +1,343 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+// Package watch monitors directory trees and reports files that are written
+// or moved into them, so that they can be scanned as soon as they arrive.
+//
+// On Linux the trees are watched with inotify. A file is reported once it
+// has been closed after writing (IN_CLOSE_WRITE) or moved into a watched
+// directory (IN_MOVED_TO) and no further events arrived for it during the
+// debounce interval. New subdirectories are watched as they appear and the
+// files already in them are reported. When the kernel's event queue
+// overflows every tree is rescanned, and directories that could not be
+// watched because the inotify watch limit was reached are polled instead.
+package watch
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Defaults for the Watcher settings
+const (
+	DefaultDebounce = 500 * time.Millisecond
+	DefaultPoll     = time.Minute
+)
+
+// errClosed stops the walks of a closed Watcher
+var errClosed = errors.New("watcher closed")
+
+// Watcher reports the files written into the trees added to it on the
+// channel returned by Files.
+type Watcher struct {
+	debounce time.Duration
+	poll     time.Duration
+	files    chan string
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	mu        sync.Mutex
+	roots     []string
+	pending   map[string]*time.Timer
+	unwatched map[string]time.Time // directories polled instead of watched, with the time of the last poll
+	closed    bool
+	rescan    int // rescans running or asked for by rescanLater, at most 2
+
+	sys // the platform's notification mechanism
+
+	// ErrorLog logs errors and fallbacks, the log package's default if nil.
+	ErrorLog *log.Logger
+}
+
+// New returns a Watcher that reports a file debounce after the last event for
+// it and polls unwatchable directories every poll. Zero durations select the
+// defaults.
+func New(debounce, poll time.Duration) (*Watcher, error) {
+	if debounce <= 0 {
+		debounce = DefaultDebounce
+	}
+	if poll <= 0 {
+		poll = DefaultPoll
+	}
+	w := &Watcher{
+		debounce:  debounce,
+		poll:      poll,
+		files:     make(chan string, 1024),
+		done:      make(chan struct{}),
+		pending:   map[string]*time.Timer{},
+		unwatched: map[string]time.Time{},
+	}
+	if err := w.init(); err != nil {
+		return nil, err
+	}
+	w.wg.Add(2)
+	go w.readEvents()
+	go w.poller()
+	return w, nil
+}
+
+// Files returns the channel on which files are reported. It is closed by
+// Close.
+func (w *Watcher) Files() <-chan string {
+	return w.files
+}
+
+// Add watches the tree rooted at dir. Files already in it are not reported;
+// call Rescan for that.
+func (w *Watcher) Add(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return &os.PathError{Op: "watch", Path: dir, Err: errNotDir}
+	}
+	w.mu.Lock()
+	w.roots = append(w.roots, dir)
+	w.mu.Unlock()
+	w.addTree(dir, nil)
+	return nil
+}
+
+// Rescan reports every file in the watched trees. It may run concurrently
+// with Close, which stops it and waits for it to return.
+func (w *Watcher) Rescan() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	// Close waits for the walk before closing the channel
+	w.wg.Add(1)
+	defer w.wg.Done()
+	roots := append([]string(nil), w.roots...)
+	w.mu.Unlock()
+	for _, r := range roots {
+		w.walk(r, time.Time{})
+	}
+}
+
+// rescanLater rescans the trees in the background, once more if a rescan is
+// running already, so that the reader of the events does not wait.
+func (w *Watcher) rescanLater() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed || w.rescan == 2 {
+		return
+	}
+	w.rescan++
+	if w.rescan == 2 {
+		// the running rescan goes on with another
+		return
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		for {
+			w.Rescan()
+			w.mu.Lock()
+			w.rescan--
+			again := w.rescan > 0 && !w.closed
+			w.mu.Unlock()
+			if !again {
+				return
+			}
+		}
+	}()
+}
+
+// Close stops watching and closes the Files channel. Files waiting for their
+// debounce interval are dropped.
+func (w *Watcher) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	for p, t := range w.pending {
+		t.Stop()
+		delete(w.pending, p)
+	}
+	w.mu.Unlock()
+
+	close(w.done)
+	err := w.close()
+	w.wg.Wait()
+	close(w.files)
+	return err
+}
+
+func (w *Watcher) logf(format string, args ...interface{}) {
+	if w.ErrorLog != nil {
+		w.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// addTree watches dir and its subdirectories, adding the files in them to
+// files if it is not nil. Directories that can not be watched are polled.
+func (w *Watcher) addTree(dir string, files *[]string) {
+	if err := w.watchDir(dir); err != nil {
+		if err == errLimit {
+			w.logf("watch: %s: inotify watch limit reached, polling every %v", dir, w.poll)
+		} else {
+			w.logf("watch: %s: %v, polling every %v", dir, err, w.poll)
+		}
+		w.mu.Lock()
+		w.unwatched[dir] = time.Now()
+		w.mu.Unlock()
+	}
+	ents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		w.logf("watch: %v", err)
+		return
+	}
+	for _, fi := range ents {
+		p := filepath.Join(dir, fi.Name())
+		switch {
+		case fi.IsDir():
+			w.addTree(p, files)
+		case files != nil && fi.Mode().IsRegular():
+			*files = append(*files, p)
+		}
+	}
+}
+
+// walk reports the regular files under dir modified after since, until the
+// Watcher is closed. Symlinks are not followed.
+func (w *Watcher) walk(dir string, since time.Time) {
+	filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		select {
+		case <-w.done:
+			return errClosed
+		default:
+		}
+		if err != nil {
+			w.logf("watch: %v", err)
+			return nil
+		}
+		if fi.Mode().IsRegular() && fi.ModTime().After(since) {
+			w.send(p)
+		}
+		return nil
+	})
+}
+
+// event schedules path to be reported once no events arrived for it for the
+// debounce interval.
+func (w *Watcher) event(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	if t, ok := w.pending[path]; ok {
+		t.Reset(w.debounce)
+		return
+	}
+	w.pending[path] = time.AfterFunc(w.debounce, func() {
+		w.mu.Lock()
+		delete(w.pending, path)
+		if w.closed {
+			w.mu.Unlock()
+			return
+		}
+		// Close waits for the send before closing the channel
+		w.wg.Add(1)
+		w.mu.Unlock()
+		w.send(path)
+		w.wg.Done()
+	})
+}
+
+func (w *Watcher) send(path string) {
+	select {
+	case w.files <- path:
+	case <-w.done:
+	}
+}
+
+// sendLater reports paths in the background, so that the reader of the
+// events does not wait.
+func (w *Watcher) sendLater(paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		for _, p := range paths {
+			w.send(p)
+		}
+	}()
+}
+
+// poller walks the unwatched directories, reporting files changed since the
+// last poll, and tries to watch them again.
+func (w *Watcher) poller() {
+	defer w.wg.Done()
+	t := time.NewTicker(w.poll)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-t.C:
+		}
+		w.mu.Lock()
+		dirs := make(map[string]time.Time, len(w.unwatched))
+		for d, last := range w.unwatched {
+			dirs[d] = last
+		}
+		w.mu.Unlock()
+
+		for d, last := range dirs {
+			now := time.Now()
+			ents, err := ioutil.ReadDir(d)
+			if err != nil {
+				if os.IsNotExist(err) {
+					w.mu.Lock()
+					delete(w.unwatched, d)
+					w.mu.Unlock()
+				}
+				continue
+			}
+			for _, fi := range ents {
+				if !fi.ModTime().After(last) {
+					continue
+				}
+				p := filepath.Join(d, fi.Name())
+				switch {
+				case fi.IsDir():
+					var files []string
+					w.addTree(p, &files)
+					for _, f := range files {
+						w.send(f)
+					}
+				case fi.Mode().IsRegular():
+					w.send(p)
+				}
+			}
+			w.mu.Lock()
+			if err := w.watchDir(d); err == nil {
+				delete(w.unwatched, d)
+			} else {
+				w.unwatched[d] = now
+			}
+			w.mu.Unlock()
+		}
+	}
+}
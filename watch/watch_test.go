@@ -0,0 +1,170 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package watch
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func expect(t *testing.T, w *Watcher, want string) {
+	select {
+	case got := <-w.Files():
+		if got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", want)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("inotify only")
+	}
+	tmp, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	outside, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	w, err := New(20*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	// a file written in several steps is reported once
+	p := filepath.Join(tmp, "upload")
+	for i := 0; i < 3; i++ {
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString("data\n")
+		f.Close()
+	}
+	expect(t, w, p)
+
+	// files in a new subdirectory, and then the files written into it
+	sub := filepath.Join(outside, "sub")
+	os.Mkdir(sub, 0700)
+	ioutil.WriteFile(filepath.Join(sub, "old"), []byte("x"), 0600)
+	if err := os.Rename(sub, filepath.Join(tmp, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, w, filepath.Join(tmp, "sub", "old"))
+	ioutil.WriteFile(filepath.Join(tmp, "sub", "new"), []byte("x"), 0600)
+	expect(t, w, filepath.Join(tmp, "sub", "new"))
+
+	// a file moved in
+	src := filepath.Join(outside, "moved")
+	ioutil.WriteFile(src, []byte("x"), 0600)
+	os.Rename(src, filepath.Join(tmp, "moved"))
+	expect(t, w, filepath.Join(tmp, "moved"))
+
+	select {
+	case p := <-w.Files():
+		t.Errorf("unexpected %s", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWatchMoved(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("inotify only")
+	}
+	tmp, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	os.Mkdir(filepath.Join(tmp, "a"), 0700)
+
+	w, err := New(20*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	// a directory moved within the tree is still watched under its new name
+	if err := os.Rename(filepath.Join(tmp, "a"), filepath.Join(tmp, "b")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond) // for the events of the move
+	p := filepath.Join(tmp, "b", "new")
+	ioutil.WriteFile(p, []byte("x"), 0600)
+	expect(t, w, p)
+}
+
+func TestRescan(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	os.Mkdir(filepath.Join(tmp, "d"), 0700)
+	ioutil.WriteFile(filepath.Join(tmp, "d", "f"), []byte("x"), 0600)
+
+	w, err := New(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+	go w.Rescan()
+	expect(t, w, filepath.Join(tmp, "d", "f"))
+}
+
+func TestRescanClose(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	for i := 0; i < 2000; i++ {
+		ioutil.WriteFile(filepath.Join(tmp, fmt.Sprint(i)), nil, 0600)
+	}
+
+	w, err := New(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+	drained := make(chan bool)
+	go func() {
+		for range w.Files() {
+		}
+		close(drained)
+	}()
+	for i := 0; i < 4; i++ {
+		go w.Rescan()
+	}
+	// closing while the rescans send must not panic
+	time.Sleep(time.Millisecond)
+	w.Close()
+	<-drained
+	w.Rescan()
+}
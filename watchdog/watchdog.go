@@ -0,0 +1,217 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+// Package watchdog reports the scans that run for too long, naming the file
+// and the type of the inner file libclamav was working on, and optionally
+// aborts them.
+//
+// A Watchdog is an http.Handler describing the scans in progress as JSON,
+// meant for a debug endpoint:
+//
+//	dog := watchdog.New(5 * time.Minute)
+//	go dog.Run(nil)
+//	http.Handle("/debug/scans", dog)
+//
+// POST /debug/scans?abort=ID aborts a scan by hand. See clamav.InFlight and
+// clamav.AbortScan for what can and can not be seen and aborted.
+package watchdog
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// DefaultThreshold is used when the Threshold of a Watchdog is zero.
+const DefaultThreshold = 5 * time.Minute
+
+// Watchdog checks the scans in progress. Its fields must be set before Run.
+type Watchdog struct {
+	Threshold time.Duration // scans running longer are stuck, DefaultThreshold if zero
+	Interval  time.Duration // how often Run checks, a tenth of the threshold if zero
+	Abort     bool          // abort the stuck scans
+
+	// OnStuck, if set, is called once for every stuck scan, in addition to
+	// logging it.
+	OnStuck func(s *clamav.ScanInfo)
+
+	// ErrorLog logs the stuck scans, the log package's default if nil.
+	ErrorLog *log.Logger
+
+	// where the scans come from, replaced by tests
+	inFlight func() []clamav.ScanInfo
+	abort    func(id uint64) bool
+
+	mu       sync.Mutex
+	reported map[uint64]bool
+}
+
+// New returns a Watchdog flagging the scans running longer than threshold.
+func New(threshold time.Duration) *Watchdog {
+	return &Watchdog{Threshold: threshold}
+}
+
+func (w *Watchdog) threshold() time.Duration {
+	if w.Threshold <= 0 {
+		return DefaultThreshold
+	}
+	return w.Threshold
+}
+
+func (w *Watchdog) interval() time.Duration {
+	if w.Interval <= 0 {
+		return w.threshold() / 10
+	}
+	return w.Interval
+}
+
+func (w *Watchdog) scans() []clamav.ScanInfo {
+	if w.inFlight != nil {
+		return w.inFlight()
+	}
+	return clamav.InFlight()
+}
+
+func (w *Watchdog) abortScan(id uint64) bool {
+	if w.abort != nil {
+		return w.abort(id)
+	}
+	return clamav.AbortScan(id)
+}
+
+func (w *Watchdog) logf(format string, args ...interface{}) {
+	if w.ErrorLog != nil {
+		w.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// Check returns the stuck scans. Those seen for the first time are logged,
+// passed to OnStuck and, if Abort is set, aborted.
+func (w *Watchdog) Check() []clamav.ScanInfo {
+	var stuck []clamav.ScanInfo
+	running := map[uint64]bool{}
+	for _, s := range w.scans() {
+		running[s.ID] = true
+		if s.Elapsed() >= w.threshold() {
+			stuck = append(stuck, s)
+		}
+	}
+
+	w.mu.Lock()
+	if w.reported == nil {
+		w.reported = map[uint64]bool{}
+	}
+	for id := range w.reported {
+		if !running[id] {
+			delete(w.reported, id)
+		}
+	}
+	var fresh []int
+	for i, s := range stuck {
+		if !w.reported[s.ID] {
+			w.reported[s.ID] = true
+			fresh = append(fresh, i)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, i := range fresh {
+		s := &stuck[i]
+		w.logf("watchdog: %s", describe(s))
+		if w.OnStuck != nil {
+			w.OnStuck(s)
+		}
+		if w.Abort && !s.Aborted {
+			s.Aborted = w.abortScan(s.ID)
+		}
+	}
+	return stuck
+}
+
+// describe names the scan and tells where it is.
+func describe(s *clamav.ScanInfo) string {
+	what := s.Path
+	if what == "" {
+		what = fmt.Sprint(s.Context)
+	}
+	msg := fmt.Sprintf("scan %d of %s running for %v", s.ID, what, s.Elapsed().Round(time.Second))
+	if s.FileType != "" {
+		msg += ", a " + s.FileType
+	}
+	if s.InnerType != "" {
+		msg += fmt.Sprintf(", in a %s after %d files", s.InnerType, s.Files)
+	}
+	return msg
+}
+
+// Run checks the scans every interval until stop is closed.
+func (w *Watchdog) Run(stop <-chan struct{}) {
+	t := time.NewTicker(w.interval())
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			w.Check()
+		}
+	}
+}
+
+// Scan describes a scan in progress in the JSON of ServeHTTP.
+type Scan struct {
+	clamav.ScanInfo
+	Context string  `json:"context,omitempty"`
+	Elapsed float64 `json:"elapsed_seconds"`
+	Stuck   bool    `json:"stuck"`
+}
+
+// Status is the JSON body returned by ServeHTTP.
+type Status struct {
+	Threshold float64 `json:"threshold_seconds"`
+	Scans     []Scan  `json:"scans"`
+}
+
+// ServeHTTP describes the scans in progress, oldest first. A POST with an
+// abort parameter aborts the scan with that ID.
+func (w *Watchdog) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if v := r.URL.Query().Get("abort"); v != "" {
+		if r.Method != http.MethodPost {
+			rw.Header().Set("Allow", "POST")
+			http.Error(rw, "abort needs a POST", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(rw, "bad scan ID", http.StatusBadRequest)
+			return
+		}
+		if !w.abortScan(id) {
+			http.Error(rw, "no such scan", http.StatusNotFound)
+			return
+		}
+		w.logf("watchdog: aborting scan %d by request", id)
+	}
+
+	st := Status{Threshold: w.threshold().Seconds(), Scans: []Scan{}}
+	for _, s := range w.scans() {
+		sc := Scan{ScanInfo: s, Elapsed: s.Elapsed().Seconds(), Stuck: s.Elapsed() >= w.threshold()}
+		if s.Context != nil {
+			sc.Context = fmt.Sprint(s.Context)
+		}
+		st.Scans = append(st.Scans, sc)
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "\t")
+	enc.Encode(st)
+}
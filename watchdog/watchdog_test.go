@@ -0,0 +1,107 @@
+// Copyright 2013 the Go ClamAV authors
+// Use of this source code is governed by a
+// license that can be found in the LICENSE file.
+
+package watchdog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mirtchovski/clamav"
+)
+
+// fakeScans stands in for clamav.InFlight and clamav.AbortScan
+type fakeScans struct {
+	scans   []clamav.ScanInfo
+	aborted []uint64
+}
+
+func (f *fakeScans) inFlight() []clamav.ScanInfo {
+	return f.scans
+}
+
+func (f *fakeScans) abort(id uint64) bool {
+	for i := range f.scans {
+		if f.scans[i].ID == id {
+			f.scans[i].Aborted = true
+			f.aborted = append(f.aborted, id)
+			return true
+		}
+	}
+	return false
+}
+
+func newTestWatchdog(f *fakeScans) *Watchdog {
+	w := New(time.Minute)
+	w.inFlight, w.abort = f.inFlight, f.abort
+	w.ErrorLog = log.New(ioutil.Discard, "", 0)
+	return w
+}
+
+func TestCheck(t *testing.T) {
+	now := time.Now()
+	f := &fakeScans{scans: []clamav.ScanInfo{
+		{ID: 1, Path: "/srv/ok.txt", Start: now},
+		{ID: 2, Path: "/srv/bomb.zip", Start: now.Add(-2 * time.Minute), FileType: "CL_TYPE_ZIP", InnerType: "CL_TYPE_PDF", Files: 12},
+	}}
+	w := newTestWatchdog(f)
+	w.Abort = true
+	var flagged []uint64
+	w.OnStuck = func(s *clamav.ScanInfo) { flagged = append(flagged, s.ID) }
+
+	stuck := w.Check()
+	if len(stuck) != 1 || stuck[0].ID != 2 || !stuck[0].Aborted {
+		t.Errorf("Check: got %+v, want scan 2 aborted", stuck)
+	}
+	if len(f.aborted) != 1 || f.aborted[0] != 2 {
+		t.Errorf("aborted %v, want [2]", f.aborted)
+	}
+
+	// a stuck scan is reported once
+	w.Check()
+	if len(flagged) != 1 {
+		t.Errorf("OnStuck called for %v, want [2]", flagged)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	f := &fakeScans{scans: []clamav.ScanInfo{
+		{ID: 7, Path: "/srv/slow.doc", Start: time.Now().Add(-time.Hour)},
+	}}
+	w := newTestWatchdog(f)
+
+	rec := httptest.NewRecorder()
+	w.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/scans", nil))
+	var st Status
+	if err := json.NewDecoder(rec.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Scans) != 1 || st.Scans[0].ID != 7 || !st.Scans[0].Stuck || st.Scans[0].Path != "/srv/slow.doc" {
+		t.Errorf("GET: got %+v", st)
+	}
+
+	for _, tt := range []struct {
+		method, query string
+		code          int
+	}{
+		{"GET", "?abort=7", http.StatusMethodNotAllowed},
+		{"POST", "?abort=x", http.StatusBadRequest},
+		{"POST", "?abort=8", http.StatusNotFound},
+		{"POST", "?abort=7", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		w.ServeHTTP(rec, httptest.NewRequest(tt.method, "/debug/scans"+tt.query, nil))
+		if rec.Code != tt.code {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.query, rec.Code, tt.code)
+		}
+	}
+	if len(f.aborted) != 1 {
+		t.Errorf("aborted %v, want [7]", f.aborted)
+	}
+}